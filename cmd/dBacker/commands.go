@@ -18,6 +18,37 @@ var defaultFlags = []cli.Flag{
 		Value:  "/tmp",
 		EnvVar: "SAVE_DIR",
 	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "compression",
+		Usage:  "compression algorithm for backups (none, gzip, zstd, xz, lz4, bz2, brotli), enables compression when set",
+		EnvVar: "COMPRESSION",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "compression-level",
+		Usage:  "compression level (0 for the algorithm default)",
+		EnvVar: "COMPRESSION_LEVEL",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "compression-block-size",
+		Usage:  "size in KiB of the blocks compressed in parallel by gzip (0 for 1024)",
+		EnvVar: "COMPRESSION_BLOCK_SIZE",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "compression-concurrency",
+		Usage:  "number of gzip blocks compressed in parallel (0 for the number of CPUs)",
+		EnvVar: "COMPRESSION_CONCURRENCY",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "dedup",
+		Usage:  "store backups split in deduplicated chunks",
+		EnvVar: "DEDUP",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "dedup-chunk-size",
+		Usage:  "average size in KiB of the deduplicated chunks",
+		Value:  1024,
+		EnvVar: "DEDUP_CHUNK_SIZE",
+	}),
 }
 
 var backupFlags = []cli.Flag{
@@ -47,6 +78,31 @@ var restoreFlags = []cli.Flag{
 		Usage:  "restore from this file instead of searching for the most recent",
 		EnvVar: "RESTORE_FILE",
 	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "restore-stream",
+		Usage:  "restore while downloading the backup instead of saving it to disk first",
+		EnvVar: "RESTORE_STREAM",
+	}),
+}
+
+var binlogFlags = []cli.Flag{
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "binlog-start",
+		Usage:  "binlog file to start archiving from when the spool directory is empty",
+		EnvVar: "BINLOG_START_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "binlog-spool-dir",
+		Usage:  "directory to write binlogs to before uploading them",
+		Value:  "/tmp/binlog",
+		EnvVar: "BINLOG_SPOOL_DIR",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "binlog-interval",
+		Usage:  "seconds between checks for closed binlogs",
+		Value:  60,
+		EnvVar: "BINLOG_INTERVAL",
+	}),
 }
 
 func backupCmd() cli.Command {
@@ -61,6 +117,7 @@ func backupCmd() cli.Command {
 			giteaCmd(name),
 			postgresCmd(name),
 			mysqlCmd(name),
+			mysqlPhysicalCmd(name),
 			tarballCmd(name),
 			consulCmd(name),
 		},
@@ -79,8 +136,23 @@ func restoreCmd() cli.Command {
 			giteaCmd(name),
 			postgresCmd(name),
 			mysqlCmd(name),
+			mysqlPhysicalCmd(name),
 			tarballCmd(name),
 			consulCmd(name),
 		},
 	}
 }
+
+func binlogCmd() cli.Command {
+	name := "binlog"
+	flags := append(defaultFlags, binlogFlags...)
+	return cli.Command{
+		Name:   name,
+		Usage:  "archive binlogs continuously",
+		Flags:  flags,
+		Before: applyConfigValues(flags),
+		Subcommands: []cli.Command{
+			mysqlCmd(name),
+		},
+	}
+}
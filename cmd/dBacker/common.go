@@ -3,10 +3,13 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,6 +23,9 @@ import (
 
 type task func(c *cli.Context) error
 
+// binlogRetryDelay is the time to wait before restarting a failed binlog archiver
+var binlogRetryDelay = 30 * time.Second
+
 func getService(c *cli.Context, service string) services.Service {
 	var config services.Service
 	switch service {
@@ -27,6 +33,8 @@ func getService(c *cli.Context, service string) services.Service {
 		config = newGogsConfig(c)
 	case "mysql":
 		config = newMysqlConfig(c)
+	case "mysql-physical":
+		config = newMysqlPhysicalConfig(c)
 	case "postgres":
 		config = newPostgresConfig(c)
 	case "tarball":
@@ -45,12 +53,39 @@ func getStore(c *cli.Context, store string) stores.Storer {
 	switch store {
 	case "s3":
 		config = newS3Config(c)
+	case "gcs":
+		config = newGCSConfig(c)
+	case "azure":
+		config = newAzureConfig(c)
+	case "sftp":
+		config = newSFTPConfig(c)
+	case "webdav":
+		config = newWebDAVConfig(c)
 	case "filesystem":
 		config = newFilesystemConfig(c)
+	case "multi":
+		// deduplication applies to each store of the list
+		return newMultiConfig(c)
 	default:
 		log.Fatal("Unsupported store: %s", store)
 	}
 
+	if c.GlobalBool("dedup") {
+		backend, ok := config.(stores.ObjectStorer)
+		if !ok {
+			log.Fatal("Deduplication is not supported by store: %s", store)
+		}
+
+		// the keep file option of the store applies to the backup, the
+		// filesystem store has none
+		config = &stores.DedupConfig{
+			Backend:         backend,
+			SaveDir:         c.GlobalString("savedir"),
+			ChunkSize:       c.GlobalInt("dedup-chunk-size") * 1024,
+			KeepAfterUpload: c.Bool(store + "-keep-file"),
+		}
+	}
+
 	return config
 }
 
@@ -67,6 +102,8 @@ func runTask(c *cli.Context, command string, serviceName string, storeName strin
 		return runScheduler(c, func(c *cli.Context) error {
 			return restoreTask(c, service, store)
 		})
+	case "binlog":
+		return binlogTask(c, service, store)
 	default:
 		log.Fatal("Unsupported command: %s", command)
 	}
@@ -75,7 +112,10 @@ func runTask(c *cli.Context, command string, serviceName string, storeName strin
 
 func backupTask(c *cli.Context, service services.Service, store stores.Storer) error {
 	filepath, err := service.Backup()
-	if err != nil {
+	if err == services.ErrDryRun {
+		log.Info("Dry run finished, nothing was stored")
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("service backup failed: %v", err)
 	}
 
@@ -87,6 +127,15 @@ func backupTask(c *cli.Context, service services.Service, store stores.Storer) e
 		return fmt.Errorf("couldn't upload file to store: %v", err)
 	}
 
+	if committer, ok := service.(services.Committer); ok {
+		err = committer.Commit(func(indexpath string) error {
+			return store.Store(indexpath, filename+stores.IndexSuffix)
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't commit backup: %v", err)
+		}
+	}
+
 	err = store.RemoveOlderBackups(c.GlobalInt("max-backups"))
 	if err != nil {
 		return fmt.Errorf("couldn't remove old backups from store: %v", err)
@@ -110,6 +159,15 @@ func restoreTask(c *cli.Context, service services.Service, store stores.Storer)
 		}
 	}
 
+	if c.GlobalBool("restore-stream") {
+		err = streamRestore(service, store, filename)
+		if err != services.ErrStreamUnsupported {
+			return err
+		}
+
+		log.Info("Backup %s can't be streamed, downloading it", filename)
+	}
+
 	filepath, err := store.Retrieve(filename)
 	if err != nil {
 		return fmt.Errorf("cannot download file %s: %v", filename, err)
@@ -117,6 +175,14 @@ func restoreTask(c *cli.Context, service services.Service, store stores.Storer)
 
 	defer store.Close()
 
+	// previous backups are looked up next to the restored one
+	if chained, ok := service.(services.ChainRestorer); ok {
+		dir := path.Dir(filename)
+		chained.SetRetriever(func(name string) (string, error) {
+			return store.Retrieve(path.Join(dir, name))
+		})
+	}
+
 	if err = service.Restore(filepath); err != nil {
 		return fmt.Errorf("service restore failed: %v", err)
 	}
@@ -124,6 +190,118 @@ func restoreTask(c *cli.Context, service services.Service, store stores.Storer)
 	return nil
 }
 
+// streamRestore restores a backup while it is read from the store, without
+// saving it to disk
+func streamRestore(service services.Service, store stores.Storer, filename string) error {
+	restorer, ok := service.(services.StreamRestorer)
+	if !ok {
+		return services.ErrStreamUnsupported
+	}
+
+	streamer, ok := store.(stores.Streamer)
+	if !ok {
+		return services.ErrStreamUnsupported
+	}
+
+	var stream *verifiedStream
+	err := restorer.RestoreStream(filename, func() (io.ReadCloser, error) {
+		body, err := streamer.Stream(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		stream = &verifiedStream{ReadCloser: body}
+		return stream, nil
+	})
+
+	if err == services.ErrStreamUnsupported {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("service restore failed: %v", err)
+	}
+
+	// the stores verify the backup once it was read to the end
+	if stream != nil {
+		if err = stream.Close(); err != nil {
+			return fmt.Errorf("backup %s was restored but failed verification: %v", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// verifiedStream reads a backup to the end when it's closed and keeps the
+// result, the services ignore the errors of their deferred Close
+type verifiedStream struct {
+	io.ReadCloser
+	closed bool
+	err    error
+}
+
+func (s *verifiedStream) Close() error {
+	if !s.closed {
+		s.closed = true
+
+		_, s.err = io.Copy(ioutil.Discard, s.ReadCloser)
+		if err := s.ReadCloser.Close(); s.err == nil {
+			s.err = err
+		}
+	}
+
+	return s.err
+}
+
+func binlogTask(c *cli.Context, service services.Service, store stores.Storer) error {
+	config, ok := service.(*services.MySQLConfig)
+	if !ok {
+		return fmt.Errorf("binlog archiving is not supported by this service")
+	}
+
+	// the repository keeps a single name per backup, binlogs need their directory
+	if c.GlobalBool("dedup") {
+		return fmt.Errorf("binlog archiving is not supported by deduplicated stores")
+	}
+
+	shipper := &services.MySQLBinlogShipper{
+		Config:    config,
+		SpoolDir:  c.GlobalString("binlog-spool-dir"),
+		StartFile: c.GlobalString("binlog-start"),
+		Interval:  time.Duration(c.GlobalInt("binlog-interval")) * time.Second,
+	}
+
+	stop := make(chan struct{})
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signalChan
+		log.Trace("Stopping binlog archiving")
+		close(stop)
+	}()
+
+	for {
+		// binlogs are kept apart from the dumps, which remove the ones they don't need
+		err := shipper.Run(stop, func(filepath string, filename string) error {
+			return store.Store(filepath, path.Join(stores.BinlogDir, filename))
+		})
+
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		log.Error("Binlog archiving failed, restarting in %s: %v", binlogRetryDelay, err)
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(binlogRetryDelay):
+		}
+	}
+}
+
 func runScheduler(c *cli.Context, task task) error {
 	cr := cron.New()
 	schedule := c.GlobalString("schedule")
@@ -175,7 +353,7 @@ func runScheduler(c *cli.Context, task task) error {
 
 	cr.Start()
 
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
 	<-signalChan
@@ -211,6 +389,48 @@ func fileOrString(c *cli.Context, name string) string {
 	return c.String(name)
 }
 
+// parseMapping converts a list of key=value pairs to a map
+func parseMapping(values []string) map[string]string {
+	mapping := make(map[string]string)
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			log.Warn("Ignoring invalid mapping %s, expected key=value", value)
+			continue
+		}
+
+		mapping[parts[0]] = parts[1]
+	}
+
+	return mapping
+}
+
+// parseTime parses a RFC 3339 date, an empty value is the zero time
+func parseTime(c *cli.Context, name string) time.Time {
+	value := c.String(name)
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatal("Invalid date %s for %s, expected RFC 3339 format", value, name)
+	}
+
+	return t
+}
+
+// newCompression returns the compression shared by every service
+func newCompression(c *cli.Context) services.Compression {
+	return services.Compression{
+		Algorithm:   c.GlobalString("compression"),
+		Level:       c.GlobalInt("compression-level"),
+		BlockSize:   c.GlobalInt("compression-block-size") * 1024,
+		Concurrency: c.GlobalInt("compression-concurrency"),
+	}
+}
+
 func applyConfigValues(flags []cli.Flag) cli.BeforeFunc {
 	return func(c *cli.Context) error {
 		config := c.App.Metadata["config"]
@@ -36,6 +36,7 @@ func main() {
 	app.Commands = []cli.Command{
 		backupCmd(),
 		restoreCmd(),
+		binlogCmd(),
 	}
 
 	app.Before = func(c *cli.Context) error {
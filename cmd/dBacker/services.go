@@ -58,7 +58,7 @@ var databaseFlags = []cli.Flag{
 	}),
 	altsrc.NewBoolFlag(cli.BoolFlag{
 		Name:   "database-compress",
-		Usage:  "compress sql with gzip",
+		Usage:  "compress sql, with gzip unless another algorithm is set",
 		EnvVar: "DATABASE_COMPRESS",
 	}),
 	altsrc.NewBoolFlag(cli.BoolFlag{
@@ -86,12 +86,107 @@ var postgresFlags = []cli.Flag{
 	}),
 }
 
+var mysqlFlags = []cli.Flag{
+	altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:   "mysql-single-transaction",
+		Usage:  "dump InnoDB tables in a single transaction for a consistent snapshot",
+		EnvVar: "MYSQL_SINGLE_TRANSACTION",
+	}),
+	altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:   "mysql-lock-tables",
+		Usage:  "lock tables while dumping, used when single transaction is disabled",
+		EnvVar: "MYSQL_LOCK_TABLES",
+	}),
+	altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:   "mysql-routines",
+		Usage:  "include stored procedures and functions in the dump",
+		EnvVar: "MYSQL_ROUTINES",
+	}),
+	altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:   "mysql-triggers",
+		Usage:  "include triggers in the dump",
+		EnvVar: "MYSQL_TRIGGERS",
+	}),
+	altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:   "mysql-events",
+		Usage:  "include scheduled events in the dump",
+		EnvVar: "MYSQL_EVENTS",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-gtid-purged",
+		Usage:  "value of --set-gtid-purged (AUTO, ON or OFF), unset to use the mysqldump default",
+		EnvVar: "MYSQL_GTID_PURGED",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "mysql-split-databases",
+		Usage:  "dump each database to its own file when database name is not set",
+		EnvVar: "MYSQL_SPLIT_DATABASES",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "mysql-binlog-position",
+		Usage:  "record the binlog position in the dump, needed for point in time restore",
+		EnvVar: "MYSQL_BINLOG_POSITION",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-binlog-dir",
+		Usage:  "directory with archived binlogs to apply after restoring the dump",
+		EnvVar: "MYSQL_BINLOG_DIR",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-binlog-store-dir",
+		Usage:  "directory of the store with archived binlogs to apply after restoring the dump, relative to the dump",
+		EnvVar: "MYSQL_BINLOG_STORE_DIR",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-stop-datetime",
+		Usage:  "stop applying binlogs at this datetime (YYYY-MM-DD hh:mm:ss)",
+		EnvVar: "MYSQL_STOP_DATETIME",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-stop-gtid",
+		Usage:  "stop applying binlogs after the transaction with this GTID",
+		EnvVar: "MYSQL_STOP_GTID",
+	}),
+}
+
+var mysqlPhysicalFlags = []cli.Flag{
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-physical-tool",
+		Usage:  "physical backup tool (mariabackup or xtrabackup)",
+		Value:  "mariabackup",
+		EnvVar: "MYSQL_PHYSICAL_TOOL",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "mysql-datadir",
+		Usage:  "mysql data directory to restore to",
+		Value:  "/var/lib/mysql",
+		EnvVar: "MYSQL_DATADIR",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "mysql-uid",
+		Usage:  "owner uid of the restored files",
+		Value:  999,
+		EnvVar: "MYSQL_UID",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "mysql-gid",
+		Usage:  "owner gid of the restored files",
+		Value:  999,
+		EnvVar: "MYSQL_GID",
+	}),
+}
+
 var tarballFlags = []cli.Flag{
 	altsrc.NewStringFlag(cli.StringFlag{
 		Name:   "tarball-path",
 		Usage:  "path to backup/restore",
 		EnvVar: "TARBALL_PATH_SOURCE",
 	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "tarball-paths",
+		Usage:  "additional paths to backup/restore in the same tarball",
+		EnvVar: "TARBALL_PATHS_SOURCE",
+	}),
 	altsrc.NewStringFlag(cli.StringFlag{
 		Name:   "tarball-name",
 		Usage:  "backup file prefix",
@@ -99,9 +194,81 @@ var tarballFlags = []cli.Flag{
 	}),
 	altsrc.NewBoolFlag(cli.BoolFlag{
 		Name:   "tarball-compress",
-		Usage:  "compress tarball with gzip",
+		Usage:  "compress tarball, with gzip unless another algorithm is set",
 		EnvVar: "TARBALL_COMPRESS",
 	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "tarball-include",
+		Usage:  "only archive files matching these gitignore-style patterns",
+		EnvVar: "TARBALL_INCLUDE",
+	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "tarball-exclude",
+		Usage:  "skip files matching these gitignore-style patterns",
+		EnvVar: "TARBALL_EXCLUDE",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "tarball-dry-run",
+		Usage:  "list the files that would be archived without creating a backup",
+		EnvVar: "TARBALL_DRY_RUN",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "tarball-incremental",
+		Usage:  "only archive files changed since the previous backup",
+		EnvVar: "TARBALL_INCREMENTAL",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "tarball-full-every",
+		Usage:  "number of backups in an incremental chain, including the full backup",
+		Value:  7,
+		EnvVar: "TARBALL_FULL_EVERY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "tarball-state-dir",
+		Usage:  "directory to keep the snapshot index of the latest incremental backup",
+		EnvVar: "TARBALL_STATE_DIR",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "tarball-restore-mode",
+		Usage:  "restore mode: replace, swap or merge",
+		Value:  services.RestoreReplace,
+		EnvVar: "TARBALL_RESTORE_MODE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "tarball-restore-target",
+		Usage:  "restore to this directory instead of the backup path",
+		EnvVar: "TARBALL_RESTORE_TARGET",
+	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "tarball-restore-only",
+		Usage:  "only restore these subpaths",
+		EnvVar: "TARBALL_RESTORE_ONLY",
+	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "tarball-restore-remap",
+		Usage:  "restore a source path to another directory, in source=destination format",
+		EnvVar: "TARBALL_RESTORE_REMAP",
+	}),
+	altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:   "tarball-same-owner",
+		Usage:  "restore the owner of the files (only when running as root)",
+		EnvVar: "TARBALL_SAME_OWNER",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "tarball-numeric-owner",
+		Usage:  "use numeric user and group ids instead of names",
+		EnvVar: "TARBALL_NUMERIC_OWNER",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "tarball-xattrs",
+		Usage:  "store and restore extended attributes, including SELinux labels",
+		EnvVar: "TARBALL_XATTRS",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "tarball-acls",
+		Usage:  "store and restore POSIX ACLs",
+		EnvVar: "TARBALL_ACLS",
+	}),
 }
 
 func newGogsConfig(c *cli.Context) *services.GiteaConfig {
@@ -118,15 +285,47 @@ func newMysqlConfig(c *cli.Context) *services.MySQLConfig {
 	c = c.Parent()
 
 	return &services.MySQLConfig{
-		Host:           c.String("database-host"),
-		Port:           c.String("database-port"),
-		User:           c.String("database-user"),
-		Password:       fileOrString(c, "database-password"),
-		Database:       c.String("database-name"),
-		Options:        c.String("database-options"),
-		Compress:       c.Bool("database-compress"),
-		SaveDir:        c.GlobalString("savedir"),
-		IgnoreExitCode: c.Bool("database-ignore-exit-code"),
+		Host:              c.String("database-host"),
+		Port:              c.String("database-port"),
+		User:              c.String("database-user"),
+		Password:          fileOrString(c, "database-password"),
+		Database:          c.String("database-name"),
+		Options:           c.String("database-options"),
+		Compress:          c.Bool("database-compress"),
+		Compression:       newCompression(c),
+		SaveDir:           c.GlobalString("savedir"),
+		IgnoreExitCode:    c.Bool("database-ignore-exit-code"),
+		SingleTransaction: c.BoolT("mysql-single-transaction"),
+		LockTables:        c.BoolT("mysql-lock-tables"),
+		Routines:          c.BoolT("mysql-routines"),
+		Triggers:          c.BoolT("mysql-triggers"),
+		Events:            c.BoolT("mysql-events"),
+		GtidPurged:        c.String("mysql-gtid-purged"),
+		SplitDatabases:    c.Bool("mysql-split-databases"),
+		BinlogPosition:    c.Bool("mysql-binlog-position"),
+		BinlogDir:         c.String("mysql-binlog-dir"),
+		BinlogStoreDir:    c.String("mysql-binlog-store-dir"),
+		StopDatetime:      c.String("mysql-stop-datetime"),
+		StopGTID:          c.String("mysql-stop-gtid"),
+	}
+}
+
+func newMysqlPhysicalConfig(c *cli.Context) *services.MySQLPhysicalConfig {
+	c = c.Parent()
+
+	return &services.MySQLPhysicalConfig{
+		Host:        c.String("database-host"),
+		Port:        c.String("database-port"),
+		User:        c.String("database-user"),
+		Password:    fileOrString(c, "database-password"),
+		Options:     c.String("database-options"),
+		Compress:    c.Bool("database-compress"),
+		Compression: newCompression(c),
+		SaveDir:     c.GlobalString("savedir"),
+		Tool:        c.String("mysql-physical-tool"),
+		DataDir:     c.String("mysql-datadir"),
+		UID:         uint32(c.Int("mysql-uid")),
+		GID:         uint32(c.Int("mysql-gid")),
 	}
 }
 
@@ -141,6 +340,7 @@ func newPostgresConfig(c *cli.Context) *services.PostgresConfig {
 		Database:       c.String("database-name"),
 		Options:        c.String("database-options"),
 		Compress:       c.Bool("database-compress"),
+		Compression:    newCompression(c),
 		Custom:         c.Bool("postgres-custom"),
 		SaveDir:        c.GlobalString("savedir"),
 		IgnoreExitCode: c.Bool("database-ignore-exit-code"),
@@ -153,10 +353,25 @@ func newTarballConfig(c *cli.Context) *services.TarballConfig {
 	c = c.Parent()
 
 	return &services.TarballConfig{
-		Path:     c.String("tarball-path"),
-		Name:     c.String("tarball-name"),
-		Compress: c.Bool("tarball-compress"),
-		SaveDir:  c.GlobalString("savedir"),
+		Path:          c.String("tarball-path"),
+		Name:          c.String("tarball-name"),
+		Compress:      c.Bool("tarball-compress"),
+		Compression:   newCompression(c),
+		SaveDir:       c.GlobalString("savedir"),
+		Include:       c.StringSlice("tarball-include"),
+		Exclude:       c.StringSlice("tarball-exclude"),
+		DryRun:        c.Bool("tarball-dry-run"),
+		Incremental:   c.Bool("tarball-incremental"),
+		FullEvery:     c.Int("tarball-full-every"),
+		StateDir:      c.String("tarball-state-dir"),
+		RestoreMode:   c.String("tarball-restore-mode"),
+		RestoreTarget: c.String("tarball-restore-target"),
+		RestoreOnly:   c.StringSlice("tarball-restore-only"),
+		RestoreRemap:  parseMapping(c.StringSlice("tarball-restore-remap")),
+		SameOwner:     c.BoolT("tarball-same-owner"),
+		NumericOwner:  c.Bool("tarball-numeric-owner"),
+		Xattrs:        c.Bool("tarball-xattrs"),
+		ACLs:          c.Bool("tarball-acls"),
 	}
 }
 
@@ -177,6 +392,11 @@ func giteaCmd(parent string) cli.Command {
 		Before: applyConfigValues(giteaFlags),
 		Subcommands: []cli.Command{
 			s3Cmd(parent, name),
+			gcsCmd(parent, name),
+			azureCmd(parent, name),
+			sftpCmd(parent, name),
+			webdavCmd(parent, name),
+			multiCmd(parent, name),
 			filesystemCmd(parent, name),
 		},
 	}
@@ -192,6 +412,11 @@ func postgresCmd(parent string) cli.Command {
 		Before: applyConfigValues(flags),
 		Subcommands: []cli.Command{
 			s3Cmd(parent, name),
+			gcsCmd(parent, name),
+			azureCmd(parent, name),
+			sftpCmd(parent, name),
+			webdavCmd(parent, name),
+			multiCmd(parent, name),
 			filesystemCmd(parent, name),
 		},
 	}
@@ -199,13 +424,39 @@ func postgresCmd(parent string) cli.Command {
 
 func mysqlCmd(parent string) cli.Command {
 	name := "mysql"
+	flags := append(databaseFlags, mysqlFlags...)
 	return cli.Command{
 		Name:   name,
 		Usage:  "connect to mysql service",
-		Flags:  databaseFlags,
-		Before: applyConfigValues(databaseFlags),
+		Flags:  flags,
+		Before: applyConfigValues(flags),
+		Subcommands: []cli.Command{
+			s3Cmd(parent, name),
+			gcsCmd(parent, name),
+			azureCmd(parent, name),
+			sftpCmd(parent, name),
+			webdavCmd(parent, name),
+			multiCmd(parent, name),
+			filesystemCmd(parent, name),
+		},
+	}
+}
+
+func mysqlPhysicalCmd(parent string) cli.Command {
+	name := "mysql-physical"
+	flags := append(databaseFlags, mysqlPhysicalFlags...)
+	return cli.Command{
+		Name:   name,
+		Usage:  "connect to mysql service using mariabackup/xtrabackup",
+		Flags:  flags,
+		Before: applyConfigValues(flags),
 		Subcommands: []cli.Command{
 			s3Cmd(parent, name),
+			gcsCmd(parent, name),
+			azureCmd(parent, name),
+			sftpCmd(parent, name),
+			webdavCmd(parent, name),
+			multiCmd(parent, name),
 			filesystemCmd(parent, name),
 		},
 	}
@@ -220,6 +471,11 @@ func tarballCmd(parent string) cli.Command {
 		Before: applyConfigValues(tarballFlags),
 		Subcommands: []cli.Command{
 			s3Cmd(parent, name),
+			gcsCmd(parent, name),
+			azureCmd(parent, name),
+			sftpCmd(parent, name),
+			webdavCmd(parent, name),
+			multiCmd(parent, name),
 			filesystemCmd(parent, name),
 		},
 	}
@@ -232,6 +488,11 @@ func consulCmd(parent string) cli.Command {
 		Usage: "connect to consul service",
 		Subcommands: []cli.Command{
 			s3Cmd(parent, name),
+			gcsCmd(parent, name),
+			azureCmd(parent, name),
+			sftpCmd(parent, name),
+			webdavCmd(parent, name),
+			multiCmd(parent, name),
 			filesystemCmd(parent, name),
 		},
 	}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/4nkitd/dBacker/stores"
 	"gopkg.in/urfave/cli.v1"
 	"gopkg.in/urfave/cli.v1/altsrc"
+	log "unknwon.dev/clog/v2"
 )
 
 var s3Flags = []cli.Flag{
@@ -37,20 +41,512 @@ var s3Flags = []cli.Flag{
 		Usage:  "keep local file after successful upload",
 		EnvVar: "S3_KEEP_FILE",
 	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-sse",
+		Usage:  "server side encryption (AES256 or aws:kms)",
+		EnvVar: "S3_SSE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-sse-kms-key-id",
+		Usage:  "kms key id used with aws:kms server side encryption",
+		EnvVar: "S3_SSE_KMS_KEY_ID",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-sse-customer-key",
+		Usage:  "base64 encoded 256-bit key for SSE-C encryption",
+		EnvVar: "S3_SSE_CUSTOMER_KEY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-sse-customer-key-file",
+		Usage:  "file with the base64 encoded SSE-C key",
+		EnvVar: "S3_SSE_CUSTOMER_KEY_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-storage-class",
+		Usage:  "storage class of the uploaded objects, like STANDARD_IA, GLACIER_IR or DEEP_ARCHIVE",
+		EnvVar: "S3_STORAGE_CLASS",
+	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "s3-tags",
+		Usage:  "tags of the uploaded objects as key=value",
+		EnvVar: "S3_TAGS",
+	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "s3-metadata",
+		Usage:  "metadata of the uploaded objects as key=value",
+		EnvVar: "S3_METADATA",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-content-type",
+		Usage:  "content type of the uploaded objects, guessed from the extension when unset",
+		EnvVar: "S3_CONTENT_TYPE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-access-key",
+		Usage:  "access key, uses the default credential chain when unset",
+		EnvVar: "S3_ACCESS_KEY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-access-key-file",
+		Usage:  "file with the access key",
+		EnvVar: "S3_ACCESS_KEY_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-secret-key",
+		Usage:  "secret key",
+		EnvVar: "S3_SECRET_KEY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-secret-key-file",
+		Usage:  "file with the secret key",
+		EnvVar: "S3_SECRET_KEY_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-profile",
+		Usage:  "named profile of the shared credentials file",
+		EnvVar: "S3_PROFILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-role-arn",
+		Usage:  "ARN of the role to assume",
+		EnvVar: "S3_ROLE_ARN",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-role-external-id",
+		Usage:  "external id used to assume the role",
+		EnvVar: "S3_ROLE_EXTERNAL_ID",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-role-session-name",
+		Usage:  "session name used to assume the role",
+		EnvVar: "S3_ROLE_SESSION_NAME",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-web-identity-token-file",
+		Usage:  "web identity token file used to assume the role",
+		EnvVar: "S3_WEB_IDENTITY_TOKEN_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-sts-endpoint",
+		Usage:  "STS endpoint used to assume the role, the regional AWS one by default",
+		EnvVar: "S3_STS_ENDPOINT",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-ca-bundle",
+		Usage:  "file with additional CA certificates",
+		EnvVar: "S3_CA_BUNDLE",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "s3-insecure-skip-verify",
+		Usage:  "skip the verification of the server certificate",
+		EnvVar: "S3_INSECURE_SKIP_VERIFY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-proxy",
+		Usage:  "proxy url, uses the proxy environment variables when unset",
+		EnvVar: "S3_PROXY",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "s3-part-size",
+		Usage:  "multipart upload part size in MiB, raised automatically for big files",
+		Value:  5,
+		EnvVar: "S3_PART_SIZE",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "s3-concurrency",
+		Usage:  "number of parts uploaded in parallel",
+		Value:  5,
+		EnvVar: "S3_CONCURRENCY",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "s3-bandwidth-limit",
+		Usage:  "upload bandwidth limit in KiB per second (0 to disable)",
+		EnvVar: "S3_BANDWIDTH_LIMIT",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "s3-resume",
+		Usage:  "resume failed multipart uploads from their completed parts",
+		EnvVar: "S3_RESUME",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-checksum",
+		Usage:  "checksum to verify uploads and downloads (sha256, crc32c, none)",
+		Value:  stores.ChecksumSHA256,
+		EnvVar: "S3_CHECKSUM",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-lock-mode",
+		Usage:  "object lock retention mode (GOVERNANCE, COMPLIANCE)",
+		EnvVar: "S3_LOCK_MODE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "s3-lock-retain-until",
+		Usage:  "object lock retention date in RFC 3339 format",
+		EnvVar: "S3_LOCK_RETAIN_UNTIL",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "s3-lock-retain-days",
+		Usage:  "days to retain each object after its upload",
+		EnvVar: "S3_LOCK_RETAIN_DAYS",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "s3-lock-legal-hold",
+		Usage:  "place a legal hold on the uploaded objects",
+		EnvVar: "S3_LOCK_LEGAL_HOLD",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "s3-delete-versions",
+		Usage:  "delete every version of the old backups on versioned buckets",
+		EnvVar: "S3_DELETE_VERSIONS",
+	}),
 }
 
 func newS3Config(c *cli.Context) *stores.S3Config {
 	return &stores.S3Config{
-		Endpoint:        c.String("s3-endpoint"),
-		Region:          c.String("s3-region"),
-		Bucket:          c.String("s3-bucket"),
-		Prefix:          c.String("s3-prefix"),
-		ForcePathStyle:  c.Bool("s3-force-path-style"),
-		KeepAfterUpload: c.Bool("s3-keep-file"),
+		Endpoint:             c.String("s3-endpoint"),
+		Region:               c.String("s3-region"),
+		Bucket:               c.String("s3-bucket"),
+		Prefix:               c.String("s3-prefix"),
+		ForcePathStyle:       c.Bool("s3-force-path-style"),
+		KeepAfterUpload:      c.Bool("s3-keep-file"),
+		SaveDir:              c.GlobalString("savedir"),
+		ServerSideEncryption: c.String("s3-sse"),
+		KMSKeyID:             c.String("s3-sse-kms-key-id"),
+		SSECustomerKey:       fileOrString(c, "s3-sse-customer-key"),
+		StorageClass:         c.String("s3-storage-class"),
+		Tags:                 parseMapping(c.StringSlice("s3-tags")),
+		Metadata:             parseMapping(c.StringSlice("s3-metadata")),
+		ContentType:          c.String("s3-content-type"),
+		Credentials: stores.S3Credentials{
+			AccessKey:            fileOrString(c, "s3-access-key"),
+			SecretKey:            fileOrString(c, "s3-secret-key"),
+			Profile:              c.String("s3-profile"),
+			RoleARN:              c.String("s3-role-arn"),
+			ExternalID:           c.String("s3-role-external-id"),
+			SessionName:          c.String("s3-role-session-name"),
+			WebIdentityTokenFile: c.String("s3-web-identity-token-file"),
+			STSEndpoint:          c.String("s3-sts-endpoint"),
+		},
+		Transport: stores.S3Transport{
+			CABundle:           c.String("s3-ca-bundle"),
+			InsecureSkipVerify: c.Bool("s3-insecure-skip-verify"),
+			Proxy:              c.String("s3-proxy"),
+		},
+		Upload: stores.S3Upload{
+			PartSize:       int64(c.Int("s3-part-size")) << 20,
+			Concurrency:    c.Int("s3-concurrency"),
+			BandwidthLimit: int64(c.Int("s3-bandwidth-limit")) << 10,
+			Resume:         c.Bool("s3-resume"),
+		},
+		Checksum: c.String("s3-checksum"),
+		Lock: stores.S3Lock{
+			Mode:        c.String("s3-lock-mode"),
+			RetainUntil: parseTime(c, "s3-lock-retain-until"),
+			RetainFor:   time.Duration(c.Int("s3-lock-retain-days")) * 24 * time.Hour,
+			LegalHold:   c.Bool("s3-lock-legal-hold"),
+		},
+		DeleteVersions: c.Bool("s3-delete-versions"),
+	}
+}
+
+var gcsFlags = []cli.Flag{
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "gcs-endpoint",
+		Usage:  "gcs endpoint",
+		EnvVar: "GCS_ENDPOINT",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "gcs-bucket",
+		Usage:  "gcs bucket",
+		EnvVar: "GCS_BUCKET",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "gcs-prefix",
+		Usage:  "gcs prefix",
+		EnvVar: "GCS_PREFIX",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "gcs-keep-file",
+		Usage:  "keep file after uploading it",
+		EnvVar: "GCS_KEEP_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "gcs-credentials-file",
+		Usage:  "service account key file, the metadata server is used if unset",
+		EnvVar: "GOOGLE_APPLICATION_CREDENTIALS",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "gcs-chunk-size",
+		Usage:  "resumable upload chunk size in MiB",
+		Value:  8,
+		EnvVar: "GCS_CHUNK_SIZE",
+	}),
+}
+
+func newGCSConfig(c *cli.Context) *stores.GCSConfig {
+	return &stores.GCSConfig{
+		Endpoint:        c.String("gcs-endpoint"),
+		Bucket:          c.String("gcs-bucket"),
+		Prefix:          c.String("gcs-prefix"),
+		KeepAfterUpload: c.Bool("gcs-keep-file"),
 		SaveDir:         c.GlobalString("savedir"),
+		CredentialsFile: c.String("gcs-credentials-file"),
+		ChunkSize:       int64(c.Int("gcs-chunk-size")) << 20,
 	}
 }
 
+var azureFlags = []cli.Flag{
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-endpoint",
+		Usage:  "blob service endpoint, defaults to the account endpoint",
+		EnvVar: "AZURE_ENDPOINT",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-container",
+		Usage:  "azure container",
+		EnvVar: "AZURE_CONTAINER",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-prefix",
+		Usage:  "azure prefix",
+		EnvVar: "AZURE_PREFIX",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "azure-keep-file",
+		Usage:  "keep file after uploading it",
+		EnvVar: "AZURE_KEEP_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-account-name",
+		Usage:  "storage account name",
+		EnvVar: "AZURE_STORAGE_ACCOUNT",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-account-key",
+		Usage:  "storage account key",
+		EnvVar: "AZURE_STORAGE_KEY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-account-key-file",
+		Usage:  "file with the storage account key",
+		EnvVar: "AZURE_STORAGE_KEY_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-sas-token",
+		Usage:  "shared access signature token",
+		EnvVar: "AZURE_STORAGE_SAS_TOKEN",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-sas-token-file",
+		Usage:  "file with the shared access signature token",
+		EnvVar: "AZURE_STORAGE_SAS_TOKEN_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-connection-string",
+		Usage:  "connection string, takes precedence over the other credentials",
+		EnvVar: "AZURE_STORAGE_CONNECTION_STRING",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-connection-string-file",
+		Usage:  "file with the connection string",
+		EnvVar: "AZURE_STORAGE_CONNECTION_STRING_FILE",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "azure-block-size",
+		Usage:  "block size in MiB",
+		Value:  4,
+		EnvVar: "AZURE_BLOCK_SIZE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "azure-access-tier",
+		Usage:  "access tier of the uploaded blobs (hot, cool or archive)",
+		EnvVar: "AZURE_ACCESS_TIER",
+	}),
+}
+
+func newAzureConfig(c *cli.Context) *stores.AzureConfig {
+	return &stores.AzureConfig{
+		Endpoint:        c.String("azure-endpoint"),
+		Container:       c.String("azure-container"),
+		Prefix:          c.String("azure-prefix"),
+		KeepAfterUpload: c.Bool("azure-keep-file"),
+		SaveDir:         c.GlobalString("savedir"),
+		Credentials: stores.AzureCredentials{
+			AccountName:      c.String("azure-account-name"),
+			AccountKey:       fileOrString(c, "azure-account-key"),
+			SASToken:         fileOrString(c, "azure-sas-token"),
+			ConnectionString: fileOrString(c, "azure-connection-string"),
+		},
+		BlockSize:  int64(c.Int("azure-block-size")) << 20,
+		AccessTier: c.String("azure-access-tier"),
+	}
+}
+
+var sftpFlags = []cli.Flag{
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-host",
+		Usage:  "sftp host",
+		EnvVar: "SFTP_HOST",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "sftp-port",
+		Usage:  "sftp port",
+		Value:  22,
+		EnvVar: "SFTP_PORT",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-user",
+		Usage:  "sftp user",
+		EnvVar: "SFTP_USER",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-private-key",
+		Usage:  "private key in PEM format",
+		EnvVar: "SFTP_PRIVATE_KEY",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-private-key-file",
+		Usage:  "file with the private key",
+		EnvVar: "SFTP_PRIVATE_KEY_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-private-key-passphrase",
+		Usage:  "passphrase of the private key",
+		EnvVar: "SFTP_PRIVATE_KEY_PASSPHRASE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-private-key-passphrase-file",
+		Usage:  "file with the passphrase of the private key",
+		EnvVar: "SFTP_PRIVATE_KEY_PASSPHRASE_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-known-hosts-file",
+		Usage:  "known_hosts file used to verify the host key, defaults to ~/.ssh/known_hosts",
+		EnvVar: "SFTP_KNOWN_HOSTS_FILE",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "sftp-dir",
+		Usage:  "remote directory, relative paths start on the home directory",
+		EnvVar: "SFTP_DIR",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "sftp-keep-file",
+		Usage:  "keep file after uploading it",
+		EnvVar: "SFTP_KEEP_FILE",
+	}),
+}
+
+func newSFTPConfig(c *cli.Context) *stores.SFTPConfig {
+	return &stores.SFTPConfig{
+		Host:                 c.String("sftp-host"),
+		Port:                 c.Int("sftp-port"),
+		User:                 c.String("sftp-user"),
+		PrivateKey:           c.String("sftp-private-key"),
+		PrivateKeyFile:       c.String("sftp-private-key-file"),
+		PrivateKeyPassphrase: fileOrString(c, "sftp-private-key-passphrase"),
+		KnownHostsFile:       c.String("sftp-known-hosts-file"),
+		Dir:                  c.String("sftp-dir"),
+		KeepAfterUpload:      c.Bool("sftp-keep-file"),
+		SaveDir:              c.GlobalString("savedir"),
+	}
+}
+
+var webdavFlags = []cli.Flag{
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "webdav-url",
+		Usage:  "url of the backups collection",
+		EnvVar: "WEBDAV_URL",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "webdav-user",
+		Usage:  "webdav user",
+		EnvVar: "WEBDAV_USER",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "webdav-password",
+		Usage:  "webdav password",
+		EnvVar: "WEBDAV_PASSWORD",
+	}),
+	altsrc.NewStringFlag(cli.StringFlag{
+		Name:   "webdav-password-file",
+		Usage:  "file with the webdav password",
+		EnvVar: "WEBDAV_PASSWORD_FILE",
+	}),
+	altsrc.NewBoolFlag(cli.BoolFlag{
+		Name:   "webdav-keep-file",
+		Usage:  "keep file after uploading it",
+		EnvVar: "WEBDAV_KEEP_FILE",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "webdav-chunk-size",
+		Usage:  "nextcloud chunked upload size in MiB, 0 disables chunking",
+		Value:  10,
+		EnvVar: "WEBDAV_CHUNK_SIZE",
+	}),
+}
+
+func newWebDAVConfig(c *cli.Context) *stores.WebDAVConfig {
+	return &stores.WebDAVConfig{
+		URL:             c.String("webdav-url"),
+		User:            c.String("webdav-user"),
+		Password:        fileOrString(c, "webdav-password"),
+		KeepAfterUpload: c.Bool("webdav-keep-file"),
+		SaveDir:         c.GlobalString("savedir"),
+		ChunkSize:       int64(c.Int("webdav-chunk-size")) << 20,
+	}
+}
+
+var multiFlags = []cli.Flag{
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "multi-stores",
+		Usage:  "stores receiving each backup, restores use the first one that has it",
+		EnvVar: "MULTI_STORES",
+	}),
+	altsrc.NewIntFlag(cli.IntFlag{
+		Name:   "multi-min-success",
+		Usage:  "stores that must succeed for the backup to succeed (0 for all)",
+		EnvVar: "MULTI_MIN_SUCCESS",
+	}),
+	altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:   "multi-max-backups",
+		Usage:  "max backups to keep on a store as store=count, overrides max-backups",
+		EnvVar: "MULTI_MAX_BACKUPS",
+	}),
+}
+
+func newMultiConfig(c *cli.Context) *stores.MultiConfig {
+	retention := parseMapping(c.StringSlice("multi-max-backups"))
+
+	config := &stores.MultiConfig{
+		MinSuccess: c.Int("multi-min-success"),
+	}
+
+	for _, name := range c.StringSlice("multi-stores") {
+		if name == "multi" {
+			log.Fatal("Unsupported store in multi-stores: %s", name)
+		}
+
+		target := stores.MultiTarget{Name: name, Store: getStore(c, name)}
+
+		if value, ok := retention[name]; ok {
+			keep, err := strconv.Atoi(value)
+			if err != nil {
+				log.Fatal("Invalid max backups %s for store %s", value, name)
+			}
+
+			target.Keep = keep
+		}
+
+		config.Targets = append(config.Targets, target)
+	}
+
+	if len(config.Targets) == 0 {
+		log.Fatal("No stores set in multi-stores")
+	}
+
+	return config
+}
+
 func newFilesystemConfig(c *cli.Context) *stores.FilesystemConfig {
 	return &stores.FilesystemConfig{
 		SaveDir: c.GlobalString("savedir"),
@@ -70,6 +566,77 @@ func s3Cmd(command string, service string) cli.Command {
 	}
 }
 
+func gcsCmd(command string, service string) cli.Command {
+	name := "gcs"
+	return cli.Command{
+		Name:   name,
+		Usage:  "use Google Cloud Storage as store",
+		Flags:  gcsFlags,
+		Before: applyConfigValues(gcsFlags),
+		Action: func(c *cli.Context) error {
+			return runTask(c, command, service, name)
+		},
+	}
+}
+
+func azureCmd(command string, service string) cli.Command {
+	name := "azure"
+	return cli.Command{
+		Name:   name,
+		Usage:  "use Azure Blob Storage as store",
+		Flags:  azureFlags,
+		Before: applyConfigValues(azureFlags),
+		Action: func(c *cli.Context) error {
+			return runTask(c, command, service, name)
+		},
+	}
+}
+
+func sftpCmd(command string, service string) cli.Command {
+	name := "sftp"
+	return cli.Command{
+		Name:   name,
+		Usage:  "use a SFTP server as store",
+		Flags:  sftpFlags,
+		Before: applyConfigValues(sftpFlags),
+		Action: func(c *cli.Context) error {
+			return runTask(c, command, service, name)
+		},
+	}
+}
+
+func webdavCmd(command string, service string) cli.Command {
+	name := "webdav"
+	return cli.Command{
+		Name:   name,
+		Usage:  "use a WebDAV server as store",
+		Flags:  webdavFlags,
+		Before: applyConfigValues(webdavFlags),
+		Action: func(c *cli.Context) error {
+			return runTask(c, command, service, name)
+		},
+	}
+}
+
+func multiCmd(command string, service string) cli.Command {
+	name := "multi"
+
+	var flags []cli.Flag
+	for _, storeFlags := range [][]cli.Flag{multiFlags, s3Flags, gcsFlags, azureFlags, sftpFlags, webdavFlags} {
+		flags = append(flags, storeFlags...)
+	}
+
+	return cli.Command{
+		Name:   name,
+		Usage:  "store each backup on several stores",
+		Flags:  flags,
+		Before: applyConfigValues(flags),
+		Action: func(c *cli.Context) error {
+			return runTask(c, command, service, name)
+		},
+	}
+}
+
 func filesystemCmd(command string, service string) cli.Command {
 	name := "filesystem"
 	return cli.Command{
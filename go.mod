@@ -4,23 +4,26 @@ go 1.14
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
-	github.com/andybalholm/brotli v1.0.0 // indirect
+	github.com/andybalholm/brotli v1.0.0
 	github.com/aws/aws-sdk-go v1.32.11
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dsnet/compress v0.0.1
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/frankban/quicktest v1.10.0 // indirect
-	github.com/klauspost/compress v1.10.10 // indirect
-	github.com/klauspost/pgzip v1.2.4 // indirect
+	github.com/klauspost/compress v1.10.10
+	github.com/klauspost/pgzip v1.2.4
 	github.com/mattn/go-colorable v0.1.7 // indirect
 	github.com/mholt/archiver/v3 v3.3.0
 	github.com/nwaples/rardecode v1.1.0 // indirect
-	github.com/pierrec/lz4 v2.5.2+incompatible // indirect
+	github.com/pierrec/lz4 v2.5.2+incompatible
+	github.com/pkg/sftp v1.13.5
 	github.com/robfig/cron/v3 v3.0.1
-	github.com/stretchr/testify v1.5.1
-	github.com/ulikunitz/xz v0.5.7 // indirect
+	github.com/stretchr/testify v1.7.0
+	github.com/ulikunitz/xz v0.5.7
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	golang.org/x/lint v0.0.0-20181026193005-c67002cb31c3
-	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae // indirect
-	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	golang.org/x/tools v0.0.0-20181201035826-d0ca3933b724 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/urfave/cli.v1 v1.20.0
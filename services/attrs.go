@@ -0,0 +1,20 @@
+package services
+
+import (
+	"strings"
+)
+
+// paxXattrPrefix is the PAX record prefix used by GNU tar and bsdtar for extended attributes
+var paxXattrPrefix = "SCHILY.xattr."
+
+// aclXattrPrefix is the prefix of the extended attributes that store POSIX ACLs
+var aclXattrPrefix = "system.posix_acl_"
+
+// xattrSelected returns true when an extended attribute must be stored/restored
+func xattrSelected(name string, xattrs bool, acls bool) bool {
+	if strings.HasPrefix(name, aclXattrPrefix) {
+		return acls
+	}
+
+	return xattrs
+}
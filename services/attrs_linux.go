@@ -0,0 +1,68 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file without following symlinks
+func readXattrs(filepath string, xattrs bool, acls bool) (map[string]string, error) {
+	size, err := unix.Llistxattr(filepath, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list extended attributes: %v", err)
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(filepath, buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list extended attributes: %v", err)
+	}
+
+	values := make(map[string]string)
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 || !xattrSelected(string(name), xattrs, acls) {
+			continue
+		}
+
+		value, err := readXattr(filepath, string(name))
+		if err != nil {
+			return nil, err
+		}
+
+		values[string(name)] = value
+	}
+
+	return values, nil
+}
+
+func readXattr(filepath string, name string) (string, error) {
+	size, err := unix.Lgetxattr(filepath, name, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot read extended attribute %s: %v", name, err)
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(filepath, name, buf)
+	if err != nil {
+		return "", fmt.Errorf("cannot read extended attribute %s: %v", name, err)
+	}
+
+	return string(buf[:size]), nil
+}
+
+// writeXattr sets an extended attribute without following symlinks
+func writeXattr(filepath string, name string, value string) error {
+	return unix.Lsetxattr(filepath, name, []byte(value), 0)
+}
+
+// lchtimes sets the access and modification times without following symlinks
+func lchtimes(filepath string, modTime time.Time) error {
+	ts := unix.NsecToTimespec(modTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, filepath, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
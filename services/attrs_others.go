@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package services
+
+import (
+	"os"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// readXattrs is not supported on this platform
+func readXattrs(filepath string, xattrs bool, acls bool) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattr is not supported on this platform
+func writeXattr(filepath string, name string, value string) error {
+	log.Warn("Extended attributes are not supported, skipping %s on %s", name, filepath)
+	return nil
+}
+
+// lchtimes sets the access and modification times, symlinks are skipped
+func lchtimes(filepath string, modTime time.Time) error {
+	info, err := os.Lstat(filepath)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	return os.Chtimes(filepath, modTime, modTime)
+}
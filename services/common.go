@@ -2,6 +2,7 @@ package services
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -22,6 +23,24 @@ type Service interface {
 	Restore(path string) error
 }
 
+// StreamRestorer is implemented by services that can restore a backup while
+// it is read from the store. The stream is only opened when the service
+// supports restoring the backup this way, otherwise ErrStreamUnsupported is
+// returned
+type StreamRestorer interface {
+	RestoreStream(filename string, open func() (io.ReadCloser, error)) error
+}
+
+// Committer is implemented by services that keep state between backups. The
+// state of a backup is only saved by Commit once the backup is stored, upload
+// stores a file as the index of the backup
+type Committer interface {
+	Commit(upload func(filepath string) error) error
+}
+
+// ErrStreamUnsupported is returned when a backup must be saved to disk to be restored
+var ErrStreamUnsupported = errors.New("the backup can't be restored from a stream")
+
 // CmdConfig has the configuration needed to run an external executable
 type CmdConfig struct {
 	Env        []string
@@ -30,6 +49,7 @@ type CmdConfig struct {
 	Credential *syscall.Credential
 	CensorArg  string
 	WorkDir    string
+	Stop       <-chan struct{}
 }
 
 // CmdRun executes an external executable
@@ -49,7 +69,14 @@ func (app *CmdConfig) CmdRun(name string, arg ...string) error {
 
 	if app.InputFile == nil && app.OutputFile == nil {
 		cmd.Stdout = os.Stdout
-		return cmd.Run()
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		defer app.killOnStop(name, cmd)()
+
+		return cmd.Wait()
 	}
 
 	var readErr, writeErr error
@@ -99,6 +126,8 @@ func (app *CmdConfig) CmdRun(name string, arg ...string) error {
 		return fmt.Errorf("cannot start process: %v", err)
 	}
 
+	defer app.killOnStop(name, cmd)()
+
 	writeErr = <-doneWrite
 	readErr = <-doneRead
 
@@ -117,6 +146,27 @@ func (app *CmdConfig) CmdRun(name string, arg ...string) error {
 	return nil
 }
 
+// killOnStop kills a started process when the stop channel is closed, the
+// returned function must be called after the process exits
+func (app *CmdConfig) killOnStop(name string, cmd *exec.Cmd) func() {
+	if app.Stop == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-app.Stop:
+			log.Trace("Stopping %s", name)
+			_ = cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
 func getEnvInt(key string, def int) int {
 	value := os.Getenv(key)
 
@@ -159,6 +209,29 @@ func removeDirectoryContents(dir string) error {
 	return nil
 }
 
+// moveDirectoryContents moves the files of a directory to another one on the
+// same filesystem
+func moveDirectoryContents(src string, dest string) error {
+	d, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot open directory: %v", err)
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return fmt.Errorf("cannot read files on directory: %v", err)
+	}
+
+	for _, name := range names {
+		if err = os.Rename(filepath.Join(src, name), filepath.Join(dest, name)); err != nil {
+			return fmt.Errorf("failed to move %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
 func censorArg(args []string, arg string) []string {
 	var updated []string
 
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+	log "unknwon.dev/clog/v2"
+)
+
+// Compression algorithms supported for backups
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionXz     = "xz"
+	CompressionLz4    = "lz4"
+	CompressionBzip2  = "bz2"
+	CompressionBrotli = "brotli"
+)
+
+// compressionExtensions maps each algorithm to its file extension
+var compressionExtensions = map[string]string{
+	CompressionGzip:   ".gz",
+	CompressionZstd:   ".zst",
+	CompressionXz:     ".xz",
+	CompressionLz4:    ".lz4",
+	CompressionBzip2:  ".bz2",
+	CompressionBrotli: ".br",
+}
+
+// compressionMagic maps each algorithm to the first bytes of its streams,
+// brotli streams don't have any
+var compressionMagic = map[string][]byte{
+	CompressionGzip:  {0x1f, 0x8b},
+	CompressionZstd:  {0x28, 0xb5, 0x2f, 0xfd},
+	CompressionXz:    {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
+	CompressionLz4:   {0x04, 0x22, 0x4d, 0x18},
+	CompressionBzip2: {0x42, 0x5a, 0x68},
+}
+
+// defaultBlockSize is the size of the blocks compressed in parallel by gzip
+var defaultBlockSize = 1 << 20
+
+// Compression has the algorithm and level used to compress backups, a level
+// of 0 uses the default of the algorithm. Gzip streams are split in blocks
+// of BlockSize bytes, up to Concurrency blocks are processed at once
+type Compression struct {
+	Algorithm   string
+	Level       int
+	BlockSize   int
+	Concurrency int
+}
+
+// blocks returns the block size and the number of blocks processed in
+// parallel, unset values use the defaults
+func (c Compression) blocks() (int, int) {
+	blockSize, concurrency := c.BlockSize, c.Concurrency
+
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	return blockSize, concurrency
+}
+
+// resolve returns the compression to use, the algorithm defaults to gzip
+// when compression is enabled without setting one
+func (c Compression) resolve(compress bool) Compression {
+	if c.Algorithm == "" {
+		if !compress {
+			return Compression{Algorithm: CompressionNone}
+		}
+
+		c.Algorithm = CompressionGzip
+	}
+
+	return c
+}
+
+// Enabled returns true when the output is compressed
+func (c Compression) Enabled() bool {
+	return c.Algorithm != "" && c.Algorithm != CompressionNone
+}
+
+// Extension returns the file extension of the algorithm
+func (c Compression) Extension() string {
+	return compressionExtensions[c.Algorithm]
+}
+
+// NewWriter wraps a writer with the compression algorithm, the returned
+// writer must be closed to flush its contents, closing it again is a no-op
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	writer, err := c.newWriter(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &onceWriteCloser{WriteCloser: writer}, nil
+}
+
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Algorithm {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		writer, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = writer.SetConcurrency(c.blocks()); err != nil {
+			return nil, fmt.Errorf("invalid gzip block size: %v", err)
+		}
+
+		return writer, nil
+	case CompressionZstd:
+		var opts []zstd.EOption
+		if c.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+		}
+
+		return zstd.NewWriter(w, opts...)
+	case CompressionXz:
+		if c.Level != 0 {
+			log.Warn("The xz compression doesn't support levels, level %d is ignored", c.Level)
+		}
+
+		return xz.NewWriter(w)
+	case CompressionLz4:
+		writer := lz4.NewWriter(w)
+		writer.Header.CompressionLevel = c.Level
+
+		return writer, nil
+	case CompressionBzip2:
+		conf := &bzip2.WriterConfig{}
+		if c.Level != 0 {
+			conf.Level = c.Level
+		}
+
+		return bzip2.NewWriter(w, conf)
+	case CompressionBrotli:
+		if c.Level != 0 {
+			return brotli.NewWriterLevel(w, c.Level), nil
+		}
+
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", c.Algorithm)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// onceWriteCloser ignores subsequent calls to Close, some compressors write
+// their trailer again when closed twice
+type onceWriteCloser struct {
+	io.WriteCloser
+	closed bool
+}
+
+func (w *onceWriteCloser) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	return w.WriteCloser.Close()
+}
+
+// detectCompression returns the algorithm of a file from its extension, or
+// from the first bytes of its contents when the extension is unknown
+func detectCompression(filepath string, header []byte) string {
+	for algorithm, ext := range compressionExtensions {
+		if strings.HasSuffix(filepath, ext) {
+			return algorithm
+		}
+	}
+
+	for algorithm, magic := range compressionMagic {
+		if bytes.HasPrefix(header, magic) {
+			return algorithm
+		}
+	}
+
+	return CompressionNone
+}
+
+// compressionReadCloser closes the decompressor and the underlying file
+type compressionReadCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *compressionReadCloser) Close() error {
+	var err error
+
+	for _, closer := range r.closers {
+		if cerr := closer(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// openDecompressed opens a file and returns a reader of its decompressed
+// contents, the algorithm is detected automatically
+func openDecompressed(filepath string) (io.ReadCloser, error) {
+	return Compression{}.open(filepath)
+}
+
+// open works like openDecompressed, gzip streams are decompressed ahead using
+// the configured block size and concurrency
+func (c Compression) open(filepath string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %v", err)
+	}
+
+	reader, err := c.decompress(filepath, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	reader.closers = append(reader.closers, f.Close)
+
+	return reader, nil
+}
+
+// decompress returns a reader of the decompressed contents of a stream, the
+// algorithm is detected from its name and first bytes. Closing the reader
+// doesn't close the stream
+func (c Compression) decompress(name string, r io.Reader) (*compressionReadCloser, error) {
+	buffered := bufio.NewReader(r)
+
+	// a short file returns less bytes and an error, which is fine
+	header, _ := buffered.Peek(8)
+
+	reader, closer, err := c.newDecompressor(detectCompression(name, header), buffered)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressionReadCloser{
+		Reader:  reader,
+		closers: []func() error{closer},
+	}, nil
+}
+
+// newDecompressor returns a reader of the decompressed contents and a
+// function to release it
+func (c Compression) newDecompressor(algorithm string, r io.Reader) (io.Reader, func() error, error) {
+	nop := func() error { return nil }
+
+	switch algorithm {
+	case CompressionNone:
+		return r, nop, nil
+	case CompressionGzip:
+		blockSize, concurrency := c.blocks()
+
+		// the reader corrupts the stream when reading ahead a single block
+		if concurrency < 2 {
+			concurrency = 2
+		}
+
+		reader, err := pgzip.NewReaderN(r, blockSize, concurrency)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create gzip reader: %v", err)
+		}
+
+		return reader, reader.Close, nil
+	case CompressionZstd:
+		reader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create zstd reader: %v", err)
+		}
+
+		return reader, func() error {
+			reader.Close()
+			return nil
+		}, nil
+	case CompressionXz:
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create xz reader: %v", err)
+		}
+
+		return reader, nop, nil
+	case CompressionLz4:
+		return lz4.NewReader(r), nop, nil
+	case CompressionBzip2:
+		reader, err := bzip2.NewReader(r, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create bzip2 reader: %v", err)
+		}
+
+		return reader, reader.Close, nil
+	case CompressionBrotli:
+		return ioutil.NopCloser(brotli.NewReader(r)), nop, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
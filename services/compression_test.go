@@ -0,0 +1,274 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var compressionAlgorithms = []string{
+	CompressionNone,
+	CompressionGzip,
+	CompressionZstd,
+	CompressionXz,
+	CompressionLz4,
+	CompressionBzip2,
+	CompressionBrotli,
+}
+
+func writeCompressed(t *testing.T, filepath string, compression Compression, data []byte) {
+	r := require.New(t)
+
+	f, err := os.Create(filepath)
+	r.NoError(err, "failed to create file")
+
+	defer f.Close()
+
+	writer, err := compression.NewWriter(f)
+	r.NoError(err, "failed to create writer")
+
+	_, err = writer.Write(data)
+	r.NoError(err, "failed to write data")
+	r.NoError(writer.Close(), "failed to close writer")
+	r.NoError(writer.Close(), "closing twice must be a no-op")
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "compression")
+	require.NoError(t, err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	data := []byte(strings.Repeat("INSERT INTO test VALUES (1, 'dBacker');\n", 1000))
+
+	for _, algorithm := range compressionAlgorithms {
+		for _, level := range []int{0, 1} {
+			r := require.New(t)
+			compression := Compression{Algorithm: algorithm, Level: level}
+
+			// without the extension the magic bytes are used, brotli doesn't have any
+			exts := []string{compression.Extension()}
+			if algorithm != CompressionBrotli {
+				exts = append(exts, "")
+			}
+
+			for _, ext := range exts {
+				filepath := path.Join(tmp, "dump.sql"+ext)
+				writeCompressed(t, filepath, compression, data)
+
+				reader, err := openDecompressed(filepath)
+				r.NoError(err, "failed to open %s", algorithm)
+
+				actual, err := ioutil.ReadAll(reader)
+				r.NoError(err, "failed to read %s", algorithm)
+				r.NoError(reader.Close(), "failed to close %s", algorithm)
+				r.True(bytes.Equal(data, actual), "contents mismatch with %s", algorithm)
+
+				os.Remove(filepath)
+			}
+		}
+	}
+}
+
+func TestCompressionResolve(t *testing.T) {
+	r := require.New(t)
+
+	r.Equal(CompressionNone, Compression{}.resolve(false).Algorithm)
+	r.Equal(CompressionGzip, Compression{}.resolve(true).Algorithm)
+	r.Equal(CompressionZstd, Compression{Algorithm: CompressionZstd}.resolve(false).Algorithm)
+	r.Equal(CompressionNone, Compression{Algorithm: CompressionNone}.resolve(true).Algorithm)
+	r.Equal("", Compression{}.resolve(false).Extension())
+	r.Equal(".zst", Compression{Algorithm: CompressionZstd}.Extension())
+
+	_, err := Compression{Algorithm: "rar"}.NewWriter(ioutil.Discard)
+	r.Error(err, "unknown algorithms must fail")
+
+	_, err = Compression{Algorithm: CompressionGzip, BlockSize: 1024}.NewWriter(ioutil.Discard)
+	r.Error(err, "gzip blocks smaller than the window must fail")
+}
+
+func TestParallelGzip(t *testing.T) {
+	r := require.New(t)
+	data := benchmarkData(4 << 20)
+
+	var buf bytes.Buffer
+	compression := Compression{Algorithm: CompressionGzip, BlockSize: 256 << 10, Concurrency: 4}
+
+	writer, err := compression.NewWriter(&buf)
+	r.NoError(err, "failed to create writer")
+
+	_, err = writer.Write(data)
+	r.NoError(err, "failed to write data")
+	r.NoError(writer.Close(), "failed to close writer")
+
+	// the output must be readable by any gzip implementation
+	reader, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	r.NoError(err, "failed to create gzip reader")
+
+	actual, err := ioutil.ReadAll(reader)
+	r.NoError(err, "failed to read data")
+	r.True(bytes.Equal(data, actual), "contents mismatch")
+
+	// a single block of read ahead must not corrupt the stream
+	single := Compression{BlockSize: 256 << 10, Concurrency: 1}
+	parallel, closer, err := single.newDecompressor(CompressionGzip, bytes.NewReader(buf.Bytes()))
+	r.NoError(err, "failed to create parallel reader")
+
+	defer closer()
+
+	actual, err = ioutil.ReadAll(parallel)
+	r.NoError(err, "failed to read data in parallel")
+	r.True(bytes.Equal(data, actual), "parallel contents mismatch")
+}
+
+// benchmarkData returns compressible data resembling a sql dump
+func benchmarkData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"INSERT", "INTO", "users", "VALUES", "NULL", "'dBacker'", "42", "(", ")", ","}
+
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[rnd.Intn(len(words))])
+		buf.WriteString(strconv.Itoa(rnd.Intn(1000)))
+		buf.WriteByte(' ')
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func benchmarkCompress(b *testing.B, newWriter func(w io.Writer) (io.WriteCloser, error)) {
+	data := benchmarkData(32 << 20)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		writer, err := newWriter(ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err = writer.Write(data); err != nil {
+			b.Fatal(err)
+		}
+
+		if err = writer.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecompress(b *testing.B, compression Compression) {
+	data := benchmarkData(32 << 20)
+
+	var buf bytes.Buffer
+	writer, err := Compression{Algorithm: CompressionGzip}.NewWriter(&buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	writer.Write(data)
+	writer.Close()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader, closer, err := compression.newDecompressor(CompressionGzip, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+
+		closer()
+	}
+}
+
+func BenchmarkGzipCompress(b *testing.B) {
+	benchmarkCompress(b, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+}
+
+func BenchmarkParallelGzipCompress(b *testing.B) {
+	benchmarkCompress(b, Compression{Algorithm: CompressionGzip}.NewWriter)
+}
+
+func BenchmarkParallelGzipCompressSmallBlocks(b *testing.B) {
+	benchmarkCompress(b, Compression{Algorithm: CompressionGzip, BlockSize: 256 << 10}.NewWriter)
+}
+
+func BenchmarkGzipDecompress(b *testing.B) {
+	data := benchmarkData(32 << 20)
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelGzipDecompress(b *testing.B) {
+	benchmarkDecompress(b, Compression{Algorithm: CompressionGzip})
+}
+
+func TestTarballCompression(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	backupDir := path.Join(tmp, "backup")
+	r.NoError(os.Mkdir(backupDir, 0755), "failed to create backup directory")
+
+	filepath := path.Join(backupDir, "test.txt")
+	expected := []byte("test")
+	r.NoError(ioutil.WriteFile(filepath, expected, 0644), "failed to create backup file")
+
+	tar := TarballConfig{
+		Path:        backupDir,
+		Name:        "test",
+		Compression: Compression{Algorithm: CompressionZstd, Level: 3},
+		SaveDir:     tmp,
+	}
+
+	tarball, err := tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+	r.True(strings.HasSuffix(tarball, ".tar.zst"), "unexpected extension on %s", tarball)
+
+	r.NoError(ioutil.WriteFile(filepath, []byte("changed"), 0644), "failed to change backup file")
+
+	// the restore doesn't depend on the configured algorithm
+	tar.Compression = Compression{}
+	r.NoError(tar.Restore(tarball), "failed to restore backup dir")
+
+	actual, err := ioutil.ReadFile(filepath)
+	r.NoError(err, "failed to read restored file")
+	r.Equal(expected, actual, "backup contents mismatch")
+}
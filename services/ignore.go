@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of the file with exclude patterns in the root of a tarball source
+var IgnoreFile = ".dbackerignore"
+
+type pathRule struct {
+	regexp  *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// pathMatcher matches slash separated relative paths against gitignore-style patterns
+type pathMatcher struct {
+	rules []pathRule
+}
+
+func newPathMatcher(patterns []string) (*pathMatcher, error) {
+	m := &pathMatcher{}
+
+	for _, pattern := range patterns {
+		if err := m.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// add parses a single pattern, blank lines and comments are ignored
+func (m *pathMatcher) add(pattern string) error {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+
+	rule := pathRule{}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	// patterns without a slash match the name at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := globToRegexp(pattern)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+
+	rule.regexp = re
+	m.rules = append(m.rules, rule)
+
+	return nil
+}
+
+// addFile loads the patterns of an ignore file, a missing file is not an error
+func (m *pathMatcher) addFile(filepath string) error {
+	f, err := os.Open(filepath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open ignore file: %v", err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err = m.add(scanner.Text()); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Empty returns true when the matcher has no rules
+func (m *pathMatcher) Empty() bool {
+	return len(m.rules) == 0
+}
+
+// Match returns true when the path matches the rules, the last matching rule wins
+func (m *pathMatcher) Match(name string, isDir bool) bool {
+	matched := false
+
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.regexp.MatchString(name) {
+			matched = !rule.negate
+		}
+	}
+
+	return matched
+}
+
+// MatchTree returns true when the path or any of its parent directories match
+func (m *pathMatcher) MatchTree(name string, isDir bool) bool {
+	if m.Match(name, isDir) {
+		return true
+	}
+
+	for dir := parentDir(name); dir != ""; dir = parentDir(dir) {
+		if m.Match(dir, true) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parentDir(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return ""
+	}
+
+	return name[:i]
+}
+
+// globToRegexp converts a glob pattern with ** support to a regular expression
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				b.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				break
+			}
+
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathMatcher(t *testing.T) {
+	r := require.New(t)
+
+	m, err := newPathMatcher([]string{
+		"# comment",
+		"*.lock",
+		"node_modules/",
+		"/cache",
+		"logs/**/*.log",
+		"!keep.lock",
+	})
+	r.NoError(err, "failed to parse patterns")
+
+	r.True(m.Match("yarn.lock", false))
+	r.True(m.Match("app/yarn.lock", false))
+	r.False(m.Match("keep.lock", false), "negated pattern must not match")
+	r.True(m.Match("app/node_modules", true))
+	r.False(m.Match("app/node_modules", false), "directory pattern must not match files")
+	r.True(m.Match("cache", true))
+	r.False(m.Match("app/cache", true), "anchored pattern must only match on the root")
+	r.True(m.Match("logs/app.log", false))
+	r.True(m.Match("logs/a/b/app.log", false))
+	r.False(m.Match("app.log", false))
+
+	r.True(m.MatchTree("app/node_modules/pkg/index.js", false))
+	r.False(m.MatchTree("app/src/index.js", false))
+}
@@ -1,26 +1,46 @@
 package services
 
 import (
-	"compress/gzip"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"sort"
 	"strings"
 
+	"github.com/mholt/archiver/v3"
 	log "unknwon.dev/clog/v2"
 )
 
 // MySQLConfig has the config options for the MySQLConfig service
 type MySQLConfig struct {
-	Host           string
-	Port           string
-	User           string
-	Password       string
-	Database       string
-	Options        string
-	Compress       bool
-	SaveDir        string
-	IgnoreExitCode bool
+	Host              string
+	Port              string
+	User              string
+	Password          string
+	Database          string
+	Options           string
+	Compress          bool
+	Compression       Compression
+	SaveDir           string
+	IgnoreExitCode    bool
+	SingleTransaction bool
+	LockTables        bool
+	Routines          bool
+	Triggers          bool
+	Events            bool
+	GtidPurged        string
+	SplitDatabases    bool
+	BinlogPosition    bool
+	BinlogDir         string
+	BinlogStoreDir    string
+	StopDatetime      string
+	StopGTID          string
+	defaultsFile      string
+	retrieve          RetrieveFunc
 }
 
 // MysqlDumpApp points to the mysqldump binary location
@@ -29,17 +49,81 @@ var MysqlDumpApp = "/usr/bin/mysqldump"
 // MysqlRestoreApp points to the mysql binary location
 var MysqlRestoreApp = "/usr/bin/mysql"
 
-func (m *MySQLConfig) newBaseArgs() []string {
-	args := []string{
+// mysqlSystemDatabases are skipped when dumping each database separately
+var mysqlSystemDatabases = []string{"information_schema", "performance_schema", "sys"}
+
+// newDefaultsFile writes the password to a temporary option file readable
+// only by the current user, so it doesn't show up in the process list
+func (m *MySQLConfig) newDefaultsFile() (func(), error) {
+	if m.Password == "" {
+		return func() {}, nil
+	}
+
+	filepath, err := newMySQLDefaultsFile(m.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	m.defaultsFile = filepath
+
+	return func() {
+		removeMySQLDefaultsFile(filepath)
+		m.defaultsFile = ""
+	}, nil
+}
+
+// newMySQLDefaultsFile creates an option file with mode 0600 containing the
+// client password and returns its path
+func newMySQLDefaultsFile(password string) (string, error) {
+	f, err := ioutil.TempFile("", "mysql-defaults")
+	if err != nil {
+		return "", fmt.Errorf("cannot create defaults file: %v", err)
+	}
+
+	defer f.Close()
+
+	if err = f.Chmod(0600); err != nil {
+		removeMySQLDefaultsFile(f.Name())
+		return "", fmt.Errorf("cannot change defaults file permissions: %v", err)
+	}
+
+	if _, err = fmt.Fprintf(f, "[client]\npassword=\"%s\"\n", escapeOptionValue(password)); err != nil {
+		removeMySQLDefaultsFile(f.Name())
+		return "", fmt.Errorf("cannot write defaults file: %v", err)
+	}
+
+	return f.Name(), nil
+}
+
+func removeMySQLDefaultsFile(filepath string) {
+	if err := os.Remove(filepath); err != nil {
+		log.Warn("Cannot remove defaults file %s, %v", filepath, err)
+	}
+}
+
+func escapeOptionValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return replacer.Replace(value)
+}
+
+func (m *MySQLConfig) newConnArgs() []string {
+	var args []string
+
+	// the defaults file must be the first argument
+	if m.defaultsFile != "" {
+		args = append(args, "--defaults-extra-file="+m.defaultsFile)
+	}
+
+	args = append(args,
 		"-h", m.Host,
 		"-P", m.Port,
 		"-u", m.User,
-	}
+	)
 
-	if m.Password != "" {
-		args = append(args, "-p"+m.Password)
-	}
+	return args
+}
 
+func (m *MySQLConfig) withOptions(args []string) []string {
 	options := strings.Fields(m.Options)
 
 	// add extra options
@@ -50,10 +134,66 @@ func (m *MySQLConfig) newBaseArgs() []string {
 	return args
 }
 
+func (m *MySQLConfig) newBaseArgs() []string {
+	return m.withOptions(m.newConnArgs())
+}
+
+func (m *MySQLConfig) newDumpArgs() []string {
+	args := m.newConnArgs()
+
+	// single transaction gives a consistent snapshot of InnoDB tables,
+	// lock tables is the fallback for other engines
+	if m.SingleTransaction {
+		args = append(args, "--single-transaction")
+	} else if m.LockTables {
+		args = append(args, "--lock-tables")
+	} else {
+		args = append(args, "--skip-lock-tables")
+	}
+
+	if m.Routines {
+		args = append(args, "--routines")
+	}
+
+	if m.Triggers {
+		args = append(args, "--triggers")
+	} else {
+		args = append(args, "--skip-triggers")
+	}
+
+	if m.Events {
+		args = append(args, "--events")
+	}
+
+	if m.GtidPurged != "" {
+		args = append(args, "--set-gtid-purged="+m.GtidPurged)
+	}
+
+	// record the binlog position as a comment, needed for point in time restore
+	if m.BinlogPosition {
+		args = append(args, "--master-data=2")
+	}
+
+	// extra options go last so they can override the defaults
+	return m.withOptions(args)
+}
+
 // Backup generates a dump of the database and returns the path where is stored
 func (m *MySQLConfig) Backup() (string, error) {
 	filepath := generateFilename(m.SaveDir, "mysql-backup")
-	args := m.newBaseArgs()
+
+	cleanup, err := m.newDefaultsFile()
+	if err != nil {
+		return "", err
+	}
+
+	defer cleanup()
+
+	if m.Database == "" && m.SplitDatabases {
+		return m.backupDatabases(filepath)
+	}
+
+	args := m.newDumpArgs()
 
 	if m.Database != "" {
 		args = append(args, "-B", m.Database)
@@ -61,16 +201,54 @@ func (m *MySQLConfig) Backup() (string, error) {
 		args = append(args, "--all-databases")
 	}
 
-	if !m.Compress {
-		filepath += ".sql"
+	return m.dump(filepath, args)
+}
+
+// backupDatabases dumps each database to its own file and packs them in a tarball
+func (m *MySQLConfig) backupDatabases(filepath string) (string, error) {
+	databases, err := m.listDatabases()
+	if err != nil {
+		return "", fmt.Errorf("cannot list databases: %v", err)
+	}
+
+	if err = os.Mkdir(filepath, 0700); err != nil {
+		return "", fmt.Errorf("cannot create dump directory: %v", err)
+	}
+
+	defer os.RemoveAll(filepath)
+
+	for _, database := range databases {
+		log.Trace("Dumping database %s", database)
+
+		args := append(m.newDumpArgs(), "-B", database)
+		if _, err = m.dump(path.Join(filepath, database), args); err != nil {
+			return "", fmt.Errorf("cannot dump database %s: %v", database, err)
+		}
+	}
+
+	tarball := filepath + ".tar"
+	if err = archiver.Archive([]string{filepath}, tarball); err != nil {
+		return "", fmt.Errorf("cannot create tarball on %s, %v", tarball, err)
+	}
+
+	return tarball, nil
+}
+
+// dump runs mysqldump with the specified arguments and writes its output to a
+// file, the extension is appended to the file path
+func (m *MySQLConfig) dump(filepath string, args []string) (string, error) {
+	compression := m.Compression.resolve(m.Compress)
+
+	filepath += ".sql" + compression.Extension()
+	if !compression.Enabled() {
 		args = append(args, "-r", filepath)
-	} else {
-		filepath += ".sql.gz"
 	}
 
-	app := CmdConfig{CensorArg: "-p"}
+	app := CmdConfig{}
 
-	if m.Compress {
+	var writer io.WriteCloser
+
+	if compression.Enabled() {
 		f, err := os.Create(filepath)
 		if err != nil {
 			return "", fmt.Errorf("cannot create file: %v", err)
@@ -78,7 +256,11 @@ func (m *MySQLConfig) Backup() (string, error) {
 
 		defer f.Close()
 
-		writer := gzip.NewWriter(f)
+		writer, err = compression.NewWriter(f)
+		if err != nil {
+			return "", err
+		}
+
 		defer writer.Close()
 
 		app.OutputFile = writer
@@ -88,35 +270,174 @@ func (m *MySQLConfig) Backup() (string, error) {
 		return "", fmt.Errorf("couldn't execute %s, %v", MysqlDumpApp, err)
 	}
 
+	if writer != nil {
+		if err := writer.Close(); err != nil {
+			return "", fmt.Errorf("cannot flush compressed dump: %v", err)
+		}
+	}
+
 	return filepath, nil
 }
 
+func (m *MySQLConfig) listDatabases() ([]string, error) {
+	var out bytes.Buffer
+
+	args := append(m.newBaseArgs(), "-N", "-B", "-e", "SHOW DATABASES")
+	app := CmdConfig{OutputFile: &out}
+
+	if err := app.CmdRun(MysqlRestoreApp, args...); err != nil {
+		return nil, fmt.Errorf("couldn't execute %s, %v", MysqlRestoreApp, err)
+	}
+
+	return filterDatabases(splitDatabases(out.String())), nil
+}
+
+// splitDatabases returns the names printed one per line by -N -B, which
+// escapes the tabs and newlines of the names but keeps their spaces
+func splitDatabases(output string) []string {
+	output = strings.TrimSuffix(output, "\n")
+	if output == "" {
+		return nil
+	}
+
+	return strings.Split(output, "\n")
+}
+
+func filterDatabases(names []string) []string {
+	var databases []string
+
+	for _, name := range names {
+		skip := false
+		for _, system := range mysqlSystemDatabases {
+			if name == system {
+				skip = true
+				break
+			}
+		}
+
+		if !skip {
+			databases = append(databases, name)
+		}
+	}
+
+	return databases
+}
+
 // Restore takes a database dump and restores it
 func (m *MySQLConfig) Restore(filepath string) error {
-	args := m.newBaseArgs()
-	app := CmdConfig{}
+	cleanup, err := m.newDefaultsFile()
+	if err != nil {
+		return err
+	}
 
-	if m.Database != "" {
-		args = append(args, "-D", m.Database)
+	defer cleanup()
+
+	if strings.HasSuffix(filepath, ".tar") {
+		if m.pointInTime() {
+			return fmt.Errorf("point in time restore is not supported with one dump per database")
+		}
+
+		return m.restoreDatabases(filepath)
+	}
+
+	if err = m.restore(filepath); err != nil {
+		return err
+	}
+
+	if m.pointInTime() {
+		return m.applyBinlogs(filepath)
 	}
 
-	f, err := os.Open(filepath)
+	return nil
+}
+
+// restoreDatabases unpacks a tarball created with one dump per database and
+// restores each of them
+func (m *MySQLConfig) restoreDatabases(filepath string) error {
+	tmp, err := ioutil.TempDir(m.SaveDir, "mysql-restore")
 	if err != nil {
-		return fmt.Errorf("cannot open file: %v", err)
+		return fmt.Errorf("cannot create temp directory: %v", err)
 	}
 
-	defer f.Close()
+	defer os.RemoveAll(tmp)
 
-	if strings.HasSuffix(filepath, ".gz") {
-		reader, err := gzip.NewReader(f)
-		if err != nil {
-			return fmt.Errorf("cannot create gzip reader: %v", err)
+	if err = archiver.Unarchive(filepath, tmp); err != nil {
+		return fmt.Errorf("cannot unpack backup: %v", err)
+	}
+
+	dir := path.Join(tmp, strings.TrimSuffix(path.Base(filepath), ".tar"))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot list contents of directory %s, %v", dir, err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		log.Trace("Restoring database dump %s", name)
+
+		if err = m.restore(path.Join(dir, name)); err != nil {
+			return fmt.Errorf("cannot restore %s: %v", name, err)
 		}
+	}
 
-		defer reader.Close()
-		app.InputFile = reader
-	} else {
-		app.InputFile = f
+	return nil
+}
+
+func (m *MySQLConfig) restore(filepath string) error {
+	reader, err := m.Compression.open(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	return m.restoreFrom(reader)
+}
+
+// RestoreStream restores a single dump while it is read, dumps with one file
+// per database and point in time restores need the backup on disk
+func (m *MySQLConfig) RestoreStream(filename string, open func() (io.ReadCloser, error)) error {
+	if strings.HasSuffix(filename, ".tar") || m.pointInTime() {
+		return ErrStreamUnsupported
+	}
+
+	cleanup, err := m.newDefaultsFile()
+	if err != nil {
+		return err
+	}
+
+	defer cleanup()
+
+	stream, err := open()
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	reader, err := m.Compression.decompress(filename, stream)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	return m.restoreFrom(reader)
+}
+
+// restoreFrom restores a decompressed dump
+func (m *MySQLConfig) restoreFrom(reader io.Reader) error {
+	args := m.newBaseArgs()
+	app := CmdConfig{InputFile: reader}
+
+	if m.Database != "" {
+		args = append(args, "-D", m.Database)
 	}
 
 	if err := app.CmdRun(MysqlRestoreApp, args...); err != nil {
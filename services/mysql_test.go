@@ -0,0 +1,77 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMySQLDumpArgs(t *testing.T) {
+	r := require.New(t)
+
+	m := MySQLConfig{
+		SingleTransaction: true,
+		LockTables:        true,
+		Routines:          true,
+		Triggers:          true,
+		Events:            true,
+		Options:           "--skip-triggers",
+	}
+
+	args := m.newDumpArgs()
+	r.Contains(args, "--single-transaction")
+	r.NotContains(args, "--lock-tables")
+	r.Contains(args, "--routines")
+	r.Contains(args, "--events")
+	r.Equal("--skip-triggers", args[len(args)-1], "extra options must go last")
+
+	m.SingleTransaction = false
+	m.Triggers = false
+	m.GtidPurged = "OFF"
+
+	args = m.newDumpArgs()
+	r.Contains(args, "--lock-tables")
+	r.Contains(args, "--skip-triggers")
+	r.Contains(args, "--set-gtid-purged=OFF")
+}
+
+func TestFilterDatabases(t *testing.T) {
+	r := require.New(t)
+
+	res := filterDatabases([]string{"information_schema", "app", "mysql", "performance_schema", "sys"})
+	r.Equal([]string{"app", "mysql"}, res)
+
+	r.Equal([]string{"my app", "sys"}, splitDatabases("my app\nsys\n"), "names must only be split on newlines")
+	r.Empty(splitDatabases(""))
+}
+
+func TestMySQLDefaultsFile(t *testing.T) {
+	r := require.New(t)
+
+	m := MySQLConfig{Password: `pa"ss\word`}
+
+	cleanup, err := m.newDefaultsFile()
+	r.NoError(err, "failed to create defaults file")
+
+	file := m.defaultsFile
+	info, err := os.Stat(file)
+	r.NoError(err, "defaults file not found")
+	r.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	contents, err := ioutil.ReadFile(file)
+	r.NoError(err, "failed to read defaults file")
+	r.Equal("[client]\npassword=\"pa\\\"ss\\\\word\"\n", string(contents))
+
+	args := m.newBaseArgs()
+	r.Equal("--defaults-extra-file="+file, args[0])
+	for _, arg := range args {
+		r.NotContains(arg, m.Password)
+	}
+
+	cleanup()
+	_, err = os.Stat(file)
+	r.True(os.IsNotExist(err), "defaults file was not removed")
+	r.Empty(m.defaultsFile)
+}
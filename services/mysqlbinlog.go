@@ -0,0 +1,372 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// MysqlBinlogApp points to the mysqlbinlog binary location
+var MysqlBinlogApp = "/usr/bin/mysqlbinlog"
+
+// binlogFilePattern matches binlog file names, like mysql-bin.000123
+var binlogFilePattern = regexp.MustCompile(`^.+\.[0-9]{6,}$`)
+
+// binlogPositionPattern matches the position written by mysqldump --master-data=2
+var binlogPositionPattern = regexp.MustCompile(`CHANGE (?:MASTER|REPLICATION SOURCE) TO (?:MASTER|SOURCE)_LOG_FILE='([^']+)', (?:MASTER|SOURCE)_LOG_POS=([0-9]+)`)
+
+// mariadbGTIDPattern matches a MariaDB GTID, domain-server-sequence
+var mariadbGTIDPattern = regexp.MustCompile(`^[0-9]+-[0-9]+-[0-9]+$`)
+
+// mysqlGTIDPattern matches a MySQL GTID, source_uuid[:tag]:transaction_id
+var mysqlGTIDPattern = regexp.MustCompile(`^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}(?::[A-Za-z_][A-Za-z0-9_]*)?):([0-9]+)$`)
+
+// binlogPositionMaxLines limits how far into the dump the position is searched
+var binlogPositionMaxLines = 100
+
+// MySQLBinlogShipper streams the binary logs of a server to a local spool
+// directory and hands over the closed files to be archived
+type MySQLBinlogShipper struct {
+	Config    *MySQLConfig
+	SpoolDir  string
+	StartFile string
+	Interval  time.Duration
+}
+
+// Run starts mysqlbinlog and calls upload for every closed binlog file until
+// the stop channel is closed or the process exits
+func (b *MySQLBinlogShipper) Run(stop <-chan struct{}, upload func(filepath string, filename string) error) error {
+	if err := os.MkdirAll(b.SpoolDir, 0700); err != nil {
+		return fmt.Errorf("cannot create spool directory: %v", err)
+	}
+
+	files, err := listBinlogs(b.SpoolDir)
+	if err != nil {
+		return err
+	}
+
+	// resume from the newest binlog, it is fetched again from the beginning
+	start := b.StartFile
+	if len(files) > 0 {
+		start = files[len(files)-1]
+	}
+
+	if start == "" {
+		return fmt.Errorf("binlog start file is not set and the spool directory is empty")
+	}
+
+	cleanup, err := b.Config.newDefaultsFile()
+	if err != nil {
+		return err
+	}
+
+	defer cleanup()
+
+	args := append(b.Config.withOptions(b.Config.newConnArgs()),
+		"--read-from-remote-server",
+		"--raw",
+		"--stop-never",
+		"--result-file="+b.SpoolDir+"/",
+		start,
+	)
+
+	done := make(chan error, 1)
+	app := CmdConfig{Stop: stop}
+
+	log.Info("Archiving binlogs starting from %s", start)
+
+	go func() {
+		done <- app.CmdRun(MysqlBinlogApp, args...)
+	}()
+
+	interval := b.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			if uerr := b.uploadClosed(upload); uerr != nil {
+				log.Error("Failed to archive binlogs: %v", uerr)
+			}
+
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+
+			if err != nil {
+				return fmt.Errorf("couldn't execute %s, %v", MysqlBinlogApp, err)
+			}
+
+			return fmt.Errorf("%s exited unexpectedly", MysqlBinlogApp)
+		case <-ticker.C:
+			if err := b.uploadClosed(upload); err != nil {
+				log.Error("Failed to archive binlogs: %v", err)
+			}
+		}
+	}
+}
+
+// uploadClosed archives every binlog except the newest one, which is still
+// being written
+func (b *MySQLBinlogShipper) uploadClosed(upload func(filepath string, filename string) error) error {
+	files, err := listBinlogs(b.SpoolDir)
+	if err != nil {
+		return err
+	}
+
+	if len(files) < 2 {
+		return nil
+	}
+
+	for _, file := range files[:len(files)-1] {
+		filepath := path.Join(b.SpoolDir, file)
+
+		log.Trace("Archiving binlog %s", file)
+		if err = upload(filepath, file); err != nil {
+			return fmt.Errorf("cannot upload %s: %v", file, err)
+		}
+
+		// the store may already have moved or removed the file
+		if err = os.Remove(filepath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove %s: %v", filepath, err)
+		}
+	}
+
+	return nil
+}
+
+func listBinlogs(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list contents of directory %s, %v", dir, err)
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && binlogFilePattern.MatchString(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// readBinlogPosition returns the binlog file and position stored in a dump
+func readBinlogPosition(filepath string) (string, string, error) {
+	reader, err := openDecompressed(filepath)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for i := 0; i < binlogPositionMaxLines && scanner.Scan(); i++ {
+		if match := binlogPositionPattern.FindStringSubmatch(scanner.Text()); match != nil {
+			return match[1], match[2], nil
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("cannot read dump: %v", err)
+	}
+
+	return "", "", fmt.Errorf("binlog position not found, the dump must be created with binlog position enabled")
+}
+
+// SetRetriever sets the function used to download the binlogs archived on the store
+func (m *MySQLConfig) SetRetriever(retrieve RetrieveFunc) {
+	m.retrieve = retrieve
+}
+
+// pointInTime reports if archived binlogs are applied after restoring a dump
+func (m *MySQLConfig) pointInTime() bool {
+	return m.BinlogDir != "" || m.BinlogStoreDir != ""
+}
+
+// nextBinlog returns the name of the binlog written after the given one
+func nextBinlog(name string) (string, error) {
+	if !binlogFilePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid binlog name %s", name)
+	}
+
+	ext := path.Ext(name)
+	seq, err := strconv.ParseUint(ext[1:], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid binlog name %s", name)
+	}
+
+	return fmt.Sprintf("%s.%0*d", strings.TrimSuffix(name, ext), len(ext)-1, seq+1), nil
+}
+
+// localBinlogs returns the binlogs of BinlogDir from the given file on
+func (m *MySQLConfig) localBinlogs(file string) ([]string, error) {
+	files, err := listBinlogs(m.BinlogDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var binlogs []string
+	for _, name := range files {
+		if name >= file {
+			binlogs = append(binlogs, path.Join(m.BinlogDir, name))
+		}
+	}
+
+	if len(binlogs) == 0 || path.Base(binlogs[0]) != file {
+		return nil, fmt.Errorf("binlog %s not found on %s", file, m.BinlogDir)
+	}
+
+	return binlogs, nil
+}
+
+// retrieveBinlogs downloads the binlogs of BinlogStoreDir from the given file
+// on, following the sequence until the next file isn't found on the store
+func (m *MySQLConfig) retrieveBinlogs(file string) ([]string, error) {
+	if m.retrieve == nil {
+		return nil, fmt.Errorf("cannot retrieve binlogs from the store")
+	}
+
+	var binlogs []string
+	for name := file; ; {
+		filepath, err := m.retrieve(path.Join(m.BinlogStoreDir, name))
+		if err != nil {
+			if len(binlogs) == 0 {
+				return nil, fmt.Errorf("binlog %s not found on the store, %v", name, err)
+			}
+
+			log.Warn("Cannot retrieve binlog %s, applying binlogs up to %s: %v", name, path.Base(binlogs[len(binlogs)-1]), err)
+			return binlogs, nil
+		}
+
+		binlogs = append(binlogs, filepath)
+
+		if name, err = nextBinlog(name); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// stopGTIDArgs returns the mysqlbinlog options that stop after the
+// transaction of a GTID. MariaDB stops on it, MySQL skips the later
+// transactions of the same source
+func stopGTIDArgs(gtid string) ([]string, error) {
+	if mariadbGTIDPattern.MatchString(gtid) {
+		return []string{"--stop-position=" + gtid}, nil
+	}
+
+	match := mysqlGTIDPattern.FindStringSubmatch(gtid)
+	if match == nil {
+		return nil, fmt.Errorf("invalid GTID %s", gtid)
+	}
+
+	seq, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil || seq >= math.MaxInt64-1 {
+		return nil, fmt.Errorf("invalid GTID %s", gtid)
+	}
+
+	return []string{fmt.Sprintf("--exclude-gtids=%s:%d-%d", match[1], seq+1, int64(math.MaxInt64-1))}, nil
+}
+
+// binlogArgs returns the mysqlbinlog options to replay the binlogs from the
+// dump position up to the configured stop point, only the transactions of
+// the restored database are replayed when it is set
+func (m *MySQLConfig) binlogArgs(position string) ([]string, error) {
+	args := []string{"--start-position=" + position}
+
+	if m.Database != "" {
+		args = append(args, "--database="+m.Database)
+	}
+
+	if m.StopDatetime != "" {
+		args = append(args, "--stop-datetime="+m.StopDatetime)
+	}
+
+	if m.StopGTID != "" {
+		stop, err := stopGTIDArgs(m.StopGTID)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, stop...)
+	}
+
+	return args, nil
+}
+
+// applyBinlogs replays the archived binlogs newer than the dump position up
+// to the configured stop datetime or GTID
+func (m *MySQLConfig) applyBinlogs(dump string) error {
+	file, position, err := readBinlogPosition(dump)
+	if err != nil {
+		return err
+	}
+
+	args, err := m.binlogArgs(position)
+	if err != nil {
+		return err
+	}
+
+	var binlogs []string
+	if m.BinlogDir != "" {
+		binlogs, err = m.localBinlogs(file)
+	} else {
+		binlogs, err = m.retrieveBinlogs(file)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	args = append(args, binlogs...)
+
+	log.Info("Applying %d binlogs starting from %s:%s", len(binlogs), file, position)
+
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		app := CmdConfig{OutputFile: writer}
+		err := app.CmdRun(MysqlBinlogApp, args...)
+		writer.CloseWithError(err)
+		done <- err
+	}()
+
+	app := CmdConfig{InputFile: reader}
+	restoreErr := app.CmdRun(MysqlRestoreApp, m.newBaseArgs()...)
+
+	// unblock mysqlbinlog if mysql exited early
+	reader.Close()
+
+	if err = <-done; err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MysqlBinlogApp, err)
+	}
+
+	if restoreErr != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MysqlRestoreApp, restoreErr)
+	}
+
+	return nil
+}
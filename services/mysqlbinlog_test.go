@@ -0,0 +1,135 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinlogPosition(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "binlog")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dump := path.Join(tmp, "dump.sql")
+	contents := "-- MySQL dump\n--\n-- CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000042', MASTER_LOG_POS=1234;\n"
+	err = ioutil.WriteFile(dump, []byte(contents), 0644)
+	r.NoError(err, "failed to create dump file")
+
+	file, position, err := readBinlogPosition(dump)
+	r.NoError(err, "failed to read binlog position")
+	r.Equal("mysql-bin.000042", file)
+	r.Equal("1234", position)
+
+	err = ioutil.WriteFile(dump, []byte("-- MySQL dump\n"), 0644)
+	r.NoError(err, "failed to create dump file")
+
+	_, _, err = readBinlogPosition(dump)
+	r.Error(err, "position found on a dump without it")
+}
+
+func TestListBinlogs(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "binlog")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	for _, name := range []string{"mysql-bin.000002", "mysql-bin.000001", "mysql-bin.index"} {
+		err = ioutil.WriteFile(path.Join(tmp, name), nil, 0644)
+		r.NoError(err, "failed to create binlog file")
+	}
+
+	files, err := listBinlogs(tmp)
+	r.NoError(err, "failed to list binlogs")
+	r.Equal([]string{"mysql-bin.000001", "mysql-bin.000002"}, files)
+
+	shipper := MySQLBinlogShipper{SpoolDir: tmp}
+
+	var uploaded []string
+	err = shipper.uploadClosed(func(filepath string, filename string) error {
+		uploaded = append(uploaded, filename)
+		return nil
+	})
+	r.NoError(err, "failed to upload closed binlogs")
+	r.Equal([]string{"mysql-bin.000001"}, uploaded, "only closed binlogs must be uploaded")
+
+	files, err = listBinlogs(tmp)
+	r.NoError(err, "failed to list binlogs")
+	r.Equal([]string{"mysql-bin.000002"}, files)
+}
+
+func TestRetrieveBinlogs(t *testing.T) {
+	r := require.New(t)
+
+	next, err := nextBinlog("mysql-bin.000009")
+	r.NoError(err, "failed to find next binlog")
+	r.Equal("mysql-bin.000010", next)
+
+	next, err = nextBinlog("mysql-bin.999999")
+	r.NoError(err, "failed to find next binlog")
+	r.Equal("mysql-bin.1000000", next)
+
+	_, err = nextBinlog("mysql-bin.index")
+	r.Error(err, "invalid binlog names must fail")
+
+	m := &MySQLConfig{BinlogStoreDir: "../binlogs"}
+
+	_, err = m.retrieveBinlogs("mysql-bin.000001")
+	r.Error(err, "binlogs can't be retrieved without a store")
+
+	stored := map[string]bool{
+		"../binlogs/mysql-bin.000001": true,
+		"../binlogs/mysql-bin.000002": true,
+		"../binlogs/mysql-bin.000003": true,
+	}
+
+	var requested []string
+	m.SetRetriever(func(name string) (string, error) {
+		requested = append(requested, name)
+		if !stored[name] {
+			return "", os.ErrNotExist
+		}
+
+		return path.Join("/tmp", path.Base(name)), nil
+	})
+
+	binlogs, err := m.retrieveBinlogs("mysql-bin.000002")
+	r.NoError(err, "failed to retrieve binlogs")
+	r.Equal([]string{"/tmp/mysql-bin.000002", "/tmp/mysql-bin.000003"}, binlogs)
+	r.Equal("../binlogs/mysql-bin.000004", requested[len(requested)-1], "the sequence must end on the first missing binlog")
+
+	_, err = m.retrieveBinlogs("mysql-bin.000005")
+	r.Error(err, "the binlog of the dump must be found")
+}
+
+func TestBinlogStopGTID(t *testing.T) {
+	r := require.New(t)
+
+	m := &MySQLConfig{StopDatetime: "2020-06-30 12:00:00", StopGTID: "0-1-100"}
+	args, err := m.binlogArgs("1234")
+	r.NoError(err, "failed to build binlog args")
+	r.Equal([]string{"--start-position=1234", "--stop-datetime=2020-06-30 12:00:00", "--stop-position=0-1-100"}, args)
+
+	m = &MySQLConfig{StopGTID: "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"}
+	args, err = m.binlogArgs("4")
+	r.NoError(err, "failed to build binlog args")
+	r.Equal([]string{"--start-position=4", "--exclude-gtids=3e11fa47-71ca-11e1-9e33-c80aa9429562:24-9223372036854775806"}, args)
+
+	args, err = stopGTIDArgs("3e11fa47-71ca-11e1-9e33-c80aa9429562:nightly:7")
+	r.NoError(err, "tagged GTIDs must be supported")
+	r.Equal([]string{"--exclude-gtids=3e11fa47-71ca-11e1-9e33-c80aa9429562:nightly:8-9223372036854775806"}, args)
+
+	_, err = stopGTIDArgs("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	r.Error(err, "GTID sets must fail")
+
+	m = &MySQLConfig{Database: "app"}
+	args, err = m.binlogArgs("4")
+	r.NoError(err, "failed to build binlog args")
+	r.Equal([]string{"--start-position=4", "--database=app"}, args, "only the restored database must be replayed")
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// MySQLPhysicalConfig has the config options for the MySQLPhysicalConfig service
+type MySQLPhysicalConfig struct {
+	Host        string
+	Port        string
+	User        string
+	Password    string
+	Options     string
+	Compress    bool
+	Compression Compression
+	SaveDir     string
+	Tool        string
+	DataDir     string
+	UID         uint32
+	GID         uint32
+}
+
+// MariabackupApp points to the mariabackup binary location
+var MariabackupApp = "/usr/bin/mariabackup"
+
+// MbstreamApp points to the mbstream binary location
+var MbstreamApp = "/usr/bin/mbstream"
+
+// XtrabackupApp points to the xtrabackup binary location
+var XtrabackupApp = "/usr/bin/xtrabackup"
+
+// XbstreamApp points to the xbstream binary location
+var XbstreamApp = "/usr/bin/xbstream"
+
+// apps returns the backup and the stream extraction binaries of the selected tool
+func (m *MySQLPhysicalConfig) apps() (string, string, error) {
+	switch m.Tool {
+	case "", "mariabackup":
+		return MariabackupApp, MbstreamApp, nil
+	case "xtrabackup":
+		return XtrabackupApp, XbstreamApp, nil
+	default:
+		return "", "", fmt.Errorf("unsupported physical backup tool: %s", m.Tool)
+	}
+}
+
+func (m *MySQLPhysicalConfig) newCmd() *CmdConfig {
+	return &CmdConfig{
+		Credential: &syscall.Credential{Uid: m.UID, Gid: m.GID},
+	}
+}
+
+// newWorkDir creates a temporary directory writable by the database user
+func (m *MySQLPhysicalConfig) newWorkDir(prefix string) (string, error) {
+	dir, err := ioutil.TempDir(m.SaveDir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("cannot create temp directory: %v", err)
+	}
+
+	if os.Geteuid() == 0 {
+		if err = os.Chown(dir, int(m.UID), int(m.GID)); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("cannot change owner of %s: %v", dir, err)
+		}
+	}
+
+	return dir, nil
+}
+
+func (m *MySQLPhysicalConfig) newBackupArgs(defaultsFile string, targetDir string) []string {
+	var args []string
+
+	// the defaults file must be the first argument
+	if defaultsFile != "" {
+		args = append(args, "--defaults-extra-file="+defaultsFile)
+	}
+
+	args = append(args,
+		"--backup",
+		"--stream=xbstream",
+		"--target-dir="+targetDir,
+		"--host="+m.Host,
+		"--port="+m.Port,
+		"--user="+m.User,
+	)
+
+	options := strings.Fields(m.Options)
+
+	// add extra options
+	if len(options) > 0 {
+		args = append(args, options...)
+	}
+
+	return args
+}
+
+func (m *MySQLPhysicalConfig) newPrepareArgs(targetDir string) []string {
+	return []string{"--prepare", "--target-dir=" + targetDir}
+}
+
+func (m *MySQLPhysicalConfig) newCopyBackArgs(targetDir string) []string {
+	return []string{"--copy-back", "--target-dir=" + targetDir, "--datadir=" + m.DataDir}
+}
+
+// Backup streams a physical copy of the running server and returns the path where is stored
+func (m *MySQLPhysicalConfig) Backup() (string, error) {
+	backupApp, _, err := m.apps()
+	if err != nil {
+		return "", err
+	}
+
+	compression := m.Compression.resolve(m.Compress)
+	filepath := generateFilename(m.SaveDir, "mysql-physical-backup") + ".xb" + compression.Extension()
+
+	var defaultsFile string
+	if m.Password != "" {
+		defaultsFile, err = newMySQLDefaultsFile(m.Password)
+		if err != nil {
+			return "", err
+		}
+
+		defer removeMySQLDefaultsFile(defaultsFile)
+	}
+
+	targetDir, err := ioutil.TempDir(m.SaveDir, "mysql-physical")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temp directory: %v", err)
+	}
+
+	defer os.RemoveAll(targetDir)
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer f.Close()
+
+	writer, err := compression.NewWriter(f)
+	if err != nil {
+		return "", err
+	}
+
+	defer writer.Close()
+
+	app := CmdConfig{OutputFile: writer}
+
+	if err := app.CmdRun(backupApp, m.newBackupArgs(defaultsFile, targetDir)...); err != nil {
+		return "", fmt.Errorf("couldn't execute %s, %v", backupApp, err)
+	}
+
+	if err = writer.Close(); err != nil {
+		return "", fmt.Errorf("cannot flush compressed backup: %v", err)
+	}
+
+	return filepath, nil
+}
+
+// Restore extracts and prepares a physical backup and copies it back to the
+// data directory, the database server must be stopped
+func (m *MySQLPhysicalConfig) Restore(filepath string) error {
+	backupApp, streamApp, err := m.apps()
+	if err != nil {
+		return err
+	}
+
+	if m.DataDir == "" {
+		return fmt.Errorf("data directory is not set")
+	}
+
+	targetDir, err := m.newWorkDir("mysql-physical-restore")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(targetDir)
+
+	reader, err := m.Compression.open(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	app := m.newCmd()
+	app.InputFile = reader
+
+	log.Trace("Extracting backup stream to %s", targetDir)
+	if err = app.CmdRun(streamApp, "-x", "-C", targetDir); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", streamApp, err)
+	}
+
+	app = m.newCmd()
+
+	log.Trace("Preparing backup on %s", targetDir)
+	if err = app.CmdRun(backupApp, m.newPrepareArgs(targetDir)...); err != nil {
+		return fmt.Errorf("couldn't prepare backup, %v", err)
+	}
+
+	return m.copyBack(backupApp, targetDir)
+}
+
+// copyBack copies a prepared backup to the data directory. Copy back requires
+// an empty data directory, so its contents are moved next to it and moved
+// back if the copy fails
+func (m *MySQLPhysicalConfig) copyBack(backupApp string, targetDir string) error {
+	dataDir := filepath.Clean(m.DataDir)
+
+	// the rollback directory is a sibling so renames never cross filesystems
+	rollback, err := ioutil.TempDir(filepath.Dir(dataDir), rollbackPrefix)
+	if err != nil {
+		return fmt.Errorf("cannot create rollback directory: %v", err)
+	}
+
+	if err = moveDirectoryContents(dataDir, rollback); err != nil {
+		m.rollback(dataDir, rollback)
+		return fmt.Errorf("failed to empty data directory before restoring: %v", err)
+	}
+
+	log.Trace("Copying backup to %s", dataDir)
+	if err = m.newCmd().CmdRun(backupApp, m.newCopyBackArgs(targetDir)...); err != nil {
+		m.rollback(dataDir, rollback)
+		return fmt.Errorf("couldn't copy back backup, %v", err)
+	}
+
+	if err = os.RemoveAll(rollback); err != nil {
+		log.Warn("Cannot remove rollback directory %s, %v", rollback, err)
+	}
+
+	return nil
+}
+
+// rollback replaces the data directory with the contents saved by copyBack
+func (m *MySQLPhysicalConfig) rollback(dataDir string, rollback string) {
+	if err := removeDirectoryContents(dataDir); err != nil {
+		log.Error("Cannot roll back %s, its previous contents are kept on %s: %v", dataDir, rollback, err)
+		return
+	}
+
+	if err := moveDirectoryContents(rollback, dataDir); err != nil {
+		log.Error("Cannot roll back %s, its previous contents are kept on %s: %v", dataDir, rollback, err)
+		return
+	}
+
+	if err := os.RemoveAll(rollback); err != nil {
+		log.Warn("Cannot remove rollback directory %s, %v", rollback, err)
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMySQLPhysicalArgs(t *testing.T) {
+	r := require.New(t)
+
+	m := MySQLPhysicalConfig{
+		Host:    "db",
+		Port:    "3306",
+		User:    "root",
+		Options: "--parallel=4",
+		DataDir: "/var/lib/mysql",
+	}
+
+	args := m.newBackupArgs("/tmp/defaults.cnf", "/tmp/target")
+	r.Equal("--defaults-extra-file=/tmp/defaults.cnf", args[0], "the defaults file must go first")
+	r.Contains(args, "--backup")
+	r.Contains(args, "--stream=xbstream")
+	r.Contains(args, "--target-dir=/tmp/target")
+	r.Contains(args, "--host=db")
+	r.Contains(args, "--port=3306")
+	r.Equal("--parallel=4", args[len(args)-1], "extra options must go last")
+
+	args = m.newBackupArgs("", "/tmp/target")
+	r.Equal("--backup", args[0])
+
+	r.Equal([]string{"--prepare", "--target-dir=/tmp/target"}, m.newPrepareArgs("/tmp/target"))
+	r.Equal([]string{"--copy-back", "--target-dir=/tmp/target", "--datadir=/var/lib/mysql"}, m.newCopyBackArgs("/tmp/target"))
+}
+
+func TestMySQLPhysicalTool(t *testing.T) {
+	r := require.New(t)
+
+	m := MySQLPhysicalConfig{}
+	backupApp, streamApp, err := m.apps()
+	r.NoError(err)
+	r.Equal(MariabackupApp, backupApp, "mariabackup must be the default")
+	r.Equal(MbstreamApp, streamApp)
+
+	m.Tool = "xtrabackup"
+	backupApp, streamApp, err = m.apps()
+	r.NoError(err)
+	r.Equal(XtrabackupApp, backupApp)
+	r.Equal(XbstreamApp, streamApp)
+
+	m.Tool = "mysqldump"
+	_, _, err = m.apps()
+	r.Error(err, "unknown tools must fail")
+}
+
+func TestMySQLPhysicalCopyBackRollback(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "mysqlphysical")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dataDir := path.Join(tmp, "mysql")
+	r.NoError(os.Mkdir(dataDir, 0755), "failed to create data directory")
+	r.NoError(ioutil.WriteFile(path.Join(dataDir, "ibdata1"), []byte("old"), 0644), "failed to create data file")
+
+	// the copy fails after writing part of the backup
+	failing := path.Join(tmp, "failing-backup")
+	script := "#!/bin/sh\ntouch " + dataDir + "/partial\nexit 1\n"
+	r.NoError(ioutil.WriteFile(failing, []byte(script), 0755), "failed to create script")
+
+	m := MySQLPhysicalConfig{DataDir: dataDir, UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	r.Error(m.copyBack(failing, tmp), "the failed copy must be reported")
+
+	files, err := ioutil.ReadDir(dataDir)
+	r.NoError(err, "failed to list data directory")
+	r.Len(files, 1, "only the previous contents must be left")
+
+	data, err := ioutil.ReadFile(path.Join(dataDir, "ibdata1"))
+	r.NoError(err, "failed to read data file")
+	r.Equal([]byte("old"), data)
+
+	// the previous contents are removed once the copy succeeds
+	succeeding := path.Join(tmp, "succeeding-backup")
+	script = "#!/bin/sh\ntest -z \"$(ls -A " + dataDir + ")\" || exit 1\ntouch " + dataDir + "/restored\n"
+	r.NoError(ioutil.WriteFile(succeeding, []byte(script), 0755), "failed to create script")
+	r.NoError(m.copyBack(succeeding, tmp), "failed to copy back")
+
+	files, err = ioutil.ReadDir(dataDir)
+	r.NoError(err, "failed to list data directory")
+	r.Len(files, 1)
+	r.Equal("restored", files[0].Name())
+
+	files, err = ioutil.ReadDir(tmp)
+	r.NoError(err, "failed to list directory")
+
+	for _, file := range files {
+		r.NotContains(file.Name(), rollbackPrefix, "rollback directory was not removed")
+	}
+}
@@ -1,8 +1,8 @@
 package services
 
 import (
-	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -19,6 +19,7 @@ type PostgresConfig struct {
 	Database       string
 	Options        string
 	Compress       bool
+	Compression    Compression
 	Custom         bool
 	SaveDir        string
 	IgnoreExitCode bool
@@ -85,6 +86,7 @@ func (p *PostgresConfig) newPostgresCmd() *CmdConfig {
 func (p *PostgresConfig) Backup() (string, error) {
 	filepath := generateFilename(p.SaveDir, "postgres-backup")
 	args := p.newBaseArgs()
+	compression := p.Compression.resolve(p.Compress)
 
 	var appPath string
 	if p.Database != "" {
@@ -98,16 +100,18 @@ func (p *PostgresConfig) Backup() (string, error) {
 		filepath += ".dump"
 		args = append(args, "-f", filepath)
 		args = append(args, "-Fc")
-	} else if !p.Compress {
+	} else if !compression.Enabled() {
 		filepath += ".sql"
 		args = append(args, "-f", filepath)
 	} else {
-		filepath += ".sql.gz"
+		filepath += ".sql" + compression.Extension()
 	}
 
 	app := p.newPostgresCmd()
 
-	if p.Compress && !p.Custom {
+	var writer io.WriteCloser
+
+	if compression.Enabled() && !p.Custom {
 		f, err := os.Create(filepath)
 		if err != nil {
 			return "", fmt.Errorf("cannot create file: %v", err)
@@ -115,7 +119,11 @@ func (p *PostgresConfig) Backup() (string, error) {
 
 		defer f.Close()
 
-		writer := gzip.NewWriter(f)
+		writer, err = compression.NewWriter(f)
+		if err != nil {
+			return "", err
+		}
+
 		defer writer.Close()
 
 		app.OutputFile = writer
@@ -125,11 +133,57 @@ func (p *PostgresConfig) Backup() (string, error) {
 		return "", fmt.Errorf("couldn't execute %s, %v", appPath, err)
 	}
 
+	if writer != nil {
+		if err := writer.Close(); err != nil {
+			return "", fmt.Errorf("cannot flush compressed dump: %v", err)
+		}
+	}
+
 	return filepath, nil
 }
 
 // Restore takes a database dump and restores it
 func (p *PostgresConfig) Restore(filepath string) error {
+	if p.Custom {
+		return p.restore(filepath, nil)
+	}
+
+	reader, err := p.Compression.open(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	return p.restore(filepath, reader)
+}
+
+// RestoreStream restores a plain dump while it is read, custom format dumps
+// need the backup on disk
+func (p *PostgresConfig) RestoreStream(filename string, open func() (io.ReadCloser, error)) error {
+	if p.Custom {
+		return ErrStreamUnsupported
+	}
+
+	stream, err := open()
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	reader, err := p.Compression.decompress(filename, stream)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	return p.restore(filename, reader)
+}
+
+// restore runs the restore of a dump, plain dumps are read from the input
+func (p *PostgresConfig) restore(filepath string, input io.Reader) error {
 	args := p.newBaseArgs()
 	var appPath string
 
@@ -142,29 +196,7 @@ func (p *PostgresConfig) Restore(filepath string) error {
 	}
 
 	app := p.newPostgresCmd()
-
-	if !p.Custom {
-		f, err := os.Open(filepath)
-		if err != nil {
-			return fmt.Errorf("cannot open file: %v", err)
-		}
-
-		defer f.Close()
-
-		if strings.HasSuffix(filepath, ".gz") {
-			reader, err := gzip.NewReader(f)
-			if err != nil {
-				return fmt.Errorf("cannot create gzip reader: %v", err)
-			}
-
-			defer reader.Close()
-
-			app.InputFile = reader
-		} else {
-			app.InputFile = f
-		}
-		defer f.Close()
-	}
+	app.InputFile = input
 
 	if p.Drop {
 		log.Info("Recreating database %s", p.Database)
@@ -0,0 +1,10 @@
+package services
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// exchangePaths atomically swaps two paths on the same filesystem
+func exchangePaths(oldpath string, newpath string) error {
+	return unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, unix.RENAME_EXCHANGE)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package services
+
+import (
+	"os"
+)
+
+// exchangePaths swaps two paths on the same filesystem, the swap is not atomic
+func exchangePaths(oldpath string, newpath string) error {
+	tmp := oldpath + ".swap"
+
+	if err := os.Rename(newpath, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(oldpath, newpath); err != nil {
+		_ = os.Rename(tmp, newpath)
+		return err
+	}
+
+	return os.Rename(tmp, oldpath)
+}
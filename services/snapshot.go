@@ -0,0 +1,317 @@
+package services
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// RetrieveFunc downloads a backup from the store and returns its local path
+type RetrieveFunc func(filename string) (string, error)
+
+// ChainRestorer is implemented by services whose backups depend on previous
+// backups of the same store
+type ChainRestorer interface {
+	SetRetriever(retrieve RetrieveFunc)
+}
+
+// snapshotIndexName is the name of the index entry inside incremental tarballs
+var snapshotIndexName = ".dbacker-snapshot.json"
+
+// snapshotFile has the attributes used to detect changes of a file
+type snapshotFile struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Inode   uint64      `json:"inode"`
+}
+
+// snapshotIndex describes the state of the source directory when a backup was taken
+type snapshotIndex struct {
+	Name    string                  `json:"name"`
+	Full    bool                    `json:"full"`
+	Chain   []string                `json:"chain"`
+	Sources []string                `json:"sources"`
+	Files   map[string]snapshotFile `json:"files"`
+	Deleted []string                `json:"deleted"`
+}
+
+func newSnapshotFile(info os.FileInfo) snapshotFile {
+	file := snapshotFile{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Mode:    info.Mode(),
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		file.Inode = uint64(stat.Ino)
+	}
+
+	return file
+}
+
+func (f *TarballConfig) snapshotPath() string {
+	return path.Join(f.StateDir, f.prefix()+"-snapshot.json")
+}
+
+// sameSources reports if two indexes were created from the same sources
+func sameSources(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newSnapshot compares the entries with the previous snapshot and returns the
+// new index and the entries that must be archived
+func (f *TarballConfig) newSnapshot(sources []tarballSource, entries []tarballEntry) (*snapshotIndex, []tarballEntry, error) {
+	if f.StateDir == "" {
+		return nil, nil, fmt.Errorf("state directory is required for incremental backups")
+	}
+
+	index := &snapshotIndex{Files: make(map[string]snapshotFile)}
+	for _, source := range sources {
+		index.Sources = append(index.Sources, source.name)
+	}
+
+	for _, entry := range entries {
+		index.Files[entry.name] = newSnapshotFile(entry.info)
+	}
+
+	previous, err := f.loadSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if previous == nil || f.FullEvery <= 0 || len(previous.Chain)+1 >= f.FullEvery {
+		log.Trace("Creating a full backup")
+		index.Full = true
+		return index, entries, nil
+	}
+
+	// names of the entries change with the sources, so they can't be compared
+	if !sameSources(previous.Sources, index.Sources) {
+		log.Trace("Creating a full backup, the sources changed since %s", previous.Name)
+		index.Full = true
+		return index, entries, nil
+	}
+
+	index.Chain = append(append([]string{}, previous.Chain...), previous.Name)
+
+	var changed []tarballEntry
+	for _, entry := range entries {
+		old, ok := previous.Files[entry.name]
+
+		// directories are always stored to keep the tree structure and permissions
+		if entry.info.IsDir() || !ok || old != index.Files[entry.name] {
+			changed = append(changed, entry)
+		}
+	}
+
+	for name := range previous.Files {
+		if _, ok := index.Files[name]; !ok {
+			index.Deleted = append(index.Deleted, name)
+		}
+	}
+
+	log.Trace("Creating an incremental backup on top of %s", previous.Name)
+
+	return index, changed, nil
+}
+
+// loadSnapshot reads the index of the previous backup, returns nil when there isn't any
+func (f *TarballConfig) loadSnapshot() (*snapshotIndex, error) {
+	data, err := ioutil.ReadFile(f.snapshotPath())
+	if os.IsNotExist(err) {
+		log.Info("Snapshot index %s not found", f.snapshotPath())
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read snapshot index: %v", err)
+	}
+
+	var index snapshotIndex
+	if err = json.Unmarshal(data, &index); err != nil {
+		log.Warn("Cannot parse snapshot index %s, %v", f.snapshotPath(), err)
+		return nil, nil
+	}
+
+	return &index, nil
+}
+
+// Commit uploads the index of the last incremental backup next to it and
+// saves it as the snapshot the next backup is compared with
+func (f *TarballConfig) Commit(upload func(filepath string) error) error {
+	index := f.pending
+	if index == nil {
+		return nil
+	}
+
+	f.pending = nil
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("cannot encode snapshot index: %v", err)
+	}
+
+	filepath := path.Join(f.SaveDir, index.Name+".json")
+	if err = ioutil.WriteFile(filepath, data, 0600); err != nil {
+		return fmt.Errorf("cannot write snapshot index: %v", err)
+	}
+
+	// stores remove the uploaded file unless configured to keep it
+	defer os.Remove(filepath)
+
+	if err = upload(filepath); err != nil {
+		return fmt.Errorf("cannot upload snapshot index: %v", err)
+	}
+
+	return f.saveSnapshot(index)
+}
+
+func (f *TarballConfig) saveSnapshot(index *snapshotIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("cannot encode snapshot index: %v", err)
+	}
+
+	if err = os.MkdirAll(f.StateDir, 0700); err != nil {
+		return fmt.Errorf("cannot create state directory: %v", err)
+	}
+
+	// write to a temporary file first so a failure doesn't corrupt the current index
+	tmp := f.snapshotPath() + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write snapshot index: %v", err)
+	}
+
+	if err = os.Rename(tmp, f.snapshotPath()); err != nil {
+		return fmt.Errorf("cannot save snapshot index: %v", err)
+	}
+
+	return nil
+}
+
+func writeSnapshotIndex(tw *tar.Writer, index *snapshotIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("cannot encode snapshot index: %v", err)
+	}
+
+	hdr := &tar.Header{
+		Name:    snapshotIndexName,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+
+	if err = tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("cannot write snapshot index header: %v", err)
+	}
+
+	if _, err = tw.Write(data); err != nil {
+		return fmt.Errorf("cannot write snapshot index: %v", err)
+	}
+
+	return nil
+}
+
+// readSnapshotIndex returns the index stored in a tarball, or nil if it
+// wasn't created as an incremental backup
+func readSnapshotIndex(filepath string) (*snapshotIndex, error) {
+	tr, closer, err := openTarball(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closer()
+
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && hdr.Name != snapshotIndexName) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read tarball: %v", err)
+	}
+
+	var index snapshotIndex
+	if err = json.NewDecoder(tr).Decode(&index); err != nil {
+		return nil, fmt.Errorf("cannot parse snapshot index: %v", err)
+	}
+
+	return &index, nil
+}
+
+// retrieveChain downloads the backups needed to restore an incremental backup
+// and returns them in the order they must be applied
+func (f *TarballConfig) retrieveChain(filepath string, index *snapshotIndex) ([]string, []*snapshotIndex, error) {
+	var files []string
+	var indexes []*snapshotIndex
+
+	if len(index.Chain) > 0 && f.retrieve == nil {
+		return nil, nil, fmt.Errorf("cannot retrieve previous backups of %s", path.Base(filepath))
+	}
+
+	for _, name := range index.Chain {
+		log.Trace("Retrieving previous backup %s", name)
+
+		file, err := f.retrieve(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot download previous backup %s: %v", name, err)
+		}
+
+		previous, err := readSnapshotIndex(file)
+		if err != nil {
+			return nil, nil, err
+		} else if previous == nil {
+			return nil, nil, fmt.Errorf("snapshot index not found on %s", name)
+		}
+
+		files = append(files, file)
+		indexes = append(indexes, previous)
+	}
+
+	return append(files, filepath), append(indexes, index), nil
+}
+
+// applyDeletions removes the files of a source deleted since the previous backup
+func (f *TarballConfig) applyDeletions(source tarballSource, dest string, index *snapshotIndex) error {
+	selected := f.selector(source)
+
+	for _, name := range index.Deleted {
+		if !selected(name) {
+			continue
+		}
+
+		target, err := extractPath(dest, name)
+		if err != nil {
+			return err
+		}
+
+		// a whole source is never deleted, only its contents
+		if target == filepath.Clean(dest) {
+			log.Warn("Skipping deletion of %s, it is the restored directory", name)
+			continue
+		}
+
+		if err = os.RemoveAll(target); err != nil {
+			return fmt.Errorf("cannot remove deleted file %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
@@ -1,53 +1,981 @@
 package services
 
 import (
+	"archive/tar"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/mholt/archiver/v3"
+	log "unknwon.dev/clog/v2"
 )
 
+// ErrDryRun is returned by a backup that only listed its contents
+var ErrDryRun = errors.New("dry run, no backup created")
+
 // TarballConfig has the config options for the TarballConfig service
 type TarballConfig struct {
-	Name     string
-	Path     string
-	Compress bool
-	SaveDir  string
+	Name          string
+	Path          string
+	Paths         []string
+	Compress      bool
+	Compression   Compression
+	SaveDir       string
+	Include       []string
+	Exclude       []string
+	DryRun        bool
+	Incremental   bool
+	FullEvery     int
+	StateDir      string
+	RestoreMode   string
+	RestoreTarget string
+	RestoreOnly   []string
+	RestoreRemap  map[string]string
+	SameOwner     bool
+	NumericOwner  bool
+	Xattrs        bool
+	ACLs          bool
+	retrieve      RetrieveFunc
+	pending       *snapshotIndex
+}
+
+const (
+	// RestoreReplace replaces the directory contents, keeping a rollback copy until the backup is unpacked
+	RestoreReplace = "replace"
+	// RestoreSwap unpacks the backup to a staging directory and swaps it with the restored directory
+	RestoreSwap = "swap"
+	// RestoreMerge unpacks the backup over the directory without deleting anything
+	RestoreMerge = "merge"
+)
+
+var rollbackPrefix = ".dbacker-rollback-"
+
+var stagingSuffix = ".staging-"
+
+// tarballSource is a directory stored under a stable name inside the tarball
+type tarballSource struct {
+	path string
+	name string
+}
+
+// tarballEntry is a file selected to be archived
+type tarballEntry struct {
+	path string
+	name string
+	info os.FileInfo
+}
+
+// SetRetriever sets the function used to download the previous backups of an incremental chain
+func (f *TarballConfig) SetRetriever(retrieve RetrieveFunc) {
+	f.retrieve = retrieve
+}
+
+// sources returns the directories to archive, a single directory keeps its
+// base name inside the tarball, multiple ones are named after their full path
+func (f *TarballConfig) sources() []tarballSource {
+	var paths []string
+	if f.Path != "" {
+		paths = append(paths, f.Path)
+	}
+
+	paths = append(paths, f.Paths...)
+
+	var sources []tarballSource
+	for _, p := range paths {
+		p = filepath.Clean(p)
+
+		name := path.Base(filepath.ToSlash(p))
+		if len(paths) > 1 {
+			name = sourceName(p)
+		}
+
+		sources = append(sources, tarballSource{path: p, name: name})
+	}
+
+	return sources
+}
+
+// sourceName returns a stable name for a path, like etc_app for /etc/app
+func sourceName(p string) string {
+	name := strings.Trim(filepath.ToSlash(p), "/")
+	if name == "" {
+		return "root"
+	}
+
+	return strings.Replace(name, "/", "_", -1)
+}
+
+func (f *TarballConfig) prefix() string {
+	if f.Name != "" {
+		return f.Name
+	}
+
+	if sources := f.sources(); len(sources) > 0 {
+		return path.Base(filepath.ToSlash(sources[0].path))
+	}
+
+	return "tarball"
 }
 
 // Backup creates a tarball of the specified directory
 func (f *TarballConfig) Backup() (string, error) {
-	var name string
-	if f.Name != "" {
-		name = f.Name + "-backup"
-	} else {
-		name = path.Base(f.Path) + "-backup"
+	sources := f.sources()
+	if len(sources) == 0 {
+		return "", fmt.Errorf("no source path to backup")
+	}
+
+	var entries []tarballEntry
+	var paths []string
+
+	for _, source := range sources {
+		list, err := f.listEntries(source)
+		if err != nil {
+			return "", fmt.Errorf("cannot list files of %s: %v", source.path, err)
+		}
+
+		entries = append(entries, list...)
+		paths = append(paths, source.path)
+	}
+
+	var err error
+
+	var index *snapshotIndex
+	if f.Incremental {
+		index, entries, err = f.newSnapshot(sources, entries)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if f.DryRun {
+		for _, entry := range entries {
+			log.Info("Would archive %s", entry.name)
+		}
+
+		if index != nil {
+			for _, name := range index.Deleted {
+				log.Info("Would mark as deleted %s", name)
+			}
+		}
+
+		log.Info("Would archive %d entries from %s", len(entries), strings.Join(paths, ", "))
+
+		return "", ErrDryRun
+	}
+
+	filepath := generateFilename(f.SaveDir, f.prefix()+"-backup")
+
+	if index != nil && !index.Full {
+		filepath += ".incr"
 	}
 
-	filepath := generateFilename(f.SaveDir, name) + ".tar"
+	filepath += ".tar" + f.Compression.resolve(f.Compress).Extension()
 
-	if f.Compress {
-		filepath += ".gz"
+	if index != nil {
+		index.Name = path.Base(filepath)
 	}
 
-	err := archiver.Archive([]string{f.Path}, filepath)
+	err = f.writeTarball(filepath, index, entries)
 	if err != nil {
 		return "", fmt.Errorf("cannot create tarball on %s, %v", filepath, err)
 	}
 
+	// the snapshot is saved by Commit once the backup is stored
+	f.pending = index
+
 	return filepath, nil
 }
 
-// Restore extracts a tarball to the specified directory
+func (f *TarballConfig) newMatchers(source tarballSource) (*pathMatcher, *pathMatcher, error) {
+	include, err := newPathMatcher(f.Include)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exclude, err := newPathMatcher(f.Exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// rules from the ignore file are loaded last so they can negate the configured ones
+	if err = exclude.addFile(filepath.Join(source.path, IgnoreFile)); err != nil {
+		return nil, nil, err
+	}
+
+	return include, exclude, nil
+}
+
+// listEntries walks the source directory and returns the entries that match
+// the include and exclude patterns, parent directories are listed before
+// their contents
+func (f *TarballConfig) listEntries(source tarballSource) ([]tarballEntry, error) {
+	include, exclude, err := f.newMatchers(source)
+	if err != nil {
+		return nil, err
+	}
+
+	root := source.path
+	base := source.name
+
+	var entries []tarballEntry
+	dirs := make(map[string]tarballEntry)
+	added := make(map[string]bool)
+
+	// addParents lists the parent directories of an included file
+	var addParents func(rel string)
+	addParents = func(rel string) {
+		dir := parentDir(rel)
+		if dir == "" || added[dir] {
+			return
+		}
+
+		addParents(dir)
+		entries = append(entries, dirs[dir])
+		added[dir] = true
+	}
+
+	err = filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+
+		entry := tarballEntry{path: fpath, info: info}
+
+		if rel == "." {
+			entry.name = base
+			entries = append(entries, entry)
+			return nil
+		}
+
+		// left by a restore that couldn't clean up, it's a copy of the old contents
+		if info.IsDir() && strings.HasPrefix(info.Name(), rollbackPrefix) {
+			log.Warn("Skipping rollback directory %s, remove it once the restore was checked", fpath)
+			return filepath.SkipDir
+		}
+
+		rel = filepath.ToSlash(rel)
+		entry.name = path.Join(base, rel)
+
+		if exclude.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.IsDir() {
+			dirs[rel] = entry
+
+			if !include.Empty() && !include.MatchTree(rel, true) {
+				return nil
+			}
+		} else if !include.Empty() && !include.MatchTree(rel, false) {
+			return nil
+		}
+
+		addParents(rel)
+		entries = append(entries, entry)
+		added[rel] = true
+
+		return nil
+	})
+
+	return entries, err
+}
+
+// writeTarball creates a tarball containing the snapshot index, when set, and
+// the listed entries. The file is removed when it can't be completely written
+func (f *TarballConfig) writeTarball(filepath string, index *snapshotIndex, entries []tarballEntry) (err error) {
+	file, err := os.Create(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("cannot close file: %v", cerr)
+		}
+
+		if err != nil {
+			os.Remove(filepath)
+		}
+	}()
+
+	out, err := f.Compression.resolve(f.Compress).NewWriter(file)
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	// the index goes first so it can be read without going through the whole archive
+	if index != nil {
+		if err = writeSnapshotIndex(tw, index); err != nil {
+			return err
+		}
+	}
+
+	links := make(map[fileID]string)
+
+	for _, entry := range entries {
+		if err = f.writeTarballEntry(tw, entry, links); err != nil {
+			return fmt.Errorf("%s: %v", entry.path, err)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("cannot close tarball: %v", err)
+	}
+
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("cannot flush compressed tarball: %v", err)
+	}
+
+	return nil
+}
+
+// fileID identifies a file of a source to detect hard links
+type fileID struct {
+	top string
+	dev uint64
+	ino uint64
+}
+
+// writeTarballEntry writes the header and contents of an entry, files already
+// written with another name are stored as hard links
+func (f *TarballConfig) writeTarballEntry(tw *tar.Writer, entry tarballEntry, links map[fileID]string) error {
+	var link string
+
+	if entry.info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(entry.path)
+		if err != nil {
+			return fmt.Errorf("cannot read link: %v", err)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(entry.info, link)
+	if err != nil {
+		return fmt.Errorf("cannot create header: %v", err)
+	}
+
+	hdr.Name = entry.name
+	if entry.info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if f.NumericOwner {
+		hdr.Uname = ""
+		hdr.Gname = ""
+	}
+
+	if stat, ok := entry.info.Sys().(*syscall.Stat_t); ok && hdr.Typeflag == tar.TypeReg && stat.Nlink > 1 {
+		// links are only stored within the same source, each one can be restored elsewhere
+		id := fileID{entryTop(entry.name), uint64(stat.Dev), uint64(stat.Ino)}
+
+		if name, ok := links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = name
+			hdr.Size = 0
+		} else {
+			links[id] = entry.name
+		}
+	}
+
+	if f.Xattrs || f.ACLs {
+		xattrs, err := readXattrs(entry.path, f.Xattrs, f.ACLs)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+
+			hdr.PAXRecords[paxXattrPrefix+name] = value
+		}
+	}
+
+	if err = tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("cannot write header: %v", err)
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %v", err)
+	}
+
+	defer file.Close()
+
+	if _, err = io.Copy(tw, file); err != nil {
+		return fmt.Errorf("cannot copy file contents: %v", err)
+	}
+
+	return nil
+}
+
+// openTarball opens a tarball for reading, decompressing it when needed
+func openTarball(filepath string) (*tar.Reader, func(), error) {
+	reader, err := openDecompressed(filepath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tar.NewReader(reader), func() { reader.Close() }, nil
+}
+
+// extractTarball unpacks the selected entries of a tarball into dest and
+// returns the number of extracted entries, the top level directory of the
+// entries is replaced by dest
+func (f *TarballConfig) extractTarball(filepath string, dest string, selected func(name string) bool) (int, error) {
+	tr, closer, err := openTarball(filepath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer closer()
+
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+
+	// directory times are set at the end, extracting files modifies them
+	var dirs []dirTime
+	count := 0
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, fmt.Errorf("cannot read tarball: %v", err)
+		}
+
+		if hdr.Name == snapshotIndexName {
+			continue
+		}
+
+		if selected != nil && !selected(hdr.Name) {
+			continue
+		}
+
+		target, err := extractPath(dest, hdr.Name)
+		if err != nil {
+			return count, err
+		}
+
+		if err = f.extractTarballEntry(tr, hdr, dest, target); err != nil {
+			return count, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+
+		count++
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{target, hdr.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = lchtimes(dirs[i].path, dirs[i].modTime); err != nil {
+			log.Warn("Cannot set times of %s, %v", dirs[i].path, err)
+		}
+	}
+
+	return count, nil
+}
+
+// extractPath removes the top level directory of an entry name and joins it
+// to dest, names escaping dest are rejected
+func extractPath(dest string, name string) (string, error) {
+	name = entryRel(name)
+
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	if target != filepath.Clean(dest) && !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid entry name %s", name)
+	}
+
+	return target, nil
+}
+
+// entryTop returns the top level directory of an entry
+func entryTop(name string) string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i]
+	}
+
+	return name
+}
+
+// entryRel returns the name of an entry relative to its top level directory
+func entryRel(name string) string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[i+1:]
+	}
+
+	return ""
+}
+
+// extractTarballEntry creates the file described by the header and restores
+// its attributes
+func (f *TarballConfig) extractTarballEntry(tr *tar.Reader, hdr *tar.Header, dest string, target string) error {
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	// replace whatever is on the target unless both are directories
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err = os.RemoveAll(target); err != nil {
+			return fmt.Errorf("cannot remove existing file: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("cannot create parent directory: %v", err)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0700); err != nil {
+			return fmt.Errorf("cannot create directory: %v", err)
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot create file: %v", err)
+		}
+
+		_, err = io.Copy(file, tr)
+		file.Close()
+
+		if err != nil {
+			return fmt.Errorf("cannot write file contents: %v", err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return fmt.Errorf("cannot create symlink: %v", err)
+		}
+	case tar.TypeLink:
+		link, err := extractPath(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+
+		// the attributes are shared with the linked file
+		if err = os.Link(link, target); err != nil {
+			return fmt.Errorf("cannot create hard link: %v", err)
+		}
+
+		return nil
+	default:
+		log.Warn("Skipping unsupported entry %s of type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	// the owner is changed first, chown clears the setuid and setgid bits,
+	// only root can give files away
+	if f.SameOwner && os.Geteuid() == 0 {
+		uid, gid := f.lookupOwner(hdr)
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return fmt.Errorf("cannot change owner: %v", err)
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, mode); err != nil {
+			return fmt.Errorf("cannot change file mode: %v", err)
+		}
+	}
+
+	if f.Xattrs || f.ACLs {
+		for key, value := range hdr.PAXRecords {
+			name := strings.TrimPrefix(key, paxXattrPrefix)
+			if name == key || !xattrSelected(name, f.Xattrs, f.ACLs) {
+				continue
+			}
+
+			if err := writeXattr(target, name, value); err != nil {
+				return fmt.Errorf("cannot set extended attribute %s: %v", name, err)
+			}
+		}
+	}
+
+	// directory times are set after extracting their contents
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	return lchtimes(target, hdr.ModTime)
+}
+
+// lookupOwner returns the owner of an entry, using the local user and group
+// names unless numeric owners are requested
+func (f *TarballConfig) lookupOwner(hdr *tar.Header) (int, int) {
+	uid, gid := hdr.Uid, hdr.Gid
+
+	if f.NumericOwner {
+		return uid, gid
+	}
+
+	if hdr.Uname != "" {
+		if u, err := user.Lookup(hdr.Uname); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+
+	if hdr.Gname != "" {
+		if g, err := user.LookupGroup(hdr.Gname); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+
+	return uid, gid
+}
+
+// Restore extracts a tarball to the specified directories, incremental backups
+// are restored by replaying the chain from the last full backup
 func (f *TarballConfig) Restore(filepath string) error {
-	err := removeDirectoryContents(f.Path)
+	sources := f.sources()
+	if len(sources) == 0 {
+		return fmt.Errorf("no source path to restore")
+	}
+
+	index, err := readSnapshotIndex(filepath)
 	if err != nil {
-		return fmt.Errorf("failed to empty directory contents before restoring: %v", err)
+		return err
+	}
+
+	chain := []string{filepath}
+	var indexes []*snapshotIndex
+
+	if index != nil {
+		chain, indexes, err = f.retrieveChain(filepath, index)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, source := range sources {
+		dest := f.restoreDest(source)
+		log.Trace("Restoring %s to %s", source.name, dest)
+
+		switch f.RestoreMode {
+		case "", RestoreReplace:
+			err = f.restoreReplace(source, dest, chain, indexes)
+		case RestoreSwap:
+			err = f.restoreSwap(source, dest, chain, indexes)
+		case RestoreMerge:
+			var count int
+			count, err = f.unpack(source, dest, chain, indexes)
+			if err == nil && count == 0 {
+				log.Warn("No entries found for %s on the backup", source.name)
+			}
+		default:
+			return fmt.Errorf("unsupported restore mode: %s", f.RestoreMode)
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot restore %s: %v", source.path, err)
+		}
+	}
+
+	return nil
+}
+
+// restoreDest returns the directory where a source is restored
+func (f *TarballConfig) restoreDest(source tarballSource) string {
+	if dest, ok := f.RestoreRemap[source.path]; ok {
+		return dest
+	}
+
+	if f.RestoreTarget == "" {
+		return source.path
+	}
+
+	if len(f.sources()) > 1 {
+		return filepath.Join(f.RestoreTarget, source.name)
+	}
+
+	return f.RestoreTarget
+}
+
+// selected returns true when an entry is part of the restored subpaths
+func (f *TarballConfig) selected(rel string) bool {
+	if len(f.RestoreOnly) == 0 {
+		return true
+	}
+
+	for _, only := range f.RestoreOnly {
+		only = strings.Trim(path.Clean("/"+only), "/")
+		if rel == only || strings.HasPrefix(rel, only+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selector returns a function that selects the entries of a source, a single
+// source accepts any top level directory
+func (f *TarballConfig) selector(source tarballSource) func(name string) bool {
+	single := len(f.sources()) == 1
+
+	return func(name string) bool {
+		if !single && entryTop(name) != source.name {
+			return false
+		}
+
+		return f.selected(entryRel(name))
 	}
+}
+
+// unpack extracts the chain of backups of a source into dest without
+// removing anything but the files deleted between backups
+func (f *TarballConfig) unpack(source tarballSource, dest string, chain []string, indexes []*snapshotIndex) (int, error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, fmt.Errorf("cannot create directory %s: %v", dest, err)
+	}
+
+	total := 0
+
+	for i, file := range chain {
+		log.Trace("Extracting %s to %s", path.Base(file), dest)
 
-	err = archiver.Unarchive(filepath, path.Dir(f.Path))
+		if indexes != nil {
+			if err := f.applyDeletions(source, dest, indexes[i]); err != nil {
+				return total, err
+			}
+		}
+
+		count, err := f.extractTarball(file, dest, f.selector(source))
+		total += count
+
+		if err != nil {
+			return total, fmt.Errorf("cannot unpack backup: %v", err)
+		}
+	}
+
+	return total, nil
+}
+
+// restoreReplace moves the current contents to a rollback directory, which
+// is moved back if the backup can't be unpacked
+func (f *TarballConfig) restoreReplace(source tarballSource, dest string, chain []string, indexes []*snapshotIndex) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("cannot create directory %s: %v", dest, err)
+	}
+
+	rollback, moved, err := f.moveToRollback(dest)
+	if err != nil {
+		if rollback != "" {
+			f.rollback(dest, rollback, moved)
+		}
+
+		return fmt.Errorf("failed to move directory contents before restoring: %v", err)
+	}
+
+	count, err := f.unpack(source, dest, chain, indexes)
+	if err == nil && count == 0 {
+		err = fmt.Errorf("no entries found for %s on the backup", source.name)
+	}
+
+	if err != nil {
+		log.Error("Restore failed, rolling back %s", dest)
+		f.rollback(dest, rollback, moved)
+		return err
+	}
+
+	if err = os.RemoveAll(rollback); err != nil {
+		log.Warn("Cannot remove rollback directory %s, %v", rollback, err)
+	}
+
+	return nil
+}
+
+// moveToRollback moves the selected contents of dest to a new rollback
+// directory and returns it with the moved names. The rollback directory is a
+// sibling of dest, so it's never left inside the restored tree, unless dest
+// is a mount point and the renames would cross filesystems
+func (f *TarballConfig) moveToRollback(dest string) (string, []string, error) {
+	rollback, err := ioutil.TempDir(filepath.Dir(filepath.Clean(dest)), rollbackPrefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot create rollback directory: %v", err)
+	}
+
+	moved, err := f.moveContents(dest, rollback)
+	if len(moved) == 0 && errors.Is(err, syscall.EXDEV) {
+		log.Warn("%s is a mount point, its previous contents are kept inside it during the restore", dest)
+
+		if err = os.RemoveAll(rollback); err != nil {
+			log.Warn("Cannot remove rollback directory %s, %v", rollback, err)
+		}
+
+		if rollback, err = ioutil.TempDir(dest, rollbackPrefix); err != nil {
+			return "", nil, fmt.Errorf("cannot create rollback directory: %v", err)
+		}
+
+		moved, err = f.moveContents(dest, rollback)
+	}
+
+	return rollback, moved, err
+}
+
+// selectedContents returns the relative names of the contents of dest
+// replaced by the restore, the rollback directory is never included
+func (f *TarballConfig) selectedContents(dest string, rollback string) ([]string, error) {
+	var names []string
+
+	if len(f.RestoreOnly) > 0 {
+		for _, only := range f.RestoreOnly {
+			names = append(names, strings.Trim(path.Clean("/"+only), "/"))
+		}
+
+		return names, nil
+	}
+
+	files, err := ioutil.ReadDir(dest)
 	if err != nil {
-		return fmt.Errorf("cannot unpack backup: %v", err)
+		return nil, fmt.Errorf("cannot read files on directory: %v", err)
+	}
+
+	for _, file := range files {
+		if filepath.Join(dest, file.Name()) != rollback {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// moveContents moves the selected contents of dest to the rollback directory
+// and returns the relative names of the moved files
+func (f *TarballConfig) moveContents(dest string, rollback string) ([]string, error) {
+	names, err := f.selectedContents(dest, rollback)
+	if err != nil {
+		return nil, err
+	}
+
+	var moved []string
+	for _, name := range names {
+		src := filepath.Join(dest, filepath.FromSlash(name))
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			continue
+		}
+
+		target := filepath.Join(rollback, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return moved, fmt.Errorf("cannot create directory: %v", err)
+		}
+
+		// wrapped to detect renames across filesystems
+		if err := os.Rename(src, target); err != nil {
+			return moved, fmt.Errorf("cannot move %s: %w", name, err)
+		}
+
+		moved = append(moved, name)
+	}
+
+	return moved, nil
+}
+
+// rollback removes the restored contents of dest, including the files that
+// didn't exist before, and moves back the files moved by moveContents
+func (f *TarballConfig) rollback(dest string, rollback string, moved []string) {
+	names, err := f.selectedContents(dest, rollback)
+	if err != nil {
+		log.Error("Cannot list restored files, the previous contents are kept on %s: %v", rollback, err)
+		return
+	}
+
+	for _, name := range names {
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		if err := os.RemoveAll(target); err != nil {
+			log.Error("Cannot remove restored file %s, the previous contents are kept on %s: %v", target, rollback, err)
+			return
+		}
+	}
+
+	for _, name := range moved {
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		if err := os.Rename(filepath.Join(rollback, filepath.FromSlash(name)), target); err != nil {
+			log.Error("Cannot roll back %s, its previous contents are kept on %s: %v", target, rollback, err)
+			return
+		}
+	}
+
+	if err := os.RemoveAll(rollback); err != nil {
+		log.Warn("Cannot remove rollback directory %s, %v", rollback, err)
+	}
+}
+
+// restoreSwap extracts the backup to a staging directory and swaps it with dest
+func (f *TarballConfig) restoreSwap(source tarballSource, dest string, chain []string, indexes []*snapshotIndex) error {
+	if len(f.RestoreOnly) > 0 {
+		return fmt.Errorf("restoring subpaths is not supported with the %s mode", RestoreSwap)
+	}
+
+	dest = filepath.Clean(dest)
+	parent := filepath.Dir(dest)
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("cannot create directory %s: %v", parent, err)
+	}
+
+	staging, err := ioutil.TempDir(parent, "."+filepath.Base(dest)+stagingSuffix)
+	if err != nil {
+		return fmt.Errorf("cannot create staging directory: %v", err)
+	}
+
+	defer os.RemoveAll(staging)
+
+	count, err := f.unpack(source, staging, chain, indexes)
+	if err != nil {
+		return err
+	} else if count == 0 {
+		return fmt.Errorf("no entries found for %s on the backup", source.name)
+	}
+
+	if _, err = os.Lstat(dest); os.IsNotExist(err) {
+		if err = os.Rename(staging, dest); err != nil {
+			return fmt.Errorf("cannot move staging directory: %v", err)
+		}
+
+		return nil
+	}
+
+	// after the exchange the staging directory has the previous contents
+	if err = exchangePaths(staging, dest); err != nil {
+		return fmt.Errorf("cannot swap staging directory: %v", err)
 	}
 
 	return nil
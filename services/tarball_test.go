@@ -1,10 +1,14 @@
 package services
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -41,4 +45,523 @@ func TestBackupRestore(t *testing.T) {
 	actual, err := ioutil.ReadFile(filepath)
 	r.NoError(err, "failed to read restored file")
 	r.Equal(expected, actual, "backup contents mismatch")
+
+	// a file removed after being listed fails the backup, no partial tarball is left
+	info, err := os.Stat(filepath)
+	r.NoError(err, "failed to read file info")
+	r.NoError(os.Remove(filepath), "failed to remove file")
+
+	partial := path.Join(tmp, "partial.tar")
+	err = tar.writeTarball(partial, nil, []tarballEntry{{path: filepath, name: "test.txt", info: info}})
+	r.Error(err, "missing files must fail the backup")
+
+	_, err = os.Stat(partial)
+	r.True(os.IsNotExist(err), "the partial tarball must be removed")
+}
+
+func TestBackupFilter(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	backupDir := path.Join(tmp, "backup")
+	files := map[string]string{
+		"app/main.conf":             "conf",
+		"app/cache/data.bin":        "cache",
+		"app/node_modules/index.js": "js",
+		"app/yarn.lock":             "lock",
+		"uploads/image.png":         "png",
+		IgnoreFile:                  "*.lock\n",
+	}
+
+	for name, contents := range files {
+		filepath := path.Join(backupDir, name)
+		err = os.MkdirAll(path.Dir(filepath), 0755)
+		r.NoError(err, "failed to create backup directory")
+
+		err = ioutil.WriteFile(filepath, []byte(contents), 0644)
+		r.NoError(err, "failed to create backup file")
+	}
+
+	tar := TarballConfig{
+		Path:    backupDir,
+		Exclude: []string{"cache/", "node_modules/"},
+		Include: []string{"app/"},
+		SaveDir: tmp,
+	}
+
+	entries, err := tar.listEntries(tar.sources()[0])
+	r.NoError(err, "failed to list entries")
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+
+	r.Equal([]string{"backup", "backup/app", "backup/app/main.conf"}, names)
+
+	tar.DryRun = true
+	_, err = tar.Backup()
+	r.Equal(ErrDryRun, err)
+}
+
+func TestIncrementalBackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	backupDir := path.Join(tmp, "backup")
+	err = os.Mkdir(backupDir, 0755)
+	r.NoError(err, "failed to create backup directory")
+
+	write := func(name string, contents string) {
+		err := ioutil.WriteFile(path.Join(backupDir, name), []byte(contents), 0644)
+		r.NoError(err, "failed to create backup file")
+	}
+
+	write("unchanged.txt", "unchanged")
+	write("changed.txt", "old")
+	write("deleted.txt", "deleted")
+
+	tar := TarballConfig{
+		Path:        backupDir,
+		Name:        "test",
+		Compress:    true,
+		SaveDir:     tmp,
+		Incremental: true,
+		FullEvery:   3,
+		StateDir:    path.Join(tmp, "state"),
+	}
+
+	full, err := tar.Backup()
+	r.NoError(err, "failed to create full backup")
+	r.NotContains(full, ".incr.")
+
+	_, err = os.Stat(tar.snapshotPath())
+	r.True(os.IsNotExist(err), "the snapshot must be saved once the backup is stored")
+
+	err = tar.Commit(func(filepath string) error {
+		return fmt.Errorf("upload failed")
+	})
+	r.Error(err, "failed index uploads must fail")
+
+	_, err = os.Stat(tar.snapshotPath())
+	r.True(os.IsNotExist(err), "the snapshot must not be saved when the index upload fails")
+
+	// the next backup starts over when the previous one wasn't committed
+	full, err = tar.Backup()
+	r.NoError(err, "failed to create full backup")
+	r.NotContains(full, ".incr.")
+
+	var uploaded *snapshotIndex
+	err = tar.Commit(func(filepath string) error {
+		data, err := ioutil.ReadFile(filepath)
+		if err == nil {
+			err = json.Unmarshal(data, &uploaded)
+		}
+		return err
+	})
+	r.NoError(err, "failed to commit full backup")
+	r.Equal(path.Base(full), uploaded.Name, "the index of the backup must be uploaded")
+
+	// make sure the timestamp of the next backup is different
+	time.Sleep(time.Second)
+
+	write("changed.txt", "new contents")
+	write("added.txt", "added")
+	err = os.Remove(path.Join(backupDir, "deleted.txt"))
+	r.NoError(err, "failed to remove backup file")
+
+	incr, err := tar.Backup()
+	r.NoError(err, "failed to create incremental backup")
+	r.Contains(incr, ".incr.")
+	r.NoError(tar.Commit(func(string) error { return nil }), "failed to commit incremental backup")
+
+	index, err := readSnapshotIndex(incr)
+	r.NoError(err, "failed to read snapshot index")
+	r.Equal([]string{path.Base(full)}, index.Chain)
+	r.Equal([]string{"backup/deleted.txt"}, index.Deleted)
+
+	tar.SetRetriever(func(name string) (string, error) {
+		return path.Join(tmp, name), nil
+	})
+
+	err = tar.Restore(incr)
+	r.NoError(err, "failed to restore incremental backup")
+
+	for name, expected := range map[string]string{
+		"unchanged.txt": "unchanged",
+		"changed.txt":   "new contents",
+		"added.txt":     "added",
+	} {
+		actual, err := ioutil.ReadFile(path.Join(backupDir, name))
+		r.NoError(err, "failed to read restored file")
+		r.Equal(expected, string(actual), "backup contents mismatch")
+	}
+
+	_, err = os.Stat(path.Join(backupDir, "deleted.txt"))
+	r.True(os.IsNotExist(err), "deleted file was restored")
+}
+
+func TestRestoreModes(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	backupDir := path.Join(tmp, "backup")
+	err = os.MkdirAll(path.Join(backupDir, "sub"), 0755)
+	r.NoError(err, "failed to create backup directory")
+
+	write := func(name string, contents string) {
+		err := ioutil.WriteFile(path.Join(backupDir, name), []byte(contents), 0644)
+		r.NoError(err, "failed to create backup file")
+	}
+
+	read := func(dir string, name string) string {
+		actual, err := ioutil.ReadFile(path.Join(dir, name))
+		r.NoError(err, "failed to read restored file")
+		return string(actual)
+	}
+
+	write("a.txt", "a")
+	write("sub/b.txt", "b")
+
+	tar := TarballConfig{
+		Path:    backupDir,
+		Name:    "test",
+		SaveDir: tmp,
+	}
+
+	tarball, err := tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	write("a.txt", "changed")
+	write("sub/b.txt", "changed")
+	write("new.txt", "new")
+
+	// merge keeps the files that are not in the backup
+	tar.RestoreMode = RestoreMerge
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to merge backup")
+	r.Equal("a", read(backupDir, "a.txt"))
+	r.Equal("new", read(backupDir, "new.txt"))
+
+	// only the selected subpaths are replaced
+	write("sub/b.txt", "changed")
+	tar.RestoreMode = RestoreReplace
+	tar.RestoreOnly = []string{"sub"}
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore subpath")
+	r.Equal("b", read(backupDir, "sub/b.txt"))
+	r.Equal("new", read(backupDir, "new.txt"))
+
+	// swap replaces the whole directory
+	tar.RestoreMode = RestoreSwap
+	tar.RestoreOnly = nil
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to swap backup")
+	r.Equal("a", read(backupDir, "a.txt"))
+	_, err = os.Stat(path.Join(backupDir, "new.txt"))
+	r.True(os.IsNotExist(err), "swap kept a file that is not in the backup")
+
+	// alternate target
+	target := path.Join(tmp, "target")
+	tar.RestoreMode = RestoreReplace
+	tar.RestoreTarget = target
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore to target")
+	r.Equal("b", read(target, "sub/b.txt"))
+
+	// a truncated tarball leaves the previous contents in place
+	data, err := ioutil.ReadFile(tarball)
+	r.NoError(err, "failed to read backup tarball")
+
+	corrupt := path.Join(tmp, "corrupt.tar")
+	err = ioutil.WriteFile(corrupt, data[:1000], 0644)
+	r.NoError(err, "failed to create corrupt tarball")
+
+	tar.RestoreTarget = ""
+	write("a.txt", "live")
+	err = tar.Restore(corrupt)
+	r.Error(err, "corrupt tarball was restored")
+	r.Equal("live", read(backupDir, "a.txt"))
+
+	for _, dir := range []string{backupDir, tmp} {
+		files, err := ioutil.ReadDir(dir)
+		r.NoError(err, "failed to list directory")
+		for _, file := range files {
+			r.NotContains(file.Name(), rollbackPrefix, "rollback directory was not removed")
+		}
+	}
+
+	// rollback directories left by an interrupted restore aren't archived
+	stale := path.Join(backupDir, rollbackPrefix+"stale")
+	r.NoError(os.Mkdir(stale, 0700), "failed to create rollback directory")
+	r.NoError(ioutil.WriteFile(path.Join(stale, "a.txt"), []byte("old"), 0644), "failed to create rollback file")
+
+	entries, err := tar.listEntries(tar.sources()[0])
+	r.NoError(err, "failed to list entries")
+	for _, entry := range entries {
+		r.NotContains(entry.name, rollbackPrefix, "rollback directory was archived")
+	}
+
+	r.NoError(os.RemoveAll(stale), "failed to remove rollback directory")
+
+	// files extracted before a failure are removed by the rollback
+	rollback, err := ioutil.TempDir(backupDir, rollbackPrefix)
+	r.NoError(err, "failed to create rollback directory")
+
+	moved, err := tar.moveContents(backupDir, rollback)
+	r.NoError(err, "failed to move directory contents")
+
+	write("a.txt", "extracted")
+	write("extracted.txt", "extracted")
+	tar.rollback(backupDir, rollback, moved)
+
+	r.Equal("live", read(backupDir, "a.txt"))
+	_, err = os.Stat(path.Join(backupDir, "extracted.txt"))
+	r.True(os.IsNotExist(err), "rollback kept a file created by the restore")
+	_, err = os.Stat(rollback)
+	r.True(os.IsNotExist(err), "rollback directory was not removed")
+}
+
+func TestPreserveAttributes(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	backupDir := path.Join(tmp, "backup")
+	err = os.Mkdir(backupDir, 0750)
+	r.NoError(err, "failed to create backup directory")
+
+	filepath := path.Join(backupDir, "file.txt")
+	err = ioutil.WriteFile(filepath, []byte("test"), 0600)
+	r.NoError(err, "failed to create backup file")
+
+	err = os.Chmod(filepath, 0640|os.ModeSetgid)
+	r.NoError(err, "failed to change file mode")
+
+	err = os.Link(filepath, path.Join(backupDir, "hardlink.txt"))
+	r.NoError(err, "failed to create hard link")
+
+	err = os.Symlink("file.txt", path.Join(backupDir, "symlink.txt"))
+	r.NoError(err, "failed to create symlink")
+
+	root := os.Geteuid() == 0
+	if root {
+		err = os.Lchown(filepath, 1234, 5678)
+		r.NoError(err, "failed to change file owner")
+	}
+
+	// 0x0002 version, user_obj rw, user 1234 r, group_obj r, mask r, other none
+	acl := []byte{
+		0x02, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x06, 0x00, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0x00, 0x04, 0x00, 0xd2, 0x04, 0x00, 0x00,
+		0x04, 0x00, 0x04, 0x00, 0xff, 0xff, 0xff, 0xff,
+		0x10, 0x00, 0x04, 0x00, 0xff, 0xff, 0xff, 0xff,
+		0x20, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff,
+	}
+
+	xattrs := map[string]string{}
+	if writeXattr(filepath, "user.dbacker", "test") == nil {
+		xattrs["user.dbacker"] = "test"
+	}
+
+	if writeXattr(filepath, "system.posix_acl_access", string(acl)) == nil {
+		current, err := readXattrs(filepath, false, true)
+		r.NoError(err, "failed to read ACLs")
+		for name, value := range current {
+			xattrs[name] = value
+		}
+	}
+
+	modTime := time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC)
+	err = lchtimes(filepath, modTime)
+	r.NoError(err, "failed to change file times")
+
+	expected, err := readXattrs(filepath, true, true)
+	r.NoError(err, "failed to read extended attributes")
+
+	tar := TarballConfig{
+		Path:          backupDir,
+		Name:          "test",
+		SaveDir:       tmp,
+		SameOwner:     true,
+		NumericOwner:  true,
+		Xattrs:        true,
+		ACLs:          true,
+		RestoreTarget: path.Join(tmp, "restored"),
+	}
+
+	tarball, err := tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore backup dir")
+
+	restored := path.Join(tar.RestoreTarget, "file.txt")
+	info, err := os.Lstat(restored)
+	r.NoError(err, "failed to stat restored file")
+	r.Equal(0640|os.ModeSetgid, info.Mode(), "file mode mismatch")
+	r.True(modTime.Equal(info.ModTime()), "modification time mismatch")
+
+	dirInfo, err := os.Stat(tar.RestoreTarget)
+	r.NoError(err, "failed to stat restored directory")
+	r.Equal(os.FileMode(0750), dirInfo.Mode().Perm(), "directory mode mismatch")
+
+	stat := info.Sys().(*syscall.Stat_t)
+	if root {
+		r.Equal(uint32(1234), stat.Uid, "file owner mismatch")
+		r.Equal(uint32(5678), stat.Gid, "file group mismatch")
+	}
+
+	linkInfo, err := os.Lstat(path.Join(tar.RestoreTarget, "hardlink.txt"))
+	r.NoError(err, "failed to stat restored hard link")
+	r.True(os.SameFile(info, linkInfo), "hard link was not restored")
+
+	target, err := os.Readlink(path.Join(tar.RestoreTarget, "symlink.txt"))
+	r.NoError(err, "failed to read restored symlink")
+	r.Equal("file.txt", target)
+
+	actual, err := readXattrs(restored, true, true)
+	r.NoError(err, "failed to read restored extended attributes")
+	r.Equal(expected, actual, "extended attributes mismatch")
+	for name := range xattrs {
+		r.Contains(actual, name)
+	}
+}
+
+func TestMultipleSources(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	first := path.Join(tmp, "etc", "app")
+	second := path.Join(tmp, "opt", "app")
+
+	for _, dir := range []string{first, second} {
+		err = os.MkdirAll(dir, 0755)
+		r.NoError(err, "failed to create backup directory")
+
+		err = ioutil.WriteFile(path.Join(dir, "test.txt"), []byte(dir), 0644)
+		r.NoError(err, "failed to create backup file")
+	}
+
+	tar := TarballConfig{
+		Path:    first,
+		Paths:   []string{second},
+		Name:    "test",
+		SaveDir: tmp,
+	}
+
+	sources := tar.sources()
+	r.Len(sources, 2)
+	r.NotEqual(sources[0].name, sources[1].name, "source names must be unique")
+
+	tarball, err := tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	for _, dir := range []string{first, second} {
+		err = ioutil.WriteFile(path.Join(dir, "test.txt"), []byte("changed"), 0644)
+		r.NoError(err, "failed to change backup file")
+	}
+
+	remapped := path.Join(tmp, "remapped")
+	tar.RestoreRemap = map[string]string{second: remapped}
+
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore backup")
+
+	actual, err := ioutil.ReadFile(path.Join(first, "test.txt"))
+	r.NoError(err, "failed to read restored file")
+	r.Equal(first, string(actual), "backup contents mismatch")
+
+	actual, err = ioutil.ReadFile(path.Join(remapped, "test.txt"))
+	r.NoError(err, "failed to read remapped file")
+	r.Equal(second, string(actual), "remapped contents mismatch")
+
+	actual, err = ioutil.ReadFile(path.Join(second, "test.txt"))
+	r.NoError(err, "failed to read original file")
+	r.Equal("changed", string(actual), "remapped source was overwritten")
+
+	// a source missing from the backup is left untouched
+	other := path.Join(tmp, "other")
+	err = os.Mkdir(other, 0755)
+	r.NoError(err, "failed to create directory")
+
+	err = ioutil.WriteFile(path.Join(other, "keep.txt"), []byte("keep"), 0644)
+	r.NoError(err, "failed to create file")
+
+	tar.Paths = []string{second, other}
+	err = tar.Restore(tarball)
+	r.Error(err, "restored a source missing from the backup")
+
+	_, err = os.Stat(path.Join(other, "keep.txt"))
+	r.NoError(err, "source missing from the backup was emptied")
+}
+
+func TestIncrementalSourcesChange(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	first := path.Join(tmp, "etc", "app")
+	second := path.Join(tmp, "opt", "app")
+
+	for _, dir := range []string{first, second} {
+		err = os.MkdirAll(dir, 0755)
+		r.NoError(err, "failed to create backup directory")
+
+		err = ioutil.WriteFile(path.Join(dir, "test.txt"), []byte(dir), 0644)
+		r.NoError(err, "failed to create backup file")
+	}
+
+	tar := TarballConfig{
+		Path:        first,
+		Paths:       []string{second},
+		Name:        "test",
+		SaveDir:     tmp,
+		Incremental: true,
+		FullEvery:   3,
+		StateDir:    path.Join(tmp, "state"),
+	}
+
+	_, err = tar.Backup()
+	r.NoError(err, "failed to create full backup")
+	r.NoError(tar.Commit(func(string) error { return nil }), "failed to commit full backup")
+
+	// make sure the timestamp of the next backup is different
+	time.Sleep(time.Second)
+
+	// removing a source changes the names of the entries of the other one
+	tar.Paths = nil
+
+	backup, err := tar.Backup()
+	r.NoError(err, "failed to create backup")
+	r.NotContains(backup, ".incr.", "a backup of different sources must be full")
+
+	index, err := readSnapshotIndex(backup)
+	r.NoError(err, "failed to read snapshot index")
+	r.True(index.Full)
+	r.Empty(index.Deleted)
+
+	// a deleted entry naming a whole source never removes the restored directory
+	err = tar.applyDeletions(tar.sources()[0], first, &snapshotIndex{Deleted: []string{"app"}})
+	r.NoError(err, "failed to apply deletions")
+
+	_, err = os.Stat(path.Join(first, "test.txt"))
+	r.NoError(err, "the restored directory was removed")
 }
@@ -0,0 +1,584 @@
+package stores
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// AzureConfig has the config options of the Azure Blob Storage store. Files
+// bigger than BlockSize are uploaded as a list of blocks, AccessTier is Hot,
+// Cool or Archive. Endpoint is only needed for Azurite or sovereign clouds
+type AzureConfig struct {
+	Endpoint        string
+	Container       string
+	Prefix          string
+	KeepAfterUpload bool
+	SaveDir         string
+	Credentials     AzureCredentials
+	BlockSize       int64
+	AccessTier      string
+	client          *http.Client
+	retrievedFiles  []string
+}
+
+// DefaultAzureBlockSize is the block size used when none is configured
+var DefaultAzureBlockSize int64 = 4 << 20
+
+// azureMaxBlocks is the maximum number of blocks of a blob
+var azureMaxBlocks int64 = 50000
+
+// azureAccessTiers maps the lower case tiers to their names
+var azureAccessTiers = map[string]string{
+	"hot":     "Hot",
+	"cool":    "Cool",
+	"archive": "Archive",
+}
+
+// azureBlob is a blob of a container listing
+type azureBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ETag          string `xml:"Etag"`
+		ContentLength int64  `xml:"Content-Length"`
+	} `xml:"Properties"`
+}
+
+// azureBlobList is a page of a container listing
+type azureBlobList struct {
+	Blobs      []azureBlob `xml:"Blobs>Blob"`
+	NextMarker string      `xml:"NextMarker"`
+}
+
+func (a *AzureConfig) root() string {
+	root := path.Clean(a.Prefix)
+	if root == "." || root == "/" {
+		return ""
+	}
+
+	return root + "/"
+}
+
+// blockSize returns the block size of a file, big enough to upload it in
+// less than the maximum number of blocks
+func (a *AzureConfig) blockSize(size int64) int64 {
+	blockSize := a.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultAzureBlockSize
+	}
+
+	if size/blockSize >= azureMaxBlocks {
+		blockSize = size/(azureMaxBlocks-1) + 1
+		blockSize = (blockSize + partSizeAlignment - 1) / partSizeAlignment * partSizeAlignment
+	}
+
+	return blockSize
+}
+
+func (a *AzureConfig) accessTier() (string, error) {
+	if a.AccessTier == "" {
+		return "", nil
+	}
+
+	tier, ok := azureAccessTiers[strings.ToLower(a.AccessTier)]
+	if !ok {
+		return "", fmt.Errorf("unsupported access tier: %s", a.AccessTier)
+	}
+
+	return tier, nil
+}
+
+// blobURL returns the URL of a blob, or of the container if name is empty
+func (a *AzureConfig) blobURL(name string) (string, error) {
+	_, endpoint, err := a.Credentials.resolve(a.Endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	if endpoint == "" {
+		if a.Credentials.AccountName == "" {
+			return "", fmt.Errorf("an endpoint or account name is required")
+		}
+
+		endpoint = "https://" + a.Credentials.AccountName + ".blob.core.windows.net"
+	}
+
+	blobURL := strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(a.Container)
+	if name == "" {
+		return blobURL, nil
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+
+	return blobURL + "/" + strings.Join(segments, "/"), nil
+}
+
+// do sends an authorized request, responses other than 2xx are returned as errors
+func (a *AzureConfig) do(method string, name string, query url.Values, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	blobURL, err := a.blobURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(query) > 0 {
+		blobURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, blobURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = length
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	creds, _, err := a.Credentials.resolve(a.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = creds.authorize(req); err != nil {
+		return nil, err
+	}
+
+	if a.client == nil {
+		a.client = &http.Client{}
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, azureError(res)
+	}
+
+	return res, nil
+}
+
+// azureError returns the error message of a failed response
+func azureError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(res.Body)
+
+	var message struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	if xml.Unmarshal(body, &message) == nil && message.Code != "" {
+		return fmt.Errorf("%s: %s, %s", res.Status, message.Code, strings.TrimSpace(message.Message))
+	}
+
+	return fmt.Errorf("%s", res.Status)
+}
+
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Store uploads a file as a block blob
+func (a *AzureConfig) Store(filepath string, filename string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	if !a.KeepAfterUpload {
+		defer func() {
+			if err := os.Remove(filepath); err != nil {
+				log.Warn("Cannot remove file %s", filepath)
+			}
+		}()
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
+
+	tier, err := a.accessTier()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(checksumMD5, f)
+	if err != nil {
+		return fmt.Errorf("cannot compute checksum, %v", err)
+	}
+
+	sum, _ := hex.DecodeString(strings.TrimPrefix(checksum, checksumMD5+":"))
+
+	contentType := mime.TypeByExtension(path.Ext(filename))
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	// the MD5 of the whole file is saved with the blob to verify downloads
+	header := http.Header{}
+	header.Set("x-ms-blob-content-type", contentType)
+	header.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(sum))
+	if tier != "" {
+		header.Set("x-ms-access-tier", tier)
+	}
+
+	name := a.root() + filename
+	blockSize := a.blockSize(info.Size())
+
+	if info.Size() <= blockSize {
+		err = a.putBlob(name, f, info.Size(), header)
+	} else {
+		err = a.putBlocks(name, f, info.Size(), blockSize, header)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to upload file, %v", err)
+	}
+
+	size, md5sum, _, err := a.properties(name)
+	if err != nil {
+		return fmt.Errorf("failed to verify upload, %v", err)
+	}
+
+	if size != info.Size() || md5sum != checksum {
+		return fmt.Errorf("uploaded blob has %d bytes and checksum %s, expected %d and %s", size, md5sum, info.Size(), checksum)
+	}
+
+	log.Trace("File uploaded to %s/%s", a.Container, name)
+
+	return nil
+}
+
+// putBlob uploads a file with a single request
+func (a *AzureConfig) putBlob(name string, f *os.File, size int64, header http.Header) error {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("cannot read file, %v", err)
+	}
+
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-MD5", contentMD5(data))
+
+	res, err := a.do(http.MethodPut, name, nil, bytes.NewReader(data), size, header)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	return nil
+}
+
+// putBlocks uploads a file block by block and commits the list of blocks
+func (a *AzureConfig) putBlocks(name string, f *os.File, size int64, blockSize int64, header http.Header) error {
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+
+	buf := make([]byte, blockSize)
+
+	for number := int64(0); number*blockSize < size; number++ {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("cannot read file, %v", err)
+		}
+
+		// the ids of a blob must have the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", number)))
+
+		blockHeader := http.Header{}
+		blockHeader.Set("Content-MD5", contentMD5(buf[:n]))
+
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+
+		res, err := a.do(http.MethodPut, name, query, bytes.NewReader(buf[:n]), int64(n), blockHeader)
+		if err != nil {
+			return fmt.Errorf("cannot upload block %d, %v", number, err)
+		}
+
+		res.Body.Close()
+
+		fmt.Fprintf(&list, "<Latest>%s</Latest>", id)
+	}
+
+	list.WriteString("</BlockList>")
+
+	res, err := a.do(http.MethodPut, name, url.Values{"comp": {"blocklist"}}, bytes.NewReader(list.Bytes()), int64(list.Len()), header)
+	if err != nil {
+		return fmt.Errorf("cannot commit blocks, %v", err)
+	}
+
+	res.Body.Close()
+
+	return nil
+}
+
+// properties returns the size, checksum and access tier of a blob
+func (a *AzureConfig) properties(name string) (int64, string, string, error) {
+	res, err := a.do(http.MethodHead, name, nil, nil, 0, nil)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("failed to read blob %s, %v", name, err)
+	}
+
+	res.Body.Close()
+
+	size := res.ContentLength
+
+	checksum := ""
+	if sum, err := base64.StdEncoding.DecodeString(res.Header.Get("Content-MD5")); err == nil && len(sum) > 0 {
+		checksum = checksumMD5 + ":" + hex.EncodeToString(sum)
+	}
+
+	return size, checksum, res.Header.Get("x-ms-access-tier"), nil
+}
+
+// openBlob returns the size, checksum and a reader of the contents of a blob
+func (a *AzureConfig) openBlob(name string) (int64, string, io.ReadCloser, error) {
+	size, checksum, tier, err := a.properties(name)
+	if err != nil {
+		return 0, "", nil, err
+	}
+
+	if tier == "Archive" {
+		return 0, "", nil, fmt.Errorf("blob %s is archived, it must be rehydrated before restoring it", name)
+	}
+
+	res, err := a.do(http.MethodGet, name, nil, nil, 0, nil)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to download blob %s, %v", name, err)
+	}
+
+	return size, checksum, res.Body, nil
+}
+
+// Retrieve downloads a blob to the local filesystem
+func (a *AzureConfig) Retrieve(name string) (string, error) {
+	size, _, _, err := a.properties(name)
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkFreeSpace(a.SaveDir, size); err != nil {
+		return "", err
+	}
+
+	filepath, err := downloadFile(a.SaveDir, path.Base(name), func(f *os.File) error {
+		size, checksum, body, err := a.openBlob(name)
+		if err != nil {
+			return err
+		}
+
+		defer body.Close()
+
+		if _, err = io.Copy(f, body); err != nil {
+			return fmt.Errorf("failed to download blob %s, %v", name, err)
+		}
+
+		if err = verifyDownload(f, size, checksum); err != nil {
+			return fmt.Errorf("blob %s is corrupted, %v", name, err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Trace("File downloaded to %s", filepath)
+	a.retrievedFiles = append(a.retrievedFiles, filepath)
+
+	return filepath, nil
+}
+
+// Stream returns a reader of a blob, its size and checksum are verified when
+// the end of the blob is read
+func (a *AzureConfig) Stream(name string) (io.ReadCloser, error) {
+	size, checksum, body, err := a.openBlob(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVerifyingReader(body, name, size, checksum)
+}
+
+// listObjects returns the blobs under a prefix of the container
+func (a *AzureConfig) listObjects(prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+	marker := ""
+
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		res, err := a.do(http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list blobs, %v", err)
+		}
+
+		var page azureBlobList
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse blob list, %v", err)
+		}
+
+		for _, blob := range page.Blobs {
+			modified, _ := time.Parse(time.RFC1123, blob.Properties.LastModified)
+
+			objects = append(objects, remoteObject{
+				Key:          blob.Name,
+				LastModified: modified,
+				Size:         blob.Properties.ContentLength,
+				ETag:         blob.Properties.ETag,
+			})
+		}
+
+		if page.NextMarker == "" {
+			return objects, nil
+		}
+
+		marker = page.NextMarker
+	}
+}
+
+func (a *AzureConfig) deleteBlob(name string) error {
+	header := http.Header{}
+	header.Set("x-ms-delete-snapshots", "include")
+
+	res, err := a.do(http.MethodDelete, name, nil, nil, 0, header)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	return nil
+}
+
+// RemoveOlderBackups keeps the most recent backups of the container and deletes the old ones
+// along with the binlogs they don't need
+func (a *AzureConfig) RemoveOlderBackups(keep int) error {
+	objects, err := a.listObjects(a.root())
+	if err != nil {
+		return err
+	}
+
+	binlogs, err := a.listObjects(a.root() + BinlogDir + "/")
+	if err != nil {
+		return err
+	}
+
+	objects, indexes := splitIndexes(withoutBinlogs(a.root(), objects))
+	sortBackups(objects)
+
+	count := len(objects) - keep
+	if count < 0 {
+		count = 0
+	}
+
+	var keys []string
+	for _, obj := range objects[:count] {
+		keys = append(keys, obj.Key)
+	}
+
+	keys = append(withIndexes(keys, indexes), expiredBinlogs(binlogs, objects[count:])...)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var failed []string
+	for _, key := range keys {
+		log.Trace("Deleting %s/%s", a.Container, key)
+
+		if err = a.deleteBlob(key); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	log.Trace("Deleted %d blobs from Azure", len(keys)-len(failed))
+
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't delete %d blobs, %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the container
+func (a *AzureConfig) FindLatestBackup() (string, error) {
+	objects, err := a.listObjects(a.root())
+	if err != nil {
+		return "", err
+	}
+
+	objects, _ = splitIndexes(withoutBinlogs(a.root(), objects))
+	if len(objects) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on container %s/%s", a.Container, a.Prefix)
+	}
+
+	sortBackups(objects)
+
+	return objects[len(objects)-1].Key, nil
+}
+
+// List returns the blobs under a prefix of the store
+func (a *AzureConfig) List(prefix string) ([]string, error) {
+	root := a.root()
+
+	objects, err := a.listObjects(root + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, obj := range objects {
+		files = append(files, strings.TrimPrefix(obj.Key, root))
+	}
+
+	return files, nil
+}
+
+// Remove deletes a blob of the store
+func (a *AzureConfig) Remove(filename string) error {
+	if err := a.deleteBlob(a.root() + filename); err != nil {
+		return fmt.Errorf("couldn't delete the blob %s, %v", filename, err)
+	}
+
+	return nil
+}
+
+// Close removes the downloaded files
+func (a *AzureConfig) Close() {
+	for _, file := range a.retrievedFiles {
+		removeDownloaded(file)
+	}
+
+	a.retrievedFiles = nil
+}
@@ -0,0 +1,153 @@
+package stores
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureCredentials(t *testing.T) {
+	r := require.New(t)
+
+	creds := AzureCredentials{ConnectionString: "DefaultEndpointsProtocol=https;AccountName=backups;AccountKey=a2V5;EndpointSuffix=core.chinacloudapi.cn"}
+	resolved, endpoint, err := creds.resolve("")
+	r.NoError(err, "failed to parse connection string")
+	r.Equal("backups", resolved.AccountName)
+	r.Equal("a2V5", resolved.AccountKey)
+	r.Equal("https://backups.blob.core.chinacloudapi.cn", endpoint)
+
+	creds = AzureCredentials{ConnectionString: "BlobEndpoint=https://backups.blob.core.windows.net/;SharedAccessSignature=sv=2019-12-12&sig=abc"}
+	resolved, endpoint, err = creds.resolve("")
+	r.NoError(err, "failed to parse connection string")
+	r.Equal("sv=2019-12-12&sig=abc", resolved.SASToken)
+	r.Equal("https://backups.blob.core.windows.net/", endpoint)
+
+	creds = AzureCredentials{ConnectionString: "UseDevelopmentStorage=true"}
+	resolved, endpoint, err = creds.resolve("")
+	r.NoError(err, "failed to parse connection string")
+	r.Equal(azureDevelopmentAccount, resolved.AccountName)
+	r.Equal(azureDevelopmentEndpoint, endpoint)
+
+	creds = AzureCredentials{ConnectionString: "invalid"}
+	_, _, err = creds.resolve("")
+	r.Error(err, "invalid connection strings must fail")
+}
+
+func TestAzureStoreRetrieve(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "azure")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeAzure("backups")
+	defer server.Close()
+
+	a := &AzureConfig{
+		Endpoint:    server.endpoint(),
+		Container:   "backups",
+		Prefix:      "mysql",
+		SaveDir:     tmp,
+		Credentials: AzureCredentials{AccountName: server.account, AccountKey: server.key},
+		AccessTier:  "cool",
+	}
+
+	for _, name := range []string{"mysql-backup-20200101000000.sql", "mysql-backup-20200102000000.sql", "mysql-backup-20200103000000.sql"} {
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(a.Store(filepath, name), "failed to store file")
+	}
+
+	r.Equal("Cool", server.object("mysql/mysql-backup-20200101000000.sql").header.Get("x-ms-access-tier"))
+	r.Equal(0, server.blockPuts, "small files must be uploaded with a single request")
+
+	latest, err := a.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("mysql/mysql-backup-20200103000000.sql", latest)
+
+	retrieved, err := a.Retrieve(latest)
+	r.NoError(err, "failed to retrieve file")
+
+	data, err := ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read retrieved file")
+	r.Equal([]byte("mysql-backup-20200103000000.sql"), data)
+
+	a.Close()
+	r.Empty(retrievedDirs(t, tmp), "the retrieved files must be removed")
+
+	r.NoError(a.RemoveOlderBackups(1), "failed to remove backups")
+
+	files, err := a.List("")
+	r.NoError(err, "failed to list blobs")
+	r.Equal([]string{"mysql-backup-20200103000000.sql"}, files)
+
+	server.object(latest).data = []byte("corrupted")
+
+	_, err = a.Retrieve(latest)
+	r.Error(err, "corrupted blobs must fail")
+	r.Empty(retrievedDirs(t, tmp), "nothing must be left on failure")
+
+	server.object(latest).header.Set("x-ms-access-tier", "Archive")
+	_, err = a.Retrieve(latest)
+	r.Error(err, "archived blobs must fail")
+
+	r.NoError(a.Remove("mysql-backup-20200103000000.sql"), "failed to remove blob")
+	r.Error(a.Remove("mysql-backup-20200103000000.sql"), "missing blobs must fail")
+
+	a.AccessTier = "frozen"
+	filepath := path.Join(tmp, "backup.sql")
+	r.NoError(ioutil.WriteFile(filepath, []byte("backup"), 0644), "failed to create file")
+	r.Error(a.Store(filepath, "backup.sql"), "unknown tiers must fail")
+}
+
+func TestAzureBlocks(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "azure")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeAzure("backups")
+	defer server.Close()
+
+	// Azurite accepts the SAS tokens of the container
+	a := &AzureConfig{
+		Endpoint:    server.endpoint(),
+		Container:   "backups",
+		SaveDir:     tmp,
+		Credentials: AzureCredentials{SASToken: "?sv=2019-12-12&sp=rwdl&sig=" + fakeAzureSAS},
+		BlockSize:   64 << 10,
+	}
+
+	data := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	filepath := path.Join(tmp, "backup.tar")
+	r.NoError(ioutil.WriteFile(filepath, data, 0644), "failed to create file")
+	r.NoError(a.Store(filepath, "backup.tar"), "failed to store file")
+	r.Equal(4, server.blockPuts, "the file must be uploaded in four blocks")
+	r.True(bytes.Equal(data, server.object("backup.tar").data), "contents mismatch")
+
+	reader, err := a.Stream("backup.tar")
+	r.NoError(err, "failed to stream blob")
+
+	streamed, err := ioutil.ReadAll(reader)
+	r.NoError(err, "failed to read blob")
+	r.True(bytes.Equal(data, streamed), "contents mismatch")
+	reader.Close()
+
+	a.Credentials.SASToken = "sig=invalid"
+	_, err = a.List("")
+	r.Error(err, "invalid signatures must fail")
+
+	r.Equal(int64(DefaultAzureBlockSize), (&AzureConfig{}).blockSize(1<<20))
+
+	size := int64(1 << 40)
+	blockSize := (&AzureConfig{}).blockSize(size)
+	r.True((size+blockSize-1)/blockSize < azureMaxBlocks, "too many blocks of %d bytes", blockSize)
+}
@@ -0,0 +1,180 @@
+package stores
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureVersion is the version of the Blob service REST API
+var azureVersion = "2019-12-12"
+
+// azureDevelopmentAccount and azureDevelopmentKey are the well known
+// credentials of the Azurite emulator
+var (
+	azureDevelopmentAccount  = "devstoreaccount1"
+	azureDevelopmentKey      = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	azureDevelopmentEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+)
+
+// AzureCredentials selects how requests are authorized, the connection
+// string has precedence over the other fields
+type AzureCredentials struct {
+	AccountName      string
+	AccountKey       string
+	SASToken         string
+	ConnectionString string
+}
+
+// resolve returns the credentials and endpoint set by a connection string
+func (c AzureCredentials) resolve(endpoint string) (AzureCredentials, string, error) {
+	if c.ConnectionString == "" {
+		return c, endpoint, nil
+	}
+
+	values := make(map[string]string)
+	for _, part := range strings.Split(c.ConnectionString, ";") {
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return c, "", fmt.Errorf("invalid connection string")
+		}
+
+		values[kv[0]] = kv[1]
+	}
+
+	if values["UseDevelopmentStorage"] == "true" {
+		return AzureCredentials{AccountName: azureDevelopmentAccount, AccountKey: azureDevelopmentKey},
+			azureDevelopmentEndpoint, nil
+	}
+
+	creds := AzureCredentials{
+		AccountName: values["AccountName"],
+		AccountKey:  values["AccountKey"],
+		SASToken:    values["SharedAccessSignature"],
+	}
+
+	if endpoint == "" {
+		endpoint = values["BlobEndpoint"]
+	}
+
+	if endpoint == "" && creds.AccountName != "" {
+		protocol := values["DefaultEndpointsProtocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+
+		suffix := values["EndpointSuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, creds.AccountName, suffix)
+	}
+
+	return creds, endpoint, nil
+}
+
+// authorize signs a request with the shared key, or adds the SAS token to it
+func (c AzureCredentials) authorize(req *http.Request) error {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+
+	if c.SASToken != "" {
+		sas, err := url.ParseQuery(strings.TrimPrefix(c.SASToken, "?"))
+		if err != nil {
+			return fmt.Errorf("invalid SAS token, %v", err)
+		}
+
+		query := req.URL.Query()
+		for name, values := range sas {
+			query[name] = values
+		}
+
+		req.URL.RawQuery = query.Encode()
+
+		return nil
+	}
+
+	if c.AccountName == "" || c.AccountKey == "" {
+		return fmt.Errorf("an account key, SAS token or connection string is required")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(c.AccountKey)
+	if err != nil {
+		return fmt.Errorf("invalid account key, %v", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(azureStringToSign(c.AccountName, req)))
+
+	req.Header.Set("Authorization", "SharedKey "+c.AccountName+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	return nil
+}
+
+// azureStringToSign returns the canonical representation of a request
+// signed with the shared key
+func azureStringToSign(account string, req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	lines := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // the date is sent in x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var names []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	resource := "/" + account + req.URL.EscapedPath()
+
+	query := req.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+
+	sort.Strings(params)
+
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	return strings.Join(lines, "\n") + "\n" + headers.String() + resource
+}
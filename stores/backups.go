@@ -0,0 +1,128 @@
+package stores
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeLayout is the layout of the timestamp in the backup names
+var backupTimeLayout = "20060102150405"
+
+// backupTimeRegexp finds the timestamp of a backup name like mysql-backup-20200102150405.sql
+var backupTimeRegexp = regexp.MustCompile(`-(\d{14})(\.|$)`)
+
+// remoteObject is a listed object of a remote store
+type remoteObject struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+	ETag         string
+}
+
+// backupTime returns the time of a backup from its name, or when it was
+// uploaded if the name has no timestamp
+func (o *remoteObject) backupTime() time.Time {
+	if match := backupTimeRegexp.FindStringSubmatch(path.Base(o.Key)); match != nil {
+		t, err := time.ParseInLocation(backupTimeLayout, match[1], time.Local)
+		if err == nil {
+			return t
+		}
+	}
+
+	return o.LastModified
+}
+
+// sortBackups orders the objects from the oldest to the newest backup
+func sortBackups(objects []remoteObject) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		ti, tj := objects[i].backupTime(), objects[j].backupTime()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+
+		return objects[i].Key < objects[j].Key
+	})
+}
+
+// IndexSuffix ends the name of the index a service stores next to a backup.
+// Indexes aren't listed as backups and are removed along with them
+var IndexSuffix = ".index.json"
+
+// isBackupIndex reports if a file is the index of a backup
+func isBackupIndex(name string) bool {
+	return strings.HasSuffix(name, IndexSuffix)
+}
+
+// splitIndexes removes the indexes from the objects, they are returned as a
+// set of keys
+func splitIndexes(objects []remoteObject) ([]remoteObject, map[string]bool) {
+	var backups []remoteObject
+	indexes := make(map[string]bool)
+
+	for _, obj := range objects {
+		if isBackupIndex(obj.Key) {
+			indexes[obj.Key] = true
+		} else {
+			backups = append(backups, obj)
+		}
+	}
+
+	return backups, indexes
+}
+
+// withIndexes returns the keys followed by the ones of their stored indexes
+func withIndexes(keys []string, indexes map[string]bool) []string {
+	all := append([]string{}, keys...)
+	for _, key := range keys {
+		if indexes[key+IndexSuffix] {
+			all = append(all, key+IndexSuffix)
+		}
+	}
+
+	return all
+}
+
+// BinlogDir is the directory of a store where the binlog command archives
+// the binlogs. Its files aren't listed as backups, the ones uploaded before
+// the oldest kept backup are removed along with the old backups
+var BinlogDir = "binlogs"
+
+// withoutBinlogs removes the archived binlogs of a root from the objects
+func withoutBinlogs(root string, objects []remoteObject) []remoteObject {
+	var backups []remoteObject
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, root+BinlogDir+"/") {
+			backups = append(backups, obj)
+		}
+	}
+
+	return backups
+}
+
+// expiredBinlogs returns the keys of the binlogs uploaded before the oldest
+// kept backup. That backup was dumped from a later binlog position, so they
+// aren't needed to restore any backup. Nothing expires when no backup is kept
+func expiredBinlogs(binlogs []remoteObject, kept []remoteObject) []string {
+	if len(kept) == 0 {
+		return nil
+	}
+
+	oldest := kept[0].backupTime()
+	for _, obj := range kept[1:] {
+		if t := obj.backupTime(); t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	var keys []string
+	for _, obj := range binlogs {
+		if obj.LastModified.Before(oldest) {
+			keys = append(keys, obj.Key)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,110 @@
+package stores
+
+import (
+	"io"
+	"math/bits"
+)
+
+// gearTable has the random values used by the rolling hash, generated with
+// splitmix64 so the chunk boundaries never change between versions
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6442616368657221)
+
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// chunker splits a stream in content-defined chunks, boundaries depend on
+// the data around them so an insertion only changes the chunks it touches
+type chunker struct {
+	reader io.Reader
+	min    int
+	max    int
+	mask   uint64
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+// newChunker returns a chunker with chunks of avg bytes on average, between
+// a quarter and four times that size
+func newChunker(reader io.Reader, avg int) *chunker {
+	shift := bits.Len(uint(avg)) - 1
+	max := avg * 4
+
+	return &chunker{
+		reader: reader,
+		min:    avg / 4,
+		max:    max,
+		mask:   (uint64(1)<<uint(shift) - 1) << (64 - uint(shift)),
+		buf:    make([]byte, max),
+	}
+}
+
+// Next returns the next chunk, the slice is only valid until the next call
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cut(data)
+	c.start += cut
+
+	return data[:cut], nil
+}
+
+// fill moves the pending data to the beginning of the buffer and reads
+// until it is full or the stream ends
+func (c *chunker) fill() error {
+	if c.end-c.start >= c.max || c.eof {
+		return nil
+	}
+
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+
+	n, err := io.ReadFull(c.reader, c.buf[c.end:])
+	c.end += n
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+
+	return err
+}
+
+// cut returns the length of the chunk at the beginning of data
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+
+	if len(data) > c.max {
+		data = data[:c.max]
+	}
+
+	var hash uint64
+	for i := c.min; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(data)
+}
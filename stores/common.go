@@ -1,5 +1,9 @@
 package stores
 
+import (
+	"io"
+)
+
 // Storer represents the methods to store/retrieve a backup from another location
 type Storer interface {
 	Store(filepath string, filename string) error
@@ -8,3 +12,17 @@ type Storer interface {
 	FindLatestBackup() (string, error)
 	Close()
 }
+
+// ObjectStorer is implemented by stores that can list and remove single
+// objects, filenames are relative to the root of the store
+type ObjectStorer interface {
+	Storer
+	List(prefix string) ([]string, error)
+	Remove(filename string) error
+}
+
+// Streamer is implemented by stores that can read a backup without saving
+// it to disk first
+type Streamer interface {
+	Stream(filename string) (io.ReadCloser, error)
+}
@@ -0,0 +1,396 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// dedupChunkDir is the directory of the repository with the chunks
+var dedupChunkDir = "chunks"
+
+// dedupIndexDir is the directory of the repository with the backup indexes
+var dedupIndexDir = "index"
+
+// dedupIndexExt is appended to the backup name to get its index
+var dedupIndexExt = ".json"
+
+// DefaultChunkSize is the average size of the chunks of a backup
+var DefaultChunkSize = 1 << 20
+
+// DedupConfig stores backups on another store split in content-defined
+// chunks, chunks are addressed by their hash so each one is stored once
+type DedupConfig struct {
+	Backend         ObjectStorer
+	SaveDir         string
+	ChunkSize       int
+	KeepAfterUpload bool
+	retrievedFiles  []string
+}
+
+// dedupChunk is a chunk of a backup
+type dedupChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// dedupIndex has the chunks needed to rebuild a backup
+type dedupIndex struct {
+	Name    string       `json:"name"`
+	Size    int64        `json:"size"`
+	Created time.Time    `json:"created"`
+	Chunks  []dedupChunk `json:"chunks"`
+}
+
+func chunkPath(hash string) string {
+	return path.Join(dedupChunkDir, hash[:2], hash)
+}
+
+func indexPath(name string) string {
+	return path.Join(dedupIndexDir, name+dedupIndexExt)
+}
+
+// Store splits a file in chunks and uploads the missing ones along with the
+// index of the backup. The repository is locked so the known chunks aren't
+// deleted by a garbage collection before the index references them
+func (d *DedupConfig) Store(filepath string, filename string) error {
+	lock, err := d.lockStore()
+	if err != nil {
+		return err
+	}
+
+	defer d.unlock(lock)
+
+	known, err := d.listChunks()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	chunkSize := d.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	index := &dedupIndex{
+		Name:    filename,
+		Created: time.Now().UTC(),
+	}
+
+	chunker := newChunker(f, chunkSize)
+	uploaded := 0
+
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot read file %q, %v", filepath, err)
+		}
+
+		sum := sha256.Sum256(data)
+		chunk := dedupChunk{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+		if !known[chunk.Hash] {
+			if err = d.upload(chunkPath(chunk.Hash), data); err != nil {
+				return fmt.Errorf("cannot store chunk %s, %v", chunk.Hash, err)
+			}
+
+			known[chunk.Hash] = true
+			uploaded++
+		}
+
+		index.Chunks = append(index.Chunks, chunk)
+		index.Size += chunk.Size
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("cannot encode index, %v", err)
+	}
+
+	// the index goes last so a failed backup never references missing chunks
+	if err = d.upload(indexPath(filename), data); err != nil {
+		return fmt.Errorf("cannot store index, %v", err)
+	}
+
+	log.Info("Stored %s with %d chunks, %d of them new", filename, len(index.Chunks), uploaded)
+
+	if d.KeepAfterUpload {
+		return nil
+	}
+
+	f.Close()
+	if err = os.Remove(filepath); err != nil && !os.IsNotExist(err) {
+		log.Warn("Cannot remove file %s, %v", filepath, err)
+	}
+
+	return nil
+}
+
+// upload writes data to a temporary file and stores it on the backend
+func (d *DedupConfig) upload(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(d.SaveDir, "dedup")
+	if err != nil {
+		return fmt.Errorf("cannot create temp file, %v", err)
+	}
+
+	// the backend usually moves or removes the file
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot write temp file, %v", err)
+	}
+
+	return d.Backend.Store(tmp.Name(), filename)
+}
+
+// listChunks returns the hashes of the chunks on the repository
+func (d *DedupConfig) listChunks() (map[string]bool, error) {
+	files, err := d.Backend.List(dedupChunkDir + "/")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list chunks, %v", err)
+	}
+
+	chunks := make(map[string]bool)
+	for _, file := range files {
+		chunks[path.Base(file)] = true
+	}
+
+	return chunks, nil
+}
+
+// listBackups returns the names of the backups sorted from oldest to newest
+// and the set of the indexes stored next to them by the services
+func (d *DedupConfig) listBackups() ([]string, map[string]bool, error) {
+	files, err := d.Backend.List(dedupIndexDir + "/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list indexes, %v", err)
+	}
+
+	var names []string
+	indexes := make(map[string]bool)
+
+	for _, file := range files {
+		if !strings.HasSuffix(file, dedupIndexExt) {
+			continue
+		}
+
+		name := strings.TrimSuffix(path.Base(file), dedupIndexExt)
+		if isBackupIndex(name) {
+			indexes[name] = true
+		} else {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, indexes, nil
+}
+
+// readIndex downloads and parses the index of a backup
+func (d *DedupConfig) readIndex(name string) (*dedupIndex, error) {
+	filepath, err := d.Backend.Retrieve(indexPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot download index of %s, %v", name, err)
+	}
+
+	// remove the downloaded copy
+	defer d.Backend.Close()
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index of %s, %v", name, err)
+	}
+
+	var index dedupIndex
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse index of %s, %v", name, err)
+	}
+
+	return &index, nil
+}
+
+// RemoveOlderBackups deletes the indexes of the old backups and the chunks
+// that aren't referenced by any of the remaining ones. The chunks are only
+// deleted while no backup is being stored on the same repository, they are
+// deleted by a later run otherwise
+func (d *DedupConfig) RemoveOlderBackups(keep int) error {
+	names, indexes, err := d.listBackups()
+	if err != nil {
+		return err
+	}
+
+	count := len(names) - keep
+	if count < 0 {
+		count = 0
+	}
+
+	for _, name := range withIndexes(names[:count], indexes) {
+		log.Trace("Removing index of %s", name)
+		if err = d.Backend.Remove(indexPath(name)); err != nil {
+			return err
+		}
+	}
+
+	// the chunks left by a skipped collection are deleted by the next one
+	lock, err := d.lockGC()
+	if err != nil {
+		return err
+	} else if lock == "" {
+		log.Warn("Removed %d backups, unused chunks are kept while a backup is being stored", count)
+		return nil
+	}
+
+	defer d.unlock(lock)
+
+	// backups stored before the lock are listed again
+	if names, indexes, err = d.listBackups(); err != nil {
+		return err
+	}
+
+	// count the references of the chunks of the remaining backups
+	refs := make(map[string]int)
+	for _, name := range withIndexes(names, indexes) {
+		index, err := d.readIndex(name)
+		if err != nil {
+			return err
+		}
+
+		for _, chunk := range index.Chunks {
+			refs[chunk.Hash]++
+		}
+	}
+
+	chunks, err := d.listChunks()
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for hash := range chunks {
+		if refs[hash] > 0 {
+			continue
+		}
+
+		if err = d.Backend.Remove(chunkPath(hash)); err != nil {
+			log.Error("Failed to remove chunk %s, %v", hash, err)
+		} else {
+			deleted++
+		}
+	}
+
+	log.Trace("Deleted %d backups and %d chunks", count, deleted)
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the repository
+func (d *DedupConfig) FindLatestBackup() (string, error) {
+	names, _, err := d.listBackups()
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on the repository")
+	}
+
+	return names[len(names)-1], nil
+}
+
+// Retrieve rebuilds a backup from its chunks and returns its local path
+func (d *DedupConfig) Retrieve(filename string) (string, error) {
+	name := path.Base(filename)
+
+	index, err := d.readIndex(name)
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkFreeSpace(d.SaveDir, index.Size); err != nil {
+		return "", err
+	}
+
+	filepath, err := downloadFile(d.SaveDir, name, func(f *os.File) error {
+		for _, chunk := range index.Chunks {
+			if err := d.appendChunk(f, chunk); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	d.retrievedFiles = append(d.retrievedFiles, filepath)
+
+	log.Trace("Rebuilt %s from %d chunks", filepath, len(index.Chunks))
+
+	return filepath, nil
+}
+
+// appendChunk downloads a chunk, checks its hash and writes it to w
+func (d *DedupConfig) appendChunk(w io.Writer, chunk dedupChunk) error {
+	filepath, err := d.Backend.Retrieve(chunkPath(chunk.Hash))
+	if err != nil {
+		return fmt.Errorf("cannot download chunk %s, %v", chunk.Hash, err)
+	}
+
+	// remove the downloaded copy so only one chunk is kept on disk
+	defer d.Backend.Close()
+
+	src, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open chunk %s, %v", chunk.Hash, err)
+	}
+
+	defer src.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), src)
+	if err != nil {
+		return fmt.Errorf("cannot copy chunk %s, %v", chunk.Hash, err)
+	}
+
+	if n != chunk.Size || hex.EncodeToString(hash.Sum(nil)) != chunk.Hash {
+		return fmt.Errorf("chunk %s is corrupted", chunk.Hash)
+	}
+
+	return nil
+}
+
+// Close deinitializes the store (remove rebuilt files)
+func (d *DedupConfig) Close() {
+	for _, file := range d.retrievedFiles {
+		removeDownloaded(file)
+	}
+
+	d.retrievedFiles = nil
+	d.Backend.Close()
+}
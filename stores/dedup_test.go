@@ -0,0 +1,236 @@
+package stores
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunker(t *testing.T) {
+	r := require.New(t)
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	split := func(data []byte) [][]byte {
+		var chunks [][]byte
+
+		chunker := newChunker(bytes.NewReader(data), 16<<10)
+		for {
+			chunk, err := chunker.Next()
+			if err == io.EOF {
+				break
+			}
+
+			r.NoError(err, "failed to read chunk")
+			r.True(len(chunk) <= 64<<10, "chunk bigger than the maximum size")
+			chunks = append(chunks, append([]byte{}, chunk...))
+		}
+
+		return chunks
+	}
+
+	chunks := split(data)
+	r.True(len(chunks) > 10, "expected more chunks, got %d", len(chunks))
+	r.Equal(data, bytes.Join(chunks, nil), "chunks don't rebuild the data")
+
+	// an insertion at the beginning only changes the first chunks
+	changed := split(append([]byte("insertion"), data...))
+
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+
+	shared := 0
+	for _, chunk := range changed {
+		if known[string(chunk)] {
+			shared++
+		}
+	}
+
+	r.True(shared >= len(chunks)-2, "only %d of %d chunks are shared", shared, len(chunks))
+}
+
+func TestDedupStoreRetrieve(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "dedup")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	repo := path.Join(tmp, "repo")
+	r.NoError(os.Mkdir(repo, 0755), "failed to create repository directory")
+
+	dedup := &DedupConfig{
+		Backend:   &FilesystemConfig{SaveDir: repo},
+		SaveDir:   tmp,
+		ChunkSize: 16 << 10,
+	}
+
+	first := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(first)
+
+	second := append([]byte{}, first...)
+	copy(second[500<<10:], "changed in the middle")
+
+	backups := map[string][]byte{
+		"test-backup-2020.01.01.tar": first,
+		"test-backup-2020.01.02.tar": second,
+	}
+
+	for _, name := range []string{"test-backup-2020.01.01.tar", "test-backup-2020.01.02.tar"} {
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, backups[name], 0644), "failed to create backup file")
+		r.NoError(dedup.Store(filepath, name), "failed to store %s", name)
+
+		_, err = os.Stat(filepath)
+		r.True(os.IsNotExist(err), "the stored file must be removed")
+	}
+
+	chunks, err := dedup.listChunks()
+	r.NoError(err, "failed to list chunks")
+
+	firstIndex, err := dedup.readIndex("test-backup-2020.01.01.tar")
+	r.NoError(err, "failed to read index")
+	r.True(len(chunks) < 2*len(firstIndex.Chunks), "chunks were not deduplicated")
+	r.True(len(chunks) > len(firstIndex.Chunks), "the changed chunks were not stored")
+
+	latest, err := dedup.FindLatestBackup()
+	r.NoError(err, "failed to find latest backup")
+	r.Equal("test-backup-2020.01.02.tar", latest)
+
+	for name, expected := range backups {
+		filepath, err := dedup.Retrieve(name)
+		r.NoError(err, "failed to retrieve %s", name)
+
+		actual, err := ioutil.ReadFile(filepath)
+		r.NoError(err, "failed to read %s", name)
+		r.Equal(expected, actual, "contents mismatch on %s", name)
+	}
+
+	dedup.Close()
+
+	// only the chunks of the first backup are removed
+	r.NoError(dedup.RemoveOlderBackups(1), "failed to remove old backups")
+
+	remaining, err := dedup.listChunks()
+	r.NoError(err, "failed to list chunks")
+	r.True(len(remaining) < len(chunks), "unreferenced chunks were not removed")
+
+	_, err = dedup.Retrieve("test-backup-2020.01.01.tar")
+	r.Error(err, "the old backup must be removed")
+
+	filepath, err := dedup.Retrieve("test-backup-2020.01.02.tar")
+	r.NoError(err, "failed to retrieve the remaining backup")
+
+	actual, err := ioutil.ReadFile(filepath)
+	r.NoError(err, "failed to read the remaining backup")
+	r.Equal(second, actual, "contents mismatch after garbage collection")
+
+	// corrupted chunks are detected
+	secondIndex, err := dedup.readIndex("test-backup-2020.01.02.tar")
+	r.NoError(err, "failed to read index")
+
+	corrupted := path.Join(repo, chunkPath(secondIndex.Chunks[0].Hash))
+	r.NoError(ioutil.WriteFile(corrupted, []byte("corrupted"), 0644), "failed to corrupt chunk")
+
+	dedup.Close()
+
+	// a file with the same name on the save directory is never overwritten
+	existing := path.Join(tmp, "test-backup-2020.01.02.tar")
+	r.NoError(ioutil.WriteFile(existing, []byte("existing"), 0644), "failed to create file")
+
+	_, err = dedup.Retrieve("test-backup-2020.01.02.tar")
+	r.Error(err, "corrupted chunks must fail the restore")
+
+	data, err := ioutil.ReadFile(existing)
+	r.NoError(err, "failed to read existing file")
+	r.Equal([]byte("existing"), data, "the existing file must be kept")
+	r.Empty(retrievedDirs(t, tmp), "failed retrieves must not leave partial files")
+
+	dedup.Close()
+}
+
+func TestDedupLocks(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "dedup")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	repo := path.Join(tmp, "repo")
+	r.NoError(os.Mkdir(repo, 0755), "failed to create repository directory")
+
+	dedup := &DedupConfig{
+		Backend:         &FilesystemConfig{SaveDir: repo},
+		SaveDir:         tmp,
+		ChunkSize:       16 << 10,
+		KeepAfterUpload: true,
+	}
+
+	store := func(name string, seed int64) error {
+		data := make([]byte, 256<<10)
+		rand.New(rand.NewSource(seed)).Read(data)
+
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, data, 0644), "failed to create backup file")
+
+		return dedup.Store(filepath, name)
+	}
+
+	r.NoError(store("test-backup-2020.01.01.tar", 1), "failed to store backup")
+	_, err = os.Stat(path.Join(tmp, "test-backup-2020.01.01.tar"))
+	r.NoError(err, "the stored file must be kept")
+
+	locks, err := dedup.Backend.List(dedupLockDir + "/")
+	r.NoError(err, "failed to list locks")
+	r.Empty(locks, "the store lock must be removed")
+
+	r.NoError(store("test-backup-2020.01.02.tar", 2), "failed to store backup")
+
+	chunks, err := dedup.listChunks()
+	r.NoError(err, "failed to list chunks")
+
+	// chunks are kept while a backup is being stored
+	lock, err := dedup.lock(dedupLockStore)
+	r.NoError(err, "failed to lock repository")
+
+	r.NoError(dedup.RemoveOlderBackups(1), "failed to remove old backups")
+
+	remaining, err := dedup.listChunks()
+	r.NoError(err, "failed to list chunks")
+	r.Equal(len(chunks), len(remaining), "chunks must not be deleted during a backup")
+
+	dedup.unlock(lock)
+
+	r.NoError(dedup.RemoveOlderBackups(1), "failed to remove old backups")
+
+	remaining, err = dedup.listChunks()
+	r.NoError(err, "failed to list chunks")
+	r.True(len(remaining) < len(chunks), "unused chunks must be deleted by the next collection")
+
+	// backups wait for a running collection
+	timeout, poll := dedupLockTimeout, dedupLockPoll
+	dedupLockTimeout, dedupLockPoll = 50*time.Millisecond, 10*time.Millisecond
+	defer func() { dedupLockTimeout, dedupLockPoll = timeout, poll }()
+
+	lock, err = dedup.lock(dedupLockGC)
+	r.NoError(err, "failed to lock repository")
+	r.Error(store("test-backup-2020.01.03.tar", 3), "backups must not run during a collection")
+	dedup.unlock(lock)
+
+	// locks left by crashed processes are ignored
+	stale := fmt.Sprintf("%s-%d-1", dedupLockGC, time.Now().Add(-2*dedupLockStale).UnixNano())
+	r.NoError(os.MkdirAll(path.Join(repo, dedupLockDir), 0755), "failed to create lock directory")
+	r.NoError(ioutil.WriteFile(path.Join(repo, dedupLockDir, stale), nil, 0644), "failed to create stale lock")
+	r.NoError(store("test-backup-2020.01.03.tar", 3), "stale locks must be ignored")
+}
@@ -0,0 +1,144 @@
+package stores
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// dedupLockDir is the directory of the repository with the locks of the
+// backups being stored and of the garbage collection
+var dedupLockDir = "locks"
+
+// Kinds of repository locks
+const (
+	dedupLockStore = "store"
+	dedupLockGC    = "gc"
+)
+
+// dedupLockStale is the age after which a lock left by a crashed process is ignored
+var dedupLockStale = 24 * time.Hour
+
+// dedupLockPoll is the time between checks while a backup waits for the
+// garbage collection to finish
+var dedupLockPoll = 10 * time.Second
+
+// dedupLockTimeout is the longest time a backup waits for the garbage collection
+var dedupLockTimeout = time.Hour
+
+// dedupLock is a lock object of the repository, its name has its kind and
+// creation time in nanoseconds
+type dedupLock struct {
+	name    string
+	created time.Time
+}
+
+// lock stores a new lock object of the given kind
+func (d *DedupConfig) lock(kind string) (string, error) {
+	now := time.Now()
+	name := path.Join(dedupLockDir, fmt.Sprintf("%s-%d-%d", kind, now.UnixNano(), os.Getpid()))
+
+	if err := d.upload(name, []byte(now.UTC().Format(time.RFC3339))); err != nil {
+		return "", fmt.Errorf("cannot lock repository, %v", err)
+	}
+
+	return name, nil
+}
+
+// unlock removes a lock object
+func (d *DedupConfig) unlock(name string) {
+	if err := d.Backend.Remove(name); err != nil {
+		log.Warn("Cannot remove repository lock %s, %v", name, err)
+	}
+}
+
+// activeLocks returns the locks of a kind that aren't stale
+func (d *DedupConfig) activeLocks(kind string) ([]dedupLock, error) {
+	files, err := d.Backend.List(dedupLockDir + "/")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list repository locks, %v", err)
+	}
+
+	var locks []dedupLock
+	for _, file := range files {
+		parts := strings.SplitN(path.Base(file), "-", 3)
+		if len(parts) != 3 || parts[0] != kind {
+			continue
+		}
+
+		nsec, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		lock := dedupLock{name: path.Join(dedupLockDir, path.Base(file)), created: time.Unix(0, nsec)}
+		if time.Since(lock.created) > dedupLockStale {
+			log.Warn("Ignoring stale repository lock %s", lock.name)
+			continue
+		}
+
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
+// lockStore locks the repository before the known chunks are listed by a
+// backup. The garbage collection doesn't delete chunks while a backup holds
+// a lock, the backup waits for a running collection to finish
+func (d *DedupConfig) lockStore() (string, error) {
+	name, err := d.lock(dedupLockStore)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(dedupLockTimeout)
+
+	for {
+		locks, err := d.activeLocks(dedupLockGC)
+		if err != nil {
+			d.unlock(name)
+			return "", err
+		}
+
+		if len(locks) == 0 {
+			return name, nil
+		}
+
+		if time.Now().After(deadline) {
+			d.unlock(name)
+			return "", fmt.Errorf("the garbage collection of the repository didn't finish after %s", dedupLockTimeout)
+		}
+
+		log.Info("Waiting for the garbage collection of the repository to finish")
+		time.Sleep(dedupLockPoll)
+	}
+}
+
+// lockGC locks the repository before the unused chunks are deleted. It
+// returns an empty name when a backup is being stored, the chunks must not
+// be deleted then
+func (d *DedupConfig) lockGC() (string, error) {
+	name, err := d.lock(dedupLockGC)
+	if err != nil {
+		return "", err
+	}
+
+	locks, err := d.activeLocks(dedupLockStore)
+	if err != nil {
+		d.unlock(name)
+		return "", err
+	}
+
+	if len(locks) > 0 {
+		d.unlock(name)
+		return "", nil
+	}
+
+	return name, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package stores
+
+import (
+	"errors"
+)
+
+// freeSpace is not available on this platform
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space can't be read on this platform")
+}
@@ -0,0 +1,230 @@
+package stores
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeAzureSAS is the signature accepted in SAS tokens
+var fakeAzureSAS = "fake-signature"
+
+// fakeAzure is a minimal Blob service with the Azurite path style URLs
+type fakeAzure struct {
+	*httptest.Server
+	account   string
+	key       string
+	container string
+	mu        sync.Mutex
+	objects   map[string]*fakeS3Object
+	blocks    map[string]map[string][]byte
+	blockPuts int
+}
+
+func newFakeAzure(container string) *fakeAzure {
+	f := &fakeAzure{
+		account:   azureDevelopmentAccount,
+		key:       azureDevelopmentKey,
+		container: container,
+		objects:   make(map[string]*fakeS3Object),
+		blocks:    make(map[string]map[string][]byte),
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+
+	return f
+}
+
+func (f *fakeAzure) endpoint() string {
+	return f.URL + "/" + f.account
+}
+
+func (f *fakeAzure) object(name string) *fakeS3Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.objects[name]
+}
+
+func fakeAzureError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// authorized checks the shared key signature or the SAS token of a request
+func (f *fakeAzure) authorized(r *http.Request) bool {
+	if r.URL.Query().Get("sig") != "" {
+		return r.URL.Query().Get("sig") == fakeAzureSAS
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(f.key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(azureStringToSign(f.account, r)))
+
+	expected := "SharedKey " + f.account + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return r.Header.Get("Authorization") == expected && r.Header.Get("x-ms-date") != ""
+}
+
+func (f *fakeAzure) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.authorized(r) {
+		fakeAzureError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	prefix := "/" + f.account + "/" + f.container
+	escaped := r.URL.EscapedPath()
+	query := r.URL.Query()
+
+	if escaped == prefix && r.Method == http.MethodGet && query.Get("comp") == "list" {
+		f.list(w, query.Get("prefix"), query.Get("marker"))
+		return
+	}
+
+	if !strings.HasPrefix(escaped, prefix+"/") {
+		fakeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+
+	name, _ := url.PathUnescape(strings.TrimPrefix(escaped, prefix+"/"))
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if md5sum := r.Header.Get("Content-MD5"); md5sum != "" && md5sum != contentMD5(body) {
+		fakeAzureError(w, http.StatusBadRequest, "Md5Mismatch")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if f.blocks[name] == nil {
+			f.blocks[name] = make(map[string][]byte)
+		}
+
+		f.blocks[name][query.Get("blockid")] = body
+		f.blockPuts++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+
+		if err := xml.Unmarshal(body, &list); err != nil {
+			fakeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := f.blocks[name][id]
+			if !ok {
+				fakeAzureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+
+			data = append(data, block...)
+		}
+
+		delete(f.blocks, name)
+		f.put(name, data, r.Header)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			fakeAzureError(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+
+		f.put(name, body, r.Header)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[name]
+		if !ok {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+
+		for name, values := range obj.header {
+			w.Header()[name] = values
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodDelete:
+		if _, ok := f.objects[name]; !ok {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		fakeAzureError(w, http.StatusMethodNotAllowed, "UnsupportedHttpVerb")
+	}
+}
+
+// put saves a blob with the properties set on its upload
+func (f *fakeAzure) put(name string, data []byte, header http.Header) {
+	properties := http.Header{}
+	properties.Set("Content-Type", header.Get("x-ms-blob-content-type"))
+	properties.Set("Content-MD5", header.Get("x-ms-blob-content-md5"))
+
+	tier := header.Get("x-ms-access-tier")
+	if tier == "" {
+		tier = "Hot"
+	}
+
+	properties.Set("x-ms-access-tier", tier)
+
+	f.objects[name] = &fakeS3Object{data: data, header: properties, modTime: time.Now()}
+}
+
+// list returns the blobs in pages of two items
+func (f *fakeAzure) list(w http.ResponseWriter, prefix string, marker string) {
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(marker)
+	end := start + 2
+	next := ""
+
+	if end < len(names) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(names)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+
+	for _, name := range names[start:end] {
+		obj := f.objects[name]
+		fmt.Fprintf(&buf, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Etag>%s</Etag><Content-Length>%d</Content-Length></Properties></Blob>",
+			name, obj.modTime.UTC().Format(http.TimeFormat), etag(obj.data), len(obj.data))
+	}
+
+	fmt.Fprintf(&buf, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+	w.Write(buf.Bytes())
+}
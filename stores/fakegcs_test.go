@@ -0,0 +1,273 @@
+package stores
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeGCSToken is the access token returned by the fake token endpoints
+var fakeGCSToken = "fake-token"
+
+// fakeGCSUpload is a resumable upload in progress
+type fakeGCSUpload struct {
+	name   string
+	crc32c string
+	size   int64
+	data   []byte
+}
+
+// fakeGCS is a minimal GCS JSON API server for a single bucket, it also
+// serves the token endpoints
+type fakeGCS struct {
+	*httptest.Server
+	bucket     string
+	key        *rsa.PublicKey
+	mu         sync.Mutex
+	objects    map[string]*fakeS3Object
+	uploads    map[string]*fakeGCSUpload
+	tokens     int
+	chunks     int
+	failChunk  int
+	uploadSeen int
+}
+
+func newFakeGCS(bucket string, key *rsa.PublicKey) *fakeGCS {
+	f := &fakeGCS{
+		bucket:  bucket,
+		key:     key,
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]*fakeGCSUpload),
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+
+	return f
+}
+
+func (f *fakeGCS) object(name string) *fakeS3Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.objects[name]
+}
+
+func crc32cBase64(data []byte) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+func fakeGCSError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
+
+func (f *fakeGCS) resource(name string, obj *fakeS3Object) map[string]string {
+	return map[string]string{
+		"name":    name,
+		"bucket":  f.bucket,
+		"size":    strconv.Itoa(len(obj.data)),
+		"updated": obj.modTime.UTC().Format(time.RFC3339Nano),
+		"etag":    etag(obj.data),
+		"crc32c":  obj.header.Get("X-Goog-Crc32c"),
+	}
+}
+
+func (f *fakeGCS) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		f.serviceAccountToken(w, r)
+		return
+	case "/computeMetadata/v1/instance/service-accounts/default/token":
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			fakeGCSError(w, http.StatusForbidden, "missing metadata flavor")
+			return
+		}
+
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token":%q,"expires_in":3600,"token_type":"Bearer"}`, fakeGCSToken)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+fakeGCSToken {
+		fakeGCSError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	bucketPath := "/storage/v1/b/" + f.bucket + "/o"
+	uploadPath := "/upload/storage/v1/b/" + f.bucket + "/o"
+	escaped := r.URL.EscapedPath()
+	query := r.URL.Query()
+
+	switch {
+	case escaped == uploadPath && r.Method == http.MethodPost:
+		var meta map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			fakeGCSError(w, http.StatusBadRequest, "invalid metadata")
+			return
+		}
+
+		size, _ := strconv.ParseInt(r.Header.Get("X-Upload-Content-Length"), 10, 64)
+		f.uploadSeen++
+		id := strconv.Itoa(f.uploadSeen)
+		f.uploads[id] = &fakeGCSUpload{name: meta["name"], crc32c: meta["crc32c"], size: size}
+
+		w.Header().Set("Location", f.URL+uploadPath+"?uploadType=resumable&upload_id="+id)
+	case escaped == uploadPath && r.Method == http.MethodPut:
+		f.putChunk(w, r, query.Get("upload_id"))
+	case escaped == bucketPath && r.Method == http.MethodGet:
+		f.list(w, query.Get("prefix"), query.Get("pageToken"))
+	case strings.HasPrefix(escaped, bucketPath+"/"):
+		name, err := url.PathUnescape(strings.TrimPrefix(escaped, bucketPath+"/"))
+		if err != nil {
+			fakeGCSError(w, http.StatusBadRequest, "invalid name")
+			return
+		}
+
+		obj, ok := f.objects[name]
+		if !ok {
+			fakeGCSError(w, http.StatusNotFound, "No such object")
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && query.Get("alt") == "media":
+			w.Write(obj.data)
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(f.resource(name, obj))
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			fakeGCSError(w, http.StatusMethodNotAllowed, "not allowed")
+		}
+	default:
+		fakeGCSError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serviceAccountToken checks the signature of the JWT assertion
+func (f *fakeGCS) serviceAccountToken(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		fakeGCSError(w, http.StatusBadRequest, "invalid grant type")
+		return
+	}
+
+	parts := strings.Split(r.FormValue("assertion"), ".")
+	if len(parts) != 3 {
+		fakeGCSError(w, http.StatusBadRequest, "invalid assertion")
+		return
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, sum[:], signature); err != nil {
+		fakeGCSError(w, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	f.tokens++
+	fmt.Fprintf(w, `{"access_token":%q,"expires_in":3600,"token_type":"Bearer"}`, fakeGCSToken)
+}
+
+// putChunk appends a chunk to an upload, the chunk number failChunk fails
+// once after half of it is received
+func (f *fakeGCS) putChunk(w http.ResponseWriter, r *http.Request, id string) {
+	upload, ok := f.uploads[id]
+	if !ok {
+		fakeGCSError(w, http.StatusNotFound, "No such upload")
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	contentRange := r.Header.Get("Content-Range")
+
+	if !strings.HasPrefix(contentRange, "bytes */") {
+		var start, end, total int64
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total); err != nil ||
+			start != int64(len(upload.data)) || end-start+1 != int64(len(body)) {
+			fakeGCSError(w, http.StatusBadRequest, "invalid range "+contentRange)
+			return
+		}
+
+		f.chunks++
+		if f.chunks == f.failChunk {
+			upload.data = append(upload.data, body[:len(body)/2]...)
+			fakeGCSError(w, http.StatusServiceUnavailable, "injected failure")
+			return
+		}
+
+		upload.data = append(upload.data, body...)
+	}
+
+	if int64(len(upload.data)) < upload.size {
+		if len(upload.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		}
+
+		w.WriteHeader(statusResumeIncomplete)
+		return
+	}
+
+	if upload.crc32c != "" && upload.crc32c != crc32cBase64(upload.data) {
+		fakeGCSError(w, http.StatusBadRequest, "checksum mismatch")
+		return
+	}
+
+	// the checksum is kept to detect objects corrupted later
+	obj := &fakeS3Object{data: upload.data, header: http.Header{}, modTime: time.Now()}
+	obj.header.Set("X-Goog-Crc32c", crc32cBase64(upload.data))
+	f.objects[upload.name] = obj
+	delete(f.uploads, id)
+
+	json.NewEncoder(w).Encode(f.resource(upload.name, obj))
+}
+
+// list returns the objects in pages of two items
+func (f *fakeGCS) list(w http.ResponseWriter, prefix string, pageToken string) {
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(pageToken)
+	end := start + 2
+
+	res := map[string]interface{}{}
+	if end < len(names) {
+		res["nextPageToken"] = strconv.Itoa(end)
+	} else {
+		end = len(names)
+	}
+
+	var items []map[string]string
+	for _, name := range names[start:end] {
+		items = append(items, f.resource(name, f.objects[name]))
+	}
+
+	res["items"] = items
+	json.NewEncoder(w).Encode(res)
+}
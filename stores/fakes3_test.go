@@ -0,0 +1,476 @@
+package stores
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3Object is an object stored by the fake server
+type fakeS3Object struct {
+	version string
+	data    []byte
+	etag    string
+	header  http.Header
+	modTime time.Time
+}
+
+// fakeS3Upload is a multipart upload in progress
+type fakeS3Upload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+// fakeS3 is a minimal S3 server with path style requests for a single bucket
+type fakeS3 struct {
+	*httptest.Server
+	bucket      string
+	mu          sync.Mutex
+	objects     map[string]*fakeS3Object
+	uploads     map[string]*fakeS3Upload
+	uploadCount int
+	partCount   int
+	failPart    int
+	// failLimit stops failing failPart after this many failures when set
+	failLimit int
+	failures  int
+	// versioned buckets keep deleted objects as noncurrent versions
+	versioned    bool
+	versionCount int
+	noncurrent   map[string][]*fakeS3Object
+	markers      map[string][]string
+	deleteCount  int
+	failDelete   string
+	// corrupt changes the objects saved by single uploads after the
+	// Content-MD5 was checked
+	corrupt bool
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	f := &fakeS3{
+		bucket:     bucket,
+		objects:    make(map[string]*fakeS3Object),
+		uploads:    make(map[string]*fakeS3Upload),
+		noncurrent: make(map[string][]*fakeS3Object),
+		markers:    make(map[string][]string),
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+
+	return f
+}
+
+// config returns a store pointing to the fake server
+func (f *fakeS3) config(saveDir string) *S3Config {
+	return &S3Config{
+		Endpoint:       f.URL,
+		Region:         "us-east-1",
+		Bucket:         f.bucket,
+		ForcePathStyle: true,
+		SaveDir:        saveDir,
+		Credentials:    S3Credentials{AccessKey: "access", SecretKey: "secret"},
+	}
+}
+
+// locked returns whether the object has a legal hold or an active retention
+func (o *fakeS3Object) locked() bool {
+	if o.header.Get("X-Amz-Object-Lock-Legal-Hold") == "ON" {
+		return true
+	}
+
+	until, err := time.Parse(time.RFC3339, o.header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+
+	return err == nil && until.After(time.Now())
+}
+
+func (f *fakeS3) object(key string) *fakeS3Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.objects[key]
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// multipartETag returns the ETag of an object assembled from parts
+func multipartETag(parts [][]byte) string {
+	var sums []byte
+	for _, part := range parts {
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+	}
+
+	sum := md5.Sum(sums)
+	return fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(parts))
+}
+
+// validMD5 checks the Content-MD5 header of a request when it's set
+func validMD5(r *http.Request, body []byte) bool {
+	header := r.Header.Get("Content-Md5")
+	sum := md5.Sum(body)
+
+	return header == "" || header == base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+
+	if len(parts) == 1 || parts[1] == "" {
+		switch {
+		case r.Method == http.MethodGet && hasQuery(query, "versions"):
+			f.listVersions(w, query.Get("prefix"))
+		case r.Method == http.MethodGet:
+			f.list(w, query.Get("prefix"))
+		case r.Method == http.MethodPost && hasQuery(query, "delete"):
+			f.deleteObjects(w, r)
+		default:
+			fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+
+		return
+	}
+
+	key := parts[1]
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if r.Method == http.MethodPut && !validMD5(r, body) {
+		fakeS3Error(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && hasQuery(query, "uploads"):
+		f.uploadCount++
+		id := strconv.Itoa(f.uploadCount)
+		f.uploads[id] = &fakeS3Upload{key: key, header: r.Header.Clone(), parts: make(map[int][]byte)}
+
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			f.bucket, key, id)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart && (f.failLimit == 0 || f.failures < f.failLimit) {
+			f.failures++
+			fakeS3Error(w, http.StatusBadRequest, "InjectedFailure")
+			return
+		}
+
+		f.partCount++
+		upload.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		fmt.Fprintf(w, "<ListPartsResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId><IsTruncated>false</IsTruncated>",
+			f.bucket, key, query.Get("uploadId"))
+		for number, data := range upload.parts {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>", number, etag(data), len(data))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+
+		var data []byte
+		var parts [][]byte
+		for _, part := range complete.Parts {
+			if etag(upload.parts[part.PartNumber]) != part.ETag {
+				fakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+
+			data = append(data, upload.parts[part.PartNumber]...)
+			parts = append(parts, upload.parts[part.PartNumber])
+		}
+
+		obj := &fakeS3Object{data: data, etag: multipartETag(parts), header: upload.header, modTime: time.Now()}
+		f.put(key, obj)
+		delete(f.uploads, query.Get("uploadId"))
+
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>",
+			f.bucket, key, obj.etag)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		if f.corrupt {
+			body = append([]byte{body[0] ^ 0xff}, body[1:]...)
+		}
+
+		obj := &fakeS3Object{data: body, header: r.Header.Clone(), modTime: time.Now()}
+		f.put(key, obj)
+		w.Header().Set("ETag", obj.etag)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj := f.version(key, query.Get("versionId"))
+		if obj == nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		for name, values := range obj.header {
+			lower := strings.ToLower(name)
+			if strings.HasPrefix(lower, "x-amz-meta-") || strings.HasPrefix(lower, "x-amz-object-lock-") || name == "Content-Type" {
+				w.Header()[name] = values
+			}
+		}
+
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func hasQuery(query map[string][]string, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated><KeyCount>%d</KeyCount>",
+		f.bucket, prefix, len(keys))
+
+	for _, key := range keys {
+		obj := f.objects[key]
+		fmt.Fprintf(&buf, "<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size></Contents>",
+			key, obj.modTime.UTC().Format(time.RFC3339), obj.etag, len(obj.data))
+	}
+
+	buf.WriteString("</ListBucketResult>")
+	w.Write(buf.Bytes())
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []struct {
+			Key       string
+			VersionId string
+		} `xml:"Object"`
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &req); err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	if len(req.Objects) > 1000 {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	f.deleteCount++
+
+	var buf bytes.Buffer
+	buf.WriteString("<DeleteResult>")
+
+	for _, obj := range req.Objects {
+		if o := f.version(obj.Key, obj.VersionId); (o != nil && o.locked()) || obj.Key == f.failDelete {
+			fmt.Fprintf(&buf, "<Error><Key>%s</Key><VersionId>%s</VersionId><Code>AccessDenied</Code><Message>Access Denied</Message></Error>",
+				obj.Key, obj.VersionId)
+			continue
+		}
+
+		if obj.VersionId != "" {
+			if !f.deleteVersion(obj.Key, obj.VersionId) {
+				fmt.Fprintf(&buf, "<Error><Key>%s</Key><VersionId>%s</VersionId><Code>NoSuchVersion</Code><Message>No Such Version</Message></Error>",
+					obj.Key, obj.VersionId)
+				continue
+			}
+		} else if o, ok := f.objects[obj.Key]; ok && f.versioned {
+			f.versionCount++
+			f.noncurrent[obj.Key] = append(f.noncurrent[obj.Key], o)
+			f.markers[obj.Key] = append(f.markers[obj.Key], strconv.Itoa(f.versionCount))
+			delete(f.objects, obj.Key)
+		} else {
+			delete(f.objects, obj.Key)
+		}
+
+		fmt.Fprintf(&buf, "<Deleted><Key>%s</Key></Deleted>", obj.Key)
+	}
+
+	buf.WriteString("</DeleteResult>")
+	w.Write(buf.Bytes())
+}
+
+// put stores an object, the previous one is kept on versioned buckets
+func (f *fakeS3) put(key string, obj *fakeS3Object) {
+	if previous, ok := f.objects[key]; ok && f.versioned {
+		f.noncurrent[key] = append(f.noncurrent[key], previous)
+	}
+
+	if obj.etag == "" {
+		obj.etag = etag(obj.data)
+	}
+
+	f.versionCount++
+	obj.version = strconv.Itoa(f.versionCount)
+	f.objects[key] = obj
+}
+
+// version returns a version of a key, the current one when version is empty
+func (f *fakeS3) version(key string, version string) *fakeS3Object {
+	if obj, ok := f.objects[key]; ok && (version == "" || obj.version == version) {
+		return obj
+	}
+
+	if version == "" {
+		return nil
+	}
+
+	for _, obj := range f.noncurrent[key] {
+		if obj.version == version {
+			return obj
+		}
+	}
+
+	return nil
+}
+
+// deleteVersion permanently removes a version or delete marker of a key
+func (f *fakeS3) deleteVersion(key string, version string) bool {
+	if obj, ok := f.objects[key]; ok && obj.version == version {
+		delete(f.objects, key)
+		return true
+	}
+
+	for i, obj := range f.noncurrent[key] {
+		if obj.version == version {
+			f.noncurrent[key] = append(f.noncurrent[key][:i], f.noncurrent[key][i+1:]...)
+			return true
+		}
+	}
+
+	for i, marker := range f.markers[key] {
+		if marker == version {
+			f.markers[key] = append(f.markers[key][:i], f.markers[key][i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// versions returns the number of versions and delete markers of a key
+func (f *fakeS3) versions(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := len(f.noncurrent[key]) + len(f.markers[key])
+	if _, ok := f.objects[key]; ok {
+		count++
+	}
+
+	return count
+}
+
+func (f *fakeS3) listVersions(w http.ResponseWriter, prefix string) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<ListVersionsResult><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>", f.bucket, prefix)
+
+	writeVersion := func(key string, obj *fakeS3Object, latest bool) {
+		fmt.Fprintf(&buf, "<Version><Key>%s</Key><VersionId>%s</VersionId><IsLatest>%t</IsLatest><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size></Version>",
+			key, obj.version, latest, obj.modTime.UTC().Format(time.RFC3339), obj.etag, len(obj.data))
+	}
+
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			writeVersion(key, obj, true)
+		}
+	}
+
+	for key, objs := range f.noncurrent {
+		if strings.HasPrefix(key, prefix) {
+			for _, obj := range objs {
+				writeVersion(key, obj, false)
+			}
+		}
+	}
+
+	for key, markers := range f.markers {
+		if strings.HasPrefix(key, prefix) {
+			for _, marker := range markers {
+				fmt.Fprintf(&buf, "<DeleteMarker><Key>%s</Key><VersionId>%s</VersionId><IsLatest>false</IsLatest></DeleteMarker>", key, marker)
+			}
+		}
+	}
+
+	buf.WriteString("</ListVersionsResult>")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,123 @@
+package stores
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSFTP is an in-process SSH server with the SFTP subsystem, serving the
+// local filesystem to a single authorized key
+type fakeSFTP struct {
+	listener   net.Listener
+	hostKey    ssh.Signer
+	authorized ssh.PublicKey
+	wg         sync.WaitGroup
+}
+
+func newFakeSFTP(authorized ssh.PublicKey) (*fakeSFTP, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeSFTP{listener: listener, hostKey: hostKey, authorized: authorized}
+
+	f.wg.Add(1)
+	go f.serve()
+
+	return f, nil
+}
+
+func (f *fakeSFTP) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSFTP) Close() {
+	f.listener.Close()
+	f.wg.Wait()
+}
+
+func (f *fakeSFTP) serve() {
+	defer f.wg.Done()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && bytes.Equal(key.Marshal(), f.authorized.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("unauthorized key for %s", conn.User())
+		},
+	}
+
+	config.AddHostKey(f.hostKey)
+
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.handle(conn, config)
+		}()
+	}
+}
+
+func (f *fakeSFTP) handle(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,125 @@
+package stores
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// fakeWebDAV is a WebDAV server with the URLs and chunked uploads of
+// Nextcloud for the user backup
+type fakeWebDAV struct {
+	*httptest.Server
+	root      string
+	files     *webdav.Handler
+	mu        sync.Mutex
+	uploads   map[string]map[string][]byte
+	chunkPuts int
+}
+
+var (
+	fakeWebDAVFiles   = "/remote.php/dav/files/backup"
+	fakeWebDAVUploads = "/remote.php/dav/uploads/backup"
+)
+
+func newFakeWebDAV(root string) *fakeWebDAV {
+	f := &fakeWebDAV{
+		root: root,
+		files: &webdav.Handler{
+			Prefix:     fakeWebDAVFiles,
+			FileSystem: webdav.Dir(root),
+			LockSystem: webdav.NewMemLS(),
+		},
+		uploads: make(map[string]map[string][]byte),
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+
+	return f
+}
+
+func (f *fakeWebDAV) handle(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != "backup" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, fakeWebDAVUploads+"/") {
+		f.handleUpload(w, r)
+		return
+	}
+
+	f.files.ServeHTTP(w, r)
+}
+
+// handleUpload emulates the chunked uploads of Nextcloud
+func (f *fakeWebDAV) handleUpload(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, fakeWebDAVUploads+"/")
+	id, chunk := path.Split(name)
+	id = strings.TrimSuffix(id, "/")
+
+	if id == "" {
+		id, chunk = chunk, ""
+	}
+
+	switch {
+	case r.Method == "MKCOL" && chunk == "":
+		f.uploads[id] = make(map[string][]byte)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete && chunk == "":
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && f.uploads[id] != nil:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.uploads[id][chunk] = data
+		f.chunkPuts++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "MOVE" && chunk == ".file" && f.uploads[id] != nil:
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || !strings.HasPrefix(dest.Path, fakeWebDAVFiles+"/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var chunks []string
+		for chunk := range f.uploads[id] {
+			chunks = append(chunks, chunk)
+		}
+
+		sort.Strings(chunks)
+
+		var data []byte
+		for _, chunk := range chunks {
+			data = append(data, f.uploads[id][chunk]...)
+		}
+
+		delete(f.uploads, id)
+
+		filepath := path.Join(f.root, strings.TrimPrefix(dest.Path, fakeWebDAVFiles))
+		if err = ioutil.WriteFile(filepath, data, 0644); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// exists reports if a file was saved by the server
+func (f *fakeWebDAV) exists(name string) bool {
+	_, err := os.Stat(path.Join(f.root, name))
+	return err == nil
+}
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	log "unknwon.dev/clog/v2"
 )
@@ -15,16 +17,25 @@ type FilesystemConfig struct {
 	SaveDir string
 }
 
+// destination returns the path of a stored file
+func (f *FilesystemConfig) destination(filename string) string {
+	return path.Clean(path.Join(f.SaveDir, filename))
+}
+
 // Store moves/copies a file to another directory
 func (f *FilesystemConfig) Store(src string, filename string) error {
-	dest := path.Clean(path.Join(f.SaveDir, filename))
+	dest := f.destination(filename)
 
 	if src == dest {
 		log.Trace("Using the same path as source and destination, do nothing")
 		return nil
 	}
 
-	err := os.Rename(dest, src)
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("cannot create destination directory, %v", err)
+	}
+
+	err := os.Rename(src, dest)
 	if err != nil {
 		log.Warn("Cannot rename %s to %s, trying to copy instead", src, dest)
 	} else {
@@ -70,19 +81,78 @@ func (f *FilesystemConfig) Store(src string, filename string) error {
 	return nil
 }
 
+// listBackups returns the files of the directory sorted by name and the set
+// of their indexes, the binlog directory is skipped
+func (f *FilesystemConfig) listBackups() ([]remoteObject, map[string]bool, error) {
+	files, err := ioutil.ReadDir(f.SaveDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list contents of directory %s, %v", f.SaveDir, err)
+	}
+
+	var objects []remoteObject
+	indexes := make(map[string]bool)
+
+	for _, file := range files {
+		switch {
+		case file.IsDir() && file.Name() == BinlogDir:
+		case isBackupIndex(file.Name()):
+			indexes[file.Name()] = true
+		default:
+			objects = append(objects, remoteObject{Key: file.Name(), LastModified: file.ModTime()})
+		}
+	}
+
+	return objects, indexes, nil
+}
+
+// listBinlogs returns the binlogs archived in the binlog directory
+func (f *FilesystemConfig) listBinlogs() ([]remoteObject, error) {
+	files, err := ioutil.ReadDir(path.Join(f.SaveDir, BinlogDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list binlogs of directory %s, %v", f.SaveDir, err)
+	}
+
+	var binlogs []remoteObject
+	for _, file := range files {
+		if !file.IsDir() {
+			binlogs = append(binlogs, remoteObject{Key: path.Join(BinlogDir, file.Name()), LastModified: file.ModTime()})
+		}
+	}
+
+	return binlogs, nil
+}
+
 // RemoveOlderBackups keeps the most recent backups of a directory and deletes the old ones
+// along with the binlogs they don't need
 func (f *FilesystemConfig) RemoveOlderBackups(keep int) error {
-	files, err := ioutil.ReadDir(f.SaveDir)
+	objects, indexes, err := f.listBackups()
+	if err != nil {
+		return err
+	}
+
+	binlogs, err := f.listBinlogs()
 	if err != nil {
-		return fmt.Errorf("cannot list contents of directory %s, %v", f.SaveDir, err)
+		return err
 	}
 
-	count := len(files) - keep
+	count := len(objects) - keep
+	if count < 0 {
+		count = 0
+	}
+
+	var files []string
+	for _, obj := range objects[:count] {
+		files = append(files, obj.Key)
+	}
+
+	files = append(withIndexes(files, indexes), expiredBinlogs(binlogs, objects[count:])...)
 	deleted := 0
 
-	if count > 0 {
-		for _, file := range files[:count] {
-			fullpath := path.Clean(path.Join(f.SaveDir, file.Name()))
+	if len(files) > 0 {
+		for _, file := range files {
+			fullpath := path.Clean(path.Join(f.SaveDir, file))
 			err = os.Remove(fullpath)
 			if err != nil {
 				log.Error("Failed to remove file %s", fullpath)
@@ -99,16 +169,16 @@ func (f *FilesystemConfig) RemoveOlderBackups(keep int) error {
 
 // FindLatestBackup returns the most recent backup of the specified directory
 func (f *FilesystemConfig) FindLatestBackup() (string, error) {
-	files, err := ioutil.ReadDir(f.SaveDir)
+	objects, _, err := f.listBackups()
 	if err != nil {
-		return "", fmt.Errorf("cannot list contents of directory %s, %v", f.SaveDir, err)
+		return "", err
 	}
 
-	if len(files) == 0 {
+	if len(objects) == 0 {
 		return "", fmt.Errorf("cannot find a recent backup on %s", f.SaveDir)
 	}
 
-	return files[len(files)-1].Name(), nil
+	return objects[len(objects)-1].Key, nil
 }
 
 // Retrieve returns the path of the requested file
@@ -116,6 +186,45 @@ func (f *FilesystemConfig) Retrieve(filename string) (string, error) {
 	return path.Clean(path.Join(f.SaveDir, filename)), nil
 }
 
+// List returns the files under a directory of the store
+func (f *FilesystemConfig) List(prefix string) ([]string, error) {
+	root := path.Clean(f.SaveDir)
+	dir := path.Join(root, prefix)
+
+	var files []string
+
+	err := filepath.Walk(dir, func(fullpath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && fullpath == dir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			files = append(files, strings.TrimPrefix(fullpath, root+"/"))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot list contents of directory %s, %v", dir, err)
+	}
+
+	return files, nil
+}
+
+// Remove deletes a file of the store
+func (f *FilesystemConfig) Remove(filename string) error {
+	fullpath := path.Clean(path.Join(f.SaveDir, filename))
+
+	if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove file %s, %v", fullpath, err)
+	}
+
+	return nil
+}
+
 // Close deinitializes the store (no dothing)
 func (f *FilesystemConfig) Close() {
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -32,3 +33,99 @@ func TestStoreRestore(t *testing.T) {
 	err = fs.Store(filepath, "test.txt")
 	r.NoError(err, "failed to store file")
 }
+
+func TestStoreReplacesExistingFile(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	saveDir := path.Join(tmp, "store")
+	r.NoError(os.Mkdir(saveDir, 0755), "failed to create store directory")
+	r.NoError(ioutil.WriteFile(path.Join(saveDir, "test.txt"), []byte("old"), 0644), "failed to create stored file")
+
+	filepath := path.Join(tmp, "test.txt")
+	r.NoError(ioutil.WriteFile(filepath, []byte("new"), 0644), "failed to create backup file")
+
+	fs := FilesystemConfig{
+		SaveDir: saveDir,
+	}
+
+	r.NoError(fs.Store(filepath, "test.txt"), "failed to store file")
+
+	data, err := ioutil.ReadFile(path.Join(saveDir, "test.txt"))
+	r.NoError(err, "failed to read stored file")
+	r.Equal([]byte("new"), data, "the stored file must be replaced")
+
+	_, err = os.Stat(filepath)
+	r.True(os.IsNotExist(err), "the source file must be moved")
+}
+
+func TestBackupIndexes(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	for _, name := range []string{
+		"test-backup-20200101000000.tar",
+		"test-backup-20200101000000.tar" + IndexSuffix,
+		"test-backup-20200102000000.tar",
+		"test-backup-20200102000000.tar" + IndexSuffix,
+	} {
+		r.NoError(ioutil.WriteFile(path.Join(tmp, name), nil, 0644), "failed to create file")
+	}
+
+	fs := FilesystemConfig{
+		SaveDir: tmp,
+	}
+
+	latest, err := fs.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("test-backup-20200102000000.tar", latest, "indexes must not be taken as backups")
+
+	r.NoError(fs.RemoveOlderBackups(1), "failed to remove backups")
+
+	files, err := fs.List("")
+	r.NoError(err, "failed to list files")
+	r.Equal([]string{"test-backup-20200102000000.tar", "test-backup-20200102000000.tar" + IndexSuffix}, files, "indexes must be removed with their backup")
+}
+
+func TestArchivedBinlogs(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "archiver")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	r.NoError(os.Mkdir(path.Join(tmp, BinlogDir), 0755), "failed to create binlog directory")
+
+	for _, name := range []string{"backup-20200101000000.sql", "backup-20200102000000.sql", "binlogs/mysql-bin.000001", "binlogs/mysql-bin.000002"} {
+		r.NoError(ioutil.WriteFile(path.Join(tmp, name), nil, 0644), "failed to create file")
+	}
+
+	uploaded := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	r.NoError(os.Chtimes(path.Join(tmp, "binlogs/mysql-bin.000001"), uploaded, uploaded), "failed to change file time")
+
+	fs := FilesystemConfig{
+		SaveDir: tmp,
+	}
+
+	r.NoError(fs.RemoveOlderBackups(2), "failed to remove backups")
+
+	files, err := fs.List("")
+	r.NoError(err, "failed to list files")
+	r.Len(files, 4, "binlogs newer than the oldest dump must be kept")
+
+	latest, err := fs.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("backup-20200102000000.sql", latest, "the binlog directory must not be taken as a backup")
+
+	r.NoError(fs.RemoveOlderBackups(1), "failed to remove backups")
+
+	files, err = fs.List("")
+	r.NoError(err, "failed to list files")
+	r.Equal([]string{"backup-20200102000000.sql", "binlogs/mysql-bin.000002"}, files, "binlogs older than the kept dump must be removed")
+}
@@ -0,0 +1,624 @@
+package stores
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// GCSConfig has the config options of the Google Cloud Storage store. The
+// credentials are read from a service account key file, or from the metadata
+// server with workload identity when CredentialsFile is empty. ChunkSize is
+// the size of the resumable upload requests, a multiple of 256 KiB
+type GCSConfig struct {
+	Endpoint        string
+	Bucket          string
+	Prefix          string
+	KeepAfterUpload bool
+	SaveDir         string
+	CredentialsFile string
+	ChunkSize       int64
+	client          *http.Client
+	tokens          *gcsTokenSource
+	retrievedFiles  []string
+}
+
+// gcsEndpoint is the default endpoint of the JSON API
+var gcsEndpoint = "https://storage.googleapis.com"
+
+// gcsChunkAlignment is the granularity of resumable upload chunks
+var gcsChunkAlignment int64 = 256 << 10
+
+// DefaultGCSChunkSize is the chunk size used when none is configured
+var DefaultGCSChunkSize int64 = 8 << 20
+
+// gcsMaxRetries is the number of consecutive failures allowed on a chunk
+var gcsMaxRetries = 3
+
+// gcsRetryDelay is the time to wait before retrying a failed chunk
+var gcsRetryDelay = time.Second
+
+// statusResumeIncomplete is returned while a resumable upload is incomplete
+const statusResumeIncomplete = 308
+
+// gcsObject is the resource of an object returned by the JSON API
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+	ETag    string    `json:"etag"`
+	CRC32C  string    `json:"crc32c"`
+}
+
+func (o *gcsObject) size() int64 {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return size
+}
+
+// checksum returns the CRC32C of the object in the format of checksumMetadata
+func (o *gcsObject) checksum() string {
+	sum, err := base64.StdEncoding.DecodeString(o.CRC32C)
+	if err != nil || len(sum) == 0 {
+		return ""
+	}
+
+	return ChecksumCRC32C + ":" + hex.EncodeToString(sum)
+}
+
+func (g *GCSConfig) init() error {
+	if g.client != nil {
+		return nil
+	}
+
+	client := &http.Client{}
+
+	tokens, err := newGCSTokenSource(client, g.CredentialsFile)
+	if err != nil {
+		return err
+	}
+
+	g.client = client
+	g.tokens = tokens
+
+	return nil
+}
+
+func (g *GCSConfig) endpoint() string {
+	if g.Endpoint == "" {
+		return gcsEndpoint
+	}
+
+	return strings.TrimSuffix(g.Endpoint, "/")
+}
+
+func (g *GCSConfig) bucketURL() string {
+	return g.endpoint() + "/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o"
+}
+
+func (g *GCSConfig) objectURL(name string) string {
+	return g.bucketURL() + "/" + url.PathEscape(name)
+}
+
+func (g *GCSConfig) root() string {
+	root := path.Clean(g.Prefix)
+	if root == "." || root == "/" {
+		return ""
+	}
+
+	return root + "/"
+}
+
+func (g *GCSConfig) chunkSize() int64 {
+	size := g.ChunkSize
+	if size <= 0 {
+		size = DefaultGCSChunkSize
+	}
+
+	return (size + gcsChunkAlignment - 1) / gcsChunkAlignment * gcsChunkAlignment
+}
+
+// do sends an authenticated request
+func (g *GCSConfig) do(req *http.Request) (*http.Response, error) {
+	if err := g.init(); err != nil {
+		return nil, err
+	}
+
+	token, err := g.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return g.client.Do(req)
+}
+
+// doJSON sends a request and decodes the response into out, if set
+func (g *GCSConfig) doJSON(req *http.Request, out interface{}) error {
+	res, err := g.do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return gcsError(res)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// gcsError returns the error message of a failed response
+func gcsError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(res.Body)
+
+	var message struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if json.Unmarshal(body, &message) == nil && message.Error.Message != "" {
+		return fmt.Errorf("%s: %s", res.Status, message.Error.Message)
+	}
+
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+}
+
+// Store uploads a file to GCS with a resumable upload
+func (g *GCSConfig) Store(filepath string, filename string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	if !g.KeepAfterUpload {
+		defer func() {
+			if err := os.Remove(filepath); err != nil {
+				log.Warn("Cannot remove file %s", filepath)
+			}
+		}()
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
+
+	checksum, err := fileChecksum(ChecksumCRC32C, f)
+	if err != nil {
+		return fmt.Errorf("cannot compute checksum, %v", err)
+	}
+
+	sum, _ := hex.DecodeString(strings.TrimPrefix(checksum, ChecksumCRC32C+":"))
+	name := g.root() + filename
+
+	session, err := g.startUpload(name, info.Size(), base64.StdEncoding.EncodeToString(sum))
+	if err != nil {
+		return fmt.Errorf("failed to start upload, %v", err)
+	}
+
+	obj, err := g.upload(session, f, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to upload file, %v", err)
+	}
+
+	// the server rejects mismatching checksums, this also checks the response
+	if obj.size() != info.Size() || obj.checksum() != checksum {
+		return fmt.Errorf("uploaded object has %d bytes and checksum %s, expected %d and %s",
+			obj.size(), obj.checksum(), info.Size(), checksum)
+	}
+
+	log.Trace("File uploaded to gs://%s/%s", g.Bucket, name)
+
+	return nil
+}
+
+// startUpload creates a resumable upload and returns its session URI
+func (g *GCSConfig) startUpload(name string, size int64, crc32c string) (string, error) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"name":        name,
+		"contentType": contentType,
+		"crc32c":      crc32c,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		g.endpoint()+"/upload/storage/v1/b/"+url.PathEscape(g.Bucket)+"/o?uploadType=resumable", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := g.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", gcsError(res)
+	}
+
+	session := res.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("no session URI returned")
+	}
+
+	return session, nil
+}
+
+// upload sends the file in chunks to a resumable upload session, failed
+// chunks are resumed from the last byte confirmed by the server
+func (g *GCSConfig) upload(session string, f io.ReaderAt, size int64) (*gcsObject, error) {
+	chunkSize := g.chunkSize()
+	offset := int64(0)
+	failures := 0
+
+	for {
+		end := offset + chunkSize
+		if end > size {
+			end = size
+		}
+
+		var contentRange string
+		if size == 0 {
+			contentRange = "bytes */0"
+		} else {
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size)
+		}
+
+		obj, next, err := g.putChunk(session, io.NewSectionReader(f, offset, end-offset), end-offset, contentRange)
+		if err == nil {
+			if obj != nil {
+				return obj, nil
+			}
+
+			offset = next
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures > gcsMaxRetries {
+			return nil, err
+		}
+
+		log.Warn("Upload of chunk at %d failed, retrying: %v", offset, err)
+		time.Sleep(gcsRetryDelay)
+
+		// ask the server how much it received
+		obj, next, serr := g.putChunk(session, nil, 0, fmt.Sprintf("bytes */%d", size))
+		if serr != nil {
+			continue
+		} else if obj != nil {
+			return obj, nil
+		}
+
+		offset = next
+	}
+}
+
+// putChunk sends a chunk of a resumable upload, it returns the object when
+// the upload is complete or the offset of the next chunk
+func (g *GCSConfig) putChunk(session string, body io.Reader, length int64, contentRange string) (*gcsObject, int64, error) {
+	req, err := http.NewRequest(http.MethodPut, session, body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.ContentLength = length
+
+	req.Header.Set("Content-Range", contentRange)
+
+	res, err := g.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var obj gcsObject
+		if err = json.NewDecoder(res.Body).Decode(&obj); err != nil {
+			return nil, 0, fmt.Errorf("cannot parse uploaded object, %v", err)
+		}
+
+		return &obj, 0, nil
+	case statusResumeIncomplete:
+		// the range is missing when nothing was received
+		received := res.Header.Get("Range")
+		if received == "" {
+			return nil, 0, nil
+		}
+
+		var last int64
+		if _, err = fmt.Sscanf(received, "bytes=0-%d", &last); err != nil {
+			return nil, 0, fmt.Errorf("invalid range %s", received)
+		}
+
+		return nil, last + 1, nil
+	default:
+		return nil, 0, gcsError(res)
+	}
+}
+
+// getObject returns the resource of an object
+func (g *GCSConfig) getObject(name string) (*gcsObject, error) {
+	req, err := http.NewRequest(http.MethodGet, g.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj gcsObject
+	if err = g.doJSON(req, &obj); err != nil {
+		return nil, fmt.Errorf("failed to read GCS object, %v", err)
+	}
+
+	return &obj, nil
+}
+
+// openObject returns a reader of the contents of an object
+func (g *GCSConfig) openObject(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, g.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := g.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download GCS object, %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, fmt.Errorf("failed to download GCS object, %v", gcsError(res))
+	}
+
+	return res.Body, nil
+}
+
+// Retrieve downloads a GCS object to the local filesystem
+func (g *GCSConfig) Retrieve(name string) (string, error) {
+	obj, err := g.getObject(name)
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkFreeSpace(g.SaveDir, obj.size()); err != nil {
+		return "", err
+	}
+
+	filepath, err := downloadFile(g.SaveDir, path.Base(name), func(f *os.File) error {
+		body, err := g.openObject(name)
+		if err != nil {
+			return err
+		}
+
+		defer body.Close()
+
+		if _, err = io.Copy(f, body); err != nil {
+			return fmt.Errorf("failed to download GCS object, %v", err)
+		}
+
+		if err = verifyDownload(f, obj.size(), obj.checksum()); err != nil {
+			return fmt.Errorf("GCS object %s is corrupted, %v", name, err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Trace("File downloaded to %s", filepath)
+	g.retrievedFiles = append(g.retrievedFiles, filepath)
+
+	return filepath, nil
+}
+
+// Stream returns a reader of a GCS object, its size and checksum are
+// verified when the end of the object is read
+func (g *GCSConfig) Stream(name string) (io.ReadCloser, error) {
+	obj, err := g.getObject(name)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := g.openObject(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVerifyingReader(body, name, obj.size(), obj.checksum())
+}
+
+// listObjects returns the objects under a prefix of the bucket
+func (g *GCSConfig) listObjects(prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+	pageToken := ""
+
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, g.bucketURL()+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+
+		if err = g.doJSON(req, &page); err != nil {
+			return nil, fmt.Errorf("couldn't list GCS objects, %v", err)
+		}
+
+		for _, obj := range page.Items {
+			if strings.HasSuffix(obj.Name, "/") {
+				continue
+			}
+
+			objects = append(objects, remoteObject{
+				Key:          obj.Name,
+				LastModified: obj.Updated,
+				Size:         obj.size(),
+				ETag:         obj.ETag,
+			})
+		}
+
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+
+		pageToken = page.NextPageToken
+	}
+}
+
+func (g *GCSConfig) deleteObject(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, g.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+
+	return g.doJSON(req, nil)
+}
+
+// RemoveOlderBackups keeps the most recent backups of the GCS store and deletes the old ones
+// along with the binlogs they don't need
+func (g *GCSConfig) RemoveOlderBackups(keep int) error {
+	objects, err := g.listObjects(g.root())
+	if err != nil {
+		return err
+	}
+
+	binlogs, err := g.listObjects(g.root() + BinlogDir + "/")
+	if err != nil {
+		return err
+	}
+
+	objects, indexes := splitIndexes(withoutBinlogs(g.root(), objects))
+	sortBackups(objects)
+
+	count := len(objects) - keep
+	if count < 0 {
+		count = 0
+	}
+
+	var keys []string
+	for _, obj := range objects[:count] {
+		keys = append(keys, obj.Key)
+	}
+
+	keys = append(withIndexes(keys, indexes), expiredBinlogs(binlogs, objects[count:])...)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var failed []string
+	for _, key := range keys {
+		log.Trace("Deleting gs://%s/%s", g.Bucket, key)
+
+		if err = g.deleteObject(key); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	log.Trace("Deleted %d objects from GCS", len(keys)-len(failed))
+
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't delete %d GCS objects, %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the GCS store
+func (g *GCSConfig) FindLatestBackup() (string, error) {
+	objects, err := g.listObjects(g.root())
+	if err != nil {
+		return "", err
+	}
+
+	objects, _ = splitIndexes(withoutBinlogs(g.root(), objects))
+	if len(objects) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on gs://%s/%s", g.Bucket, g.Prefix)
+	}
+
+	sortBackups(objects)
+
+	return objects[len(objects)-1].Key, nil
+}
+
+// List returns the objects under a prefix of the store
+func (g *GCSConfig) List(prefix string) ([]string, error) {
+	root := g.root()
+
+	objects, err := g.listObjects(root + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, obj := range objects {
+		files = append(files, strings.TrimPrefix(obj.Key, root))
+	}
+
+	return files, nil
+}
+
+// Remove deletes an object of the store
+func (g *GCSConfig) Remove(filename string) error {
+	if err := g.deleteObject(g.root() + filename); err != nil {
+		return fmt.Errorf("couldn't delete the GCS object %s, %v", filename, err)
+	}
+
+	return nil
+}
+
+// Close removes the downloaded files
+func (g *GCSConfig) Close() {
+	for _, file := range g.retrievedFiles {
+		removeDownloaded(file)
+	}
+
+	g.retrievedFiles = nil
+}
@@ -0,0 +1,181 @@
+package stores
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newGCSTest returns a fake server and a store using a service account key
+func newGCSTest(t *testing.T, tmp string) (*fakeGCS, *GCSConfig) {
+	r := require.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	r.NoError(err, "failed to generate key")
+
+	server := newFakeGCS("backups", &key.PublicKey)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	r.NoError(err, "failed to encode key")
+
+	account, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "backups@project.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      server.URL + "/token",
+	})
+	r.NoError(err, "failed to encode service account")
+
+	credentials := path.Join(tmp, "credentials.json")
+	r.NoError(ioutil.WriteFile(credentials, account, 0600), "failed to write credentials")
+
+	return server, &GCSConfig{
+		Endpoint:        server.URL,
+		Bucket:          "backups",
+		SaveDir:         tmp,
+		CredentialsFile: credentials,
+	}
+}
+
+func TestGCSStoreRetrieve(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "gcs")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server, g := newGCSTest(t, tmp)
+	defer server.Close()
+
+	g.Prefix = "mysql"
+
+	for _, name := range []string{"mysql-backup-20200101000000.sql", "mysql-backup-20200102000000.sql", "mysql-backup-20200103000000.sql"} {
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(g.Store(filepath, name), "failed to store file")
+
+		_, err = os.Stat(filepath)
+		r.True(os.IsNotExist(err), "the source file must be removed")
+	}
+
+	r.Equal(1, server.tokens, "the token must be reused")
+
+	latest, err := g.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("mysql/mysql-backup-20200103000000.sql", latest)
+
+	retrieved, err := g.Retrieve(latest)
+	r.NoError(err, "failed to retrieve file")
+
+	data, err := ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read retrieved file")
+	r.Equal([]byte("mysql-backup-20200103000000.sql"), data)
+
+	g.Close()
+	r.Empty(retrievedDirs(t, tmp), "the retrieved files must be removed")
+
+	r.NoError(g.RemoveOlderBackups(1), "failed to remove backups")
+
+	files, err := g.List("")
+	r.NoError(err, "failed to list objects")
+	r.Equal([]string{"mysql-backup-20200103000000.sql"}, files)
+
+	// corrupted objects fail to download
+	server.object(latest).data = []byte("corrupted")
+
+	_, err = g.Retrieve(latest)
+	r.Error(err, "corrupted objects must fail")
+	r.Empty(retrievedDirs(t, tmp), "nothing must be left on failure")
+
+	reader, err := g.Stream(latest)
+	r.NoError(err, "failed to stream object")
+
+	_, err = ioutil.ReadAll(reader)
+	r.Error(err, "corrupted streams must fail")
+	reader.Close()
+
+	r.NoError(g.Remove("mysql-backup-20200103000000.sql"), "failed to remove object")
+
+	_, err = g.FindLatestBackup()
+	r.Error(err, "no backups must be found")
+}
+
+func TestGCSResumableUpload(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "gcs")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server, g := newGCSTest(t, tmp)
+	defer server.Close()
+
+	retryDelay := gcsRetryDelay
+	gcsRetryDelay = 0
+	defer func() { gcsRetryDelay = retryDelay }()
+
+	g.ChunkSize = 100 << 10
+	r.Equal(gcsChunkAlignment, g.chunkSize(), "chunks must be aligned")
+
+	data := make([]byte, 3*gcsChunkAlignment+1000)
+	mrand.New(mrand.NewSource(1)).Read(data)
+
+	filepath := path.Join(tmp, "backup.tar")
+	r.NoError(ioutil.WriteFile(filepath, data, 0644), "failed to create file")
+
+	// the second chunk fails after half of it is received
+	server.failChunk = 2
+	r.NoError(g.Store(filepath, "backup.tar"), "failed to resume upload")
+	r.True(bytes.Equal(data, server.object("backup.tar").data), "contents mismatch")
+	r.Equal(4, server.chunks, "the upload must resume from the received half")
+
+	filepath = path.Join(tmp, "empty.tar")
+	r.NoError(ioutil.WriteFile(filepath, nil, 0644), "failed to create file")
+	r.NoError(g.Store(filepath, "empty.tar"), "failed to store empty file")
+	r.Empty(server.object("empty.tar").data)
+}
+
+func TestGCSCredentials(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "gcs")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server, g := newGCSTest(t, tmp)
+	defer server.Close()
+
+	// workload identity uses the metadata server
+	host := os.Getenv("GCE_METADATA_HOST")
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer os.Setenv("GCE_METADATA_HOST", host)
+
+	g.CredentialsFile = ""
+
+	_, err = g.List("")
+	r.NoError(err, "failed to list with workload identity")
+	r.Equal(1, server.tokens)
+
+	g = &GCSConfig{CredentialsFile: path.Join(tmp, "missing.json")}
+	_, err = g.List("")
+	r.Error(err, "missing credentials must fail")
+
+	invalid := path.Join(tmp, "user.json")
+	r.NoError(ioutil.WriteFile(invalid, []byte(`{"type":"authorized_user"}`), 0600), "failed to write credentials")
+
+	g = &GCSConfig{CredentialsFile: invalid}
+	_, err = g.List("")
+	r.Error(err, "unsupported credentials must fail")
+}
@@ -0,0 +1,223 @@
+package stores
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsScope is the OAuth2 scope needed to read and write objects
+var gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsTokenURI is used when the service account file doesn't have one
+var gcsTokenURI = "https://oauth2.googleapis.com/token"
+
+// gcsMetadataHost serves the tokens of the attached service account on GCE
+// and GKE workload identity, GCE_METADATA_HOST overrides it
+var gcsMetadataHost = "metadata.google.internal"
+
+// gcsTokenExpiryDelta renews the tokens before they expire
+var gcsTokenExpiryDelta = time.Minute
+
+// gcsServiceAccount has the fields used of a service account key file
+type gcsServiceAccount struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcsToken is an access token returned by the token endpoints
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// gcsTokenSource returns access tokens, they are reused until they expire
+type gcsTokenSource struct {
+	client  *http.Client
+	account *gcsServiceAccount
+	key     *rsa.PrivateKey
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+}
+
+// newGCSTokenSource returns a source of tokens of a service account key
+// file, or of the metadata server when the file is empty
+func newGCSTokenSource(client *http.Client, credentialsFile string) (*gcsTokenSource, error) {
+	source := &gcsTokenSource{client: client}
+
+	if credentialsFile == "" {
+		return source, nil
+	}
+
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read credentials file, %v", err)
+	}
+
+	var account gcsServiceAccount
+	if err = json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("cannot parse credentials file, %v", err)
+	}
+
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("unsupported credentials type: %s", account.Type)
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no private key found on credentials file")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("cannot parse private key, %v", err)
+		}
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key is not a RSA key")
+	}
+
+	if account.TokenURI == "" {
+		account.TokenURI = gcsTokenURI
+	}
+
+	source.account = &account
+	source.key = key
+
+	return source, nil
+}
+
+// Token returns a valid access token
+func (s *gcsTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+
+	var token *gcsToken
+	var err error
+
+	if s.account != nil {
+		token, err = s.serviceAccountToken()
+	} else {
+		token, err = s.metadataToken()
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - gcsTokenExpiryDelta)
+
+	return s.token, nil
+}
+
+// serviceAccountToken exchanges a signed JWT for an access token
+func (s *gcsTokenSource) serviceAccountToken() (*gcsToken, error) {
+	now := time.Now()
+
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.account.PrivateKeyID,
+	})
+
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign token request, %v", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + encoding.EncodeToString(signature)},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return s.fetch(req)
+}
+
+// metadataToken returns a token of the service account attached to the
+// instance or the Kubernetes service account with workload identity
+func (s *gcsTokenSource) metadataToken() (*gcsToken, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = gcsMetadataHost
+	}
+
+	req, err := http.NewRequest(http.MethodGet,
+		"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	return s.fetch(req)
+}
+
+func (s *gcsTokenSource) fetch(req *http.Request) (*gcsToken, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get access token, %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("cannot get access token, %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token gcsToken
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("cannot parse access token, %v", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("empty access token")
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,188 @@
+package stores
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// MultiTarget is a store of a MultiConfig, Keep overrides the number of
+// backups kept on it when set
+type MultiTarget struct {
+	Name  string
+	Store Storer
+	Keep  int
+}
+
+// MultiConfig stores each backup on several stores. Store succeeds when at
+// least MinSuccess stores succeed, or all of them when MinSuccess is 0.
+// Restores use the first store that has the backup
+type MultiConfig struct {
+	Targets    []MultiTarget
+	MinSuccess int
+	stored     map[string]bool
+}
+
+func (m *MultiConfig) required() int {
+	if m.MinSuccess <= 0 || m.MinSuccess > len(m.Targets) {
+		return len(m.Targets)
+	}
+
+	return m.MinSuccess
+}
+
+// Store uploads a file to every store, each one receives its own link to
+// the file so stores removing it after the upload don't affect the others.
+// The file is removed once the last store finishes
+func (m *MultiConfig) Store(filepath string, filename string) error {
+	if len(m.Targets) == 0 {
+		return fmt.Errorf("no stores configured")
+	}
+
+	m.stored = make(map[string]bool)
+	keepFile := false
+
+	var failed []string
+	for _, t := range m.Targets {
+		// the filesystem store keeps the file when it is already on its directory
+		if fs, ok := t.Store.(*FilesystemConfig); ok && fs.destination(filename) == path.Clean(filepath) {
+			keepFile = true
+			m.stored[t.Name] = true
+			continue
+		}
+
+		if err := storeLink(t.Store, filepath, filename); err != nil {
+			log.Warn("Couldn't store %s on %s: %v", filename, t.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+			continue
+		}
+
+		log.Trace("Stored %s on %s", filename, t.Name)
+		m.stored[t.Name] = true
+	}
+
+	if !keepFile {
+		if err := os.Remove(filepath); err != nil {
+			log.Warn("Cannot remove file %s", filepath)
+		}
+	}
+
+	if len(m.stored) < m.required() {
+		return fmt.Errorf("stored on %d of %d stores, %d required, %s",
+			len(m.stored), len(m.Targets), m.required(), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// storeLink stores a hard link to a file, or a copy when links aren't
+// supported, and removes it if the store keeps it
+func storeLink(store Storer, filepath string, filename string) error {
+	dir, err := ioutil.TempDir(path.Dir(filepath), "store-")
+	if err != nil {
+		return fmt.Errorf("cannot create temp directory, %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	link := path.Join(dir, path.Base(filepath))
+	if err = os.Link(filepath, link); err != nil {
+		if err = copyFile(filepath, link); err != nil {
+			return fmt.Errorf("cannot copy file, %v", err)
+		}
+	}
+
+	return store.Store(link, filename)
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// RemoveOlderBackups applies the retention of each store, stores that failed
+// the last upload are skipped so their previous backups are kept
+func (m *MultiConfig) RemoveOlderBackups(keep int) error {
+	var failed []string
+	for _, t := range m.Targets {
+		if m.stored != nil && !m.stored[t.Name] {
+			log.Warn("Keeping the old backups of %s, the last upload failed", t.Name)
+			continue
+		}
+
+		n := keep
+		if t.Keep > 0 {
+			n = t.Keep
+		}
+
+		if err := t.Store.RemoveOlderBackups(n); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't remove old backups from %d stores, %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the first available store
+func (m *MultiConfig) FindLatestBackup() (string, error) {
+	var failed []string
+	for _, t := range m.Targets {
+		latest, err := t.Store.FindLatestBackup()
+		if err == nil {
+			return latest, nil
+		}
+
+		log.Warn("Cannot find the latest backup on %s: %v", t.Name, err)
+		failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+	}
+
+	return "", fmt.Errorf("cannot find a recent backup, %s", strings.Join(failed, "; "))
+}
+
+// Retrieve downloads a file from the first store that has it
+func (m *MultiConfig) Retrieve(filename string) (string, error) {
+	var failed []string
+	for _, t := range m.Targets {
+		filepath, err := t.Store.Retrieve(filename)
+		if err == nil {
+			return filepath, nil
+		}
+
+		log.Warn("Cannot retrieve %s from %s: %v", filename, t.Name, err)
+		failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+	}
+
+	return "", fmt.Errorf("cannot retrieve %s, %s", filename, strings.Join(failed, "; "))
+}
+
+// Close deinitializes every store
+func (m *MultiConfig) Close() {
+	for _, t := range m.Targets {
+		t.Store.Close()
+	}
+}
@@ -0,0 +1,152 @@
+package stores
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// brokenStore fails every operation
+type brokenStore struct {
+	closed bool
+}
+
+func (b *brokenStore) Store(filepath string, filename string) error {
+	return fmt.Errorf("store is down")
+}
+
+func (b *brokenStore) Retrieve(filename string) (string, error) {
+	return "", fmt.Errorf("store is down")
+}
+
+func (b *brokenStore) RemoveOlderBackups(keep int) error {
+	return fmt.Errorf("store is down")
+}
+
+func (b *brokenStore) FindLatestBackup() (string, error) {
+	return "", fmt.Errorf("store is down")
+}
+
+func (b *brokenStore) Close() {
+	b.closed = true
+}
+
+func writeBackup(t *testing.T, dir string, name string) string {
+	filepath := path.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+	return filepath
+}
+
+func TestMultiStore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "multi")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeAzure("backups")
+	defer server.Close()
+
+	fs := &FilesystemConfig{SaveDir: path.Join(tmp, "fs")}
+	azure := &AzureConfig{
+		Endpoint:    server.endpoint(),
+		Container:   "backups",
+		SaveDir:     tmp,
+		Credentials: AzureCredentials{AccountName: server.account, AccountKey: server.key},
+	}
+
+	m := &MultiConfig{Targets: []MultiTarget{
+		{Name: "filesystem", Store: fs, Keep: 1},
+		{Name: "azure", Store: azure},
+	}}
+
+	for _, name := range []string{"backup-20200101000000.sql", "backup-20200102000000.sql", "backup-20200103000000.sql"} {
+		filepath := writeBackup(t, tmp, name)
+		r.NoError(m.Store(filepath, name), "failed to store file")
+		r.NoError(m.RemoveOlderBackups(2), "failed to remove old backups")
+
+		_, err = os.Stat(filepath)
+		r.True(os.IsNotExist(err), "the file must be removed after the last store")
+	}
+
+	files, err := fs.List("")
+	r.NoError(err, "failed to list files")
+	r.Equal([]string{"backup-20200103000000.sql"}, files, "the retention of the store must be used")
+
+	files, err = azure.List("")
+	r.NoError(err, "failed to list blobs")
+	r.Equal([]string{"backup-20200102000000.sql", "backup-20200103000000.sql"}, files)
+
+	entries, err := ioutil.ReadDir(tmp)
+	r.NoError(err, "failed to list directory")
+
+	for _, entry := range entries {
+		r.False(strings.HasPrefix(entry.Name(), "store-"), "the links must be removed")
+	}
+
+	// the file is kept when a filesystem store saves it on the same directory
+	local := &MultiConfig{Targets: []MultiTarget{
+		{Name: "filesystem", Store: &FilesystemConfig{SaveDir: tmp}},
+		{Name: "azure", Store: azure},
+	}}
+
+	filepath := writeBackup(t, tmp, "backup-20200104000000.sql")
+	r.NoError(local.Store(filepath, "backup-20200104000000.sql"), "failed to store file")
+	r.FileExists(filepath)
+
+	latest, err := m.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("backup-20200103000000.sql", latest)
+}
+
+func TestMultiStorePolicy(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "multi")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	broken := &brokenStore{}
+	fs := &FilesystemConfig{SaveDir: path.Join(tmp, "fs")}
+
+	m := &MultiConfig{Targets: []MultiTarget{
+		{Name: "broken", Store: broken},
+		{Name: "filesystem", Store: fs},
+	}}
+
+	filepath := writeBackup(t, tmp, "backup-20200101000000.sql")
+	err = m.Store(filepath, "backup-20200101000000.sql")
+	r.Error(err, "every store must succeed by default")
+	r.Contains(err.Error(), "broken: store is down")
+
+	_, err = os.Stat(filepath)
+	r.True(os.IsNotExist(err), "the file must be removed after the last store")
+
+	m.MinSuccess = 1
+	filepath = writeBackup(t, tmp, "backup-20200102000000.sql")
+	r.NoError(m.Store(filepath, "backup-20200102000000.sql"), "one store is enough")
+
+	// the failed store keeps its old backups
+	r.NoError(m.RemoveOlderBackups(1), "failed to remove old backups")
+
+	files, err := fs.List("")
+	r.NoError(err, "failed to list files")
+	r.Equal([]string{"backup-20200102000000.sql"}, files)
+
+	// restores fall back to the next store
+	latest, err := m.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("backup-20200102000000.sql", latest)
+
+	retrieved, err := m.Retrieve(latest)
+	r.NoError(err, "failed to retrieve file")
+	r.Equal(path.Join(fs.SaveDir, latest), retrieved)
+
+	m.Close()
+	r.True(broken.closed, "every store must be closed")
+}
@@ -0,0 +1,70 @@
+package stores
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// partialSuffix is added to the files being downloaded
+var partialSuffix = ".partial"
+
+// checkFreeSpace fails when a directory doesn't have room for a file
+func checkFreeSpace(dir string, size int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Trace("Cannot check free space on %s, %v", dir, err)
+		return nil
+	}
+
+	if free < size {
+		return fmt.Errorf("not enough free space on %s, %d bytes needed and %d available", dir, size, free)
+	}
+
+	return nil
+}
+
+// downloadFile saves a file with the given name on a new directory under
+// dir, so existing files are never overwritten. The file has a partial suffix
+// until download succeeds and is removed when it fails
+func downloadFile(dir string, name string, download func(f *os.File) error) (string, error) {
+	tmp, err := ioutil.TempDir(dir, "retrieve-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+
+	partial := path.Join(tmp, name+partialSuffix)
+	f, err := os.Create(partial)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+
+	err = download(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to close file: %v", cerr)
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	filepath := path.Join(tmp, name)
+	if err = os.Rename(partial, filepath); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("failed to rename file: %v", err)
+	}
+
+	return filepath, nil
+}
+
+// removeDownloaded removes a file saved by downloadFile and its directory
+func removeDownloaded(filepath string) {
+	if err := os.RemoveAll(path.Dir(filepath)); err != nil {
+		log.Warn("Cannot remove file %s", filepath)
+	}
+}
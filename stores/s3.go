@@ -1,11 +1,15 @@
 package stores
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io"
+	"mime"
+	"net/url"
 	"os"
 	"path"
-	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -14,31 +18,132 @@ import (
 	log "unknwon.dev/clog/v2"
 )
 
-// S3Config has the config options for the S3 service
+// S3Config has the config options for the S3 service. ServerSideEncryption
+// is AES256 or aws:kms and SSECustomerKey a base64 encoded 256-bit key for SSE-C
 type S3Config struct {
-	Endpoint        string
-	Region          string
-	Bucket          string
-	Prefix          string
-	ForcePathStyle  bool
-	KeepAfterUpload bool
-	SaveDir         string
-	retrievedFile   string
+	Endpoint             string
+	Region               string
+	Bucket               string
+	Prefix               string
+	ForcePathStyle       bool
+	KeepAfterUpload      bool
+	SaveDir              string
+	ServerSideEncryption string
+	KMSKeyID             string
+	SSECustomerKey       string
+	StorageClass         string
+	Tags                 map[string]string
+	Metadata             map[string]string
+	ContentType          string
+	Credentials          S3Credentials
+	Transport            S3Transport
+	Upload               S3Upload
+	Checksum             string
+	Lock                 S3Lock
+	DeleteVersions       bool
+	session              *session.Session
+	retrievedFiles       []string
 }
 
-func (s *S3Config) newSession() *session.Session {
-	config := &aws.Config{
-		Endpoint:         aws.String(s.Endpoint),
-		Region:           aws.String(s.Region),
-		S3ForcePathStyle: aws.Bool(s.ForcePathStyle),
+// sseCustomerAlgorithm is the only algorithm supported by SSE-C
+var sseCustomerAlgorithm = "AES256"
+
+// defaultContentType is used when the type can't be guessed from the file extension
+var defaultContentType = "application/octet-stream"
+
+// customerKey returns the decoded SSE-C key, or an empty string if not set
+func (s *S3Config) customerKey() (string, error) {
+	if s.SSECustomerKey == "" {
+		return "", nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(s.SSECustomerKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid SSE-C key, %v", err)
 	}
 
-	return session.Must(session.NewSession(config))
+	if len(key) != 32 {
+		return "", fmt.Errorf("invalid SSE-C key, expected 32 bytes and got %d", len(key))
+	}
+
+	return string(key), nil
+}
+
+// newUploadInput returns the upload parameters of an object
+func (s *S3Config) newUploadInput(key string) (*s3manager.UploadInput, error) {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+
+	switch s.ServerSideEncryption {
+	case "":
+	case s3.ServerSideEncryptionAes256:
+		input.ServerSideEncryption = aws.String(s.ServerSideEncryption)
+	case s3.ServerSideEncryptionAwsKms:
+		input.ServerSideEncryption = aws.String(s.ServerSideEncryption)
+		if s.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.KMSKeyID)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported server side encryption: %s", s.ServerSideEncryption)
+	}
+
+	customerKey, err := s.customerKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if customerKey != "" {
+		if s.ServerSideEncryption != "" {
+			return nil, fmt.Errorf("SSE-C can't be combined with server side encryption")
+		}
+
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(customerKey)
+	}
+
+	if s.StorageClass != "" {
+		input.StorageClass = aws.String(s.StorageClass)
+	}
+
+	if len(s.Tags) > 0 {
+		tags := url.Values{}
+		for name, value := range s.Tags {
+			tags.Set(name, value)
+		}
+
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if len(s.Metadata) > 0 {
+		input.Metadata = aws.StringMap(s.Metadata)
+	}
+
+	contentType := s.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	input.ContentType = aws.String(contentType)
+
+	if err = s.Lock.apply(input, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return input, nil
 }
 
 // Store saves a file to a remote S3 service
 func (s *S3Config) Store(filepath string, filename string) error {
-	uploader := s3manager.NewUploader(s.newSession())
+	sess, err := s.newSession()
+	if err != nil {
+		return err
+	}
 
 	f, err := os.Open(filepath)
 	if err != nil {
@@ -58,73 +163,126 @@ func (s *S3Config) Store(filepath string, filename string) error {
 
 	key := path.Clean(path.Join(s.Prefix, filename))
 
-	// Upload the file to S3.
-	res, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(key),
-		Body:   f,
-	})
+	input, err := s.newUploadInput(key)
 	if err != nil {
-		return fmt.Errorf("failed to upload file, %v", err)
+		return err
 	}
 
-	log.Trace("File uploaded to %s\n", res.Location)
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
 
-	return nil
-}
+	svc := s3.New(sess)
+	partSize := s.Upload.partSize(info.Size())
 
-func (s *S3Config) getFileListing(svc *s3.S3) ([]string, error) {
-	var files []string
+	// the metadata is sent when the upload starts, so the checksum is
+	// computed beforehand, along with the ETag
+	checksum, etag, err := uploadSums(f, s.checksum(), info.Size(), partSize, s.etagVerified())
+	if err != nil {
+		return fmt.Errorf("cannot compute checksum, %v", err)
+	}
 
-	err := svc.ListObjectsPages(&s3.ListObjectsInput{
-		Bucket: aws.String(s.Bucket),
-		// make sure that the prefix ends with "/"
-		Prefix: aws.String(path.Clean(s.Prefix) + "/"),
-	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
+	if checksum != "" {
+		if input.Metadata == nil {
+			input.Metadata = make(map[string]*string)
+		}
 
-		for _, obj := range p.Contents {
-			if !strings.HasSuffix(*obj.Key, "/") {
-				files = append(files, aws.StringValue(obj.Key))
-			}
+		input.Metadata[checksumMetadata] = aws.String(checksum)
+	}
+
+	// only multipart uploads can be resumed
+	if s.Upload.Resume && info.Size() > partSize {
+		if err = s.resumableUpload(svc, f, input); err != nil {
+			return fmt.Errorf("failed to upload file, %v", err)
 		}
-		return true
-	})
+	} else {
+		uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+			u.PartSize = partSize
+			u.Concurrency = s.Upload.concurrency()
+		})
+
+		input.Body = f
+
+		// Upload the file to S3.
+		if _, err = uploader.Upload(input); err != nil {
+			return fmt.Errorf("failed to upload file, %v", err)
+		}
+	}
+
+	if err = s.verifyUpload(svc, key, info.Size(), etag, checksum); err != nil {
+		return fmt.Errorf("failed to verify upload, %v", err)
+	}
+
+	log.Trace("File uploaded to s3://%s/%s", s.Bucket, key)
 
-	return files, err
+	return nil
+}
+
+// listBackups returns the objects of the store from the oldest to the newest
+// backup and the keys of their indexes, archived binlogs are skipped
+func (s *S3Config) listBackups(svc *s3.S3) ([]remoteObject, map[string]bool, error) {
+	objects, err := s.listObjects(svc, s.root())
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't list S3 objects, %v", err)
+	}
+
+	objects, indexes := splitIndexes(withoutBinlogs(s.root(), objects))
+	sortBackups(objects)
+
+	return objects, indexes, nil
 }
 
 // RemoveOlderBackups keeps the most recent backups of the S3 service and deletes the old ones
+// along with the binlogs they don't need
 func (s *S3Config) RemoveOlderBackups(keep int) error {
-	svc := s3.New(s.newSession())
+	svc, err := s.newClient()
+	if err != nil {
+		return err
+	}
 
-	files, err := s.getFileListing(svc)
+	objects, indexes, err := s.listBackups(svc)
 	if err != nil {
-		return fmt.Errorf("couldn't list S3 objects, %v", err)
+		return err
 	}
 
-	sort.Strings(files)
-	count := len(files) - keep
+	binlogs, err := s.listObjects(svc, s.root()+BinlogDir+"/")
+	if err != nil {
+		return fmt.Errorf("couldn't list S3 binlogs, %v", err)
+	}
 
-	if count > 0 {
-		var items s3.Delete
-		var objs = make([]*s3.ObjectIdentifier, count)
+	count := len(objects) - keep
+	if count < 0 {
+		count = 0
+	}
 
-		for i, file := range files[:count] {
-			objs[i] = &s3.ObjectIdentifier{Key: aws.String(file)}
-			log.Trace("Marked to delete: s3://%s/%s", s.Bucket, file)
-		}
+	var files []string
+	for _, obj := range objects[:count] {
+		files = append(files, obj.Key)
+	}
+
+	files = append(withIndexes(files, indexes), expiredBinlogs(binlogs, objects[count:])...)
 
-		items.SetObjects(objs)
+	if len(files) > 0 {
+		locked := s.lockedObjects(svc, files)
 
-		out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
-			Bucket: aws.String(s.Bucket),
-			Delete: &items})
+		var keys []string
+		for _, file := range files {
+			if locked[file] {
+				continue
+			}
 
-		if err != nil {
-			return fmt.Errorf("couldn't delete the S3 objects, %v", err)
+			keys = append(keys, file)
+			log.Trace("Marked to delete: s3://%s/%s", s.Bucket, file)
 		}
 
-		log.Trace("Deleted %d objects from S3", len(out.Deleted))
+		if len(locked) > 0 {
+			log.Warn("Skipped %d locked objects on S3", len(locked))
+		}
+
+		if err = s.deleteKeys(svc, keys); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -132,59 +290,165 @@ func (s *S3Config) RemoveOlderBackups(keep int) error {
 
 // FindLatestBackup returns the most recent backup of the S3 store
 func (s *S3Config) FindLatestBackup() (string, error) {
-	svc := s3.New(s.newSession())
+	svc, err := s.newClient()
+	if err != nil {
+		return "", err
+	}
 
-	files, err := s.getFileListing(svc)
+	objects, _, err := s.listBackups(svc)
 	if err != nil {
-		return "", fmt.Errorf("couldn't list S3 objects, %v", err)
+		return "", err
 	}
 
-	if len(files) == 0 {
+	if len(objects) == 0 {
 		return "", fmt.Errorf("cannot find a recent backup on s3://%s/%s",
 			s.Bucket, s.Prefix)
 	}
 
-	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	latest := objects[len(objects)-1]
+	log.Trace("Latest backup is s3://%s/%s with %d bytes, modified on %s",
+		s.Bucket, latest.Key, latest.Size, latest.LastModified.Format(time.RFC3339))
 
-	return files[0], nil
+	return latest.Key, nil
 }
 
 // Retrieve downloads a S3 object to the local filesystem
 func (s *S3Config) Retrieve(s3path string) (string, error) {
 	// Create an uploader with the session and default options
-	downloader := s3manager.NewDownloader(s.newSession())
+	sess, err := s.newSession()
+	if err != nil {
+		return "", err
+	}
 
-	filepath := path.Join(s.SaveDir, path.Base(s3path))
-	f, err := os.Create(filepath)
+	downloader := s3manager.NewDownloader(sess)
+
+	obj, input, err := s.newGetObjectInput(s3.New(sess), s3path)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %v", err)
+		return "", err
 	}
 
-	defer f.Close()
+	size := aws.Int64Value(obj.ContentLength)
+	if err = checkFreeSpace(s.SaveDir, size); err != nil {
+		return "", err
+	}
 
-	// download the file from S3.
-	_, err = downloader.Download(f, &s3.GetObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s3path),
+	filepath, err := downloadFile(s.SaveDir, path.Base(s3path), func(f *os.File) error {
+		// download the file from S3.
+		if _, err := downloader.Download(f, input); err != nil {
+			return fmt.Errorf("failed to download S3 object, %v", err)
+		}
+
+		if err := verifyDownload(f, size, objectChecksum(obj.Metadata)); err != nil {
+			return fmt.Errorf("S3 object %s is corrupted, %v", s3path, err)
+		}
+
+		return nil
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("failed to download S3 object, %v", err)
+		return "", err
 	}
 
 	log.Trace("File downloaded to %s\n", filepath)
-	s.retrievedFile = filepath
+	s.retrievedFiles = append(s.retrievedFiles, filepath)
 
 	return filepath, nil
 }
 
-// Close deinitializes the store (remove downloaded file)
-func (s *S3Config) Close() {
-	if s.retrievedFile != "" {
-		if err := os.Remove(s.retrievedFile); err != nil {
-			log.Warn("Cannot remove file %s", s.retrievedFile)
-		}
+// Stream returns a reader of a S3 object, its size and checksum are verified
+// when the end of the object is read
+func (s *S3Config) Stream(s3path string) (io.ReadCloser, error) {
+	svc, err := s.newClient()
+	if err != nil {
+		return nil, err
+	}
 
-		s.retrievedFile = ""
+	obj, input, err := s.newGetObjectInput(svc, s3path)
+	if err != nil {
+		return nil, err
 	}
+
+	out, err := svc.GetObject(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download S3 object, %v", err)
+	}
+
+	return newVerifyingReader(out.Body, s3path, aws.Int64Value(obj.ContentLength), objectChecksum(obj.Metadata))
+}
+
+// newGetObjectInput returns the attributes of an object and the input to
+// download that same version of it
+func (s *S3Config) newGetObjectInput(svc *s3.S3, s3path string) (*s3.HeadObjectOutput, *s3.GetObjectInput, error) {
+	head, err := s.newHeadObjectInput(s3path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the size and checksum are read first to verify the download
+	obj, err := svc.HeadObject(head)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read S3 object, %v", err)
+	}
+
+	// objects encrypted with SSE-C need the same key to be read
+	input := &s3.GetObjectInput{
+		Bucket:               aws.String(s.Bucket),
+		Key:                  aws.String(s3path),
+		IfMatch:              obj.ETag,
+		SSECustomerAlgorithm: head.SSECustomerAlgorithm,
+		SSECustomerKey:       head.SSECustomerKey,
+	}
+
+	return obj, input, nil
+}
+
+// root returns the prefix of every key of the store, ending with "/" when set
+func (s *S3Config) root() string {
+	root := path.Clean(s.Prefix)
+	if root == "." || root == "/" {
+		return ""
+	}
+
+	return root + "/"
+}
+
+// List returns the objects under a prefix, relative to the store prefix
+func (s *S3Config) List(prefix string) ([]string, error) {
+	svc, err := s.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	root := s.root()
+
+	objects, err := s.listObjects(svc, root+prefix)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list S3 objects, %v", err)
+	}
+
+	var files []string
+	for _, obj := range objects {
+		files = append(files, strings.TrimPrefix(obj.Key, root))
+	}
+
+	return files, nil
+}
+
+// Remove deletes an object of the store
+func (s *S3Config) Remove(filename string) error {
+	svc, err := s.newClient()
+	if err != nil {
+		return err
+	}
+
+	return s.deleteKeys(svc, []string{s.root() + filename})
+}
+
+// Close deinitializes the store (remove downloaded files)
+func (s *S3Config) Close() {
+	for _, file := range s.retrievedFiles {
+		removeDownloaded(file)
+	}
+
+	s.retrievedFiles = nil
 }
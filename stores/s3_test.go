@@ -0,0 +1,661 @@
+package stores
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3UploadInput(t *testing.T) {
+	r := require.New(t)
+
+	s := &S3Config{
+		Bucket:               "backups",
+		ServerSideEncryption: "aws:kms",
+		KMSKeyID:             "alias/backups",
+		StorageClass:         "STANDARD_IA",
+		Tags:                 map[string]string{"job": "nightly", "service": "mysql"},
+		Metadata:             map[string]string{"host": "db1"},
+	}
+
+	input, err := s.newUploadInput("mysql/mysql-backup.json")
+	r.NoError(err, "failed to create upload input")
+	r.Equal("backups", aws.StringValue(input.Bucket))
+	r.Equal("mysql/mysql-backup.json", aws.StringValue(input.Key))
+	r.Equal("aws:kms", aws.StringValue(input.ServerSideEncryption))
+	r.Equal("alias/backups", aws.StringValue(input.SSEKMSKeyId))
+	r.Equal("STANDARD_IA", aws.StringValue(input.StorageClass))
+	r.Equal("db1", aws.StringValue(input.Metadata["host"]))
+	r.Equal("application/json", aws.StringValue(input.ContentType))
+
+	tags, err := url.ParseQuery(aws.StringValue(input.Tagging))
+	r.NoError(err, "failed to parse tags")
+	r.Equal("nightly", tags.Get("job"))
+	r.Equal("mysql", tags.Get("service"))
+
+	s = &S3Config{Bucket: "backups", ContentType: "application/sql"}
+	input, err = s.newUploadInput("mysql-backup.sql")
+	r.NoError(err, "failed to create upload input")
+	r.Nil(input.ServerSideEncryption, "encryption must be unset by default")
+	r.Nil(input.Tagging, "tags must be unset by default")
+	r.Equal("application/sql", aws.StringValue(input.ContentType))
+
+	s = &S3Config{Bucket: "backups"}
+	input, err = s.newUploadInput("backup.unknown")
+	r.NoError(err, "failed to create upload input")
+	r.Equal(defaultContentType, aws.StringValue(input.ContentType))
+
+	key := strings.Repeat("k", 32)
+	s = &S3Config{Bucket: "backups", SSECustomerKey: base64.StdEncoding.EncodeToString([]byte(key))}
+	input, err = s.newUploadInput("backup.tar")
+	r.NoError(err, "failed to create upload input")
+	r.Equal("AES256", aws.StringValue(input.SSECustomerAlgorithm))
+	r.Equal(key, aws.StringValue(input.SSECustomerKey))
+
+	s.ServerSideEncryption = "AES256"
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "SSE-C can't be combined with server side encryption")
+
+	s = &S3Config{Bucket: "backups", SSECustomerKey: base64.StdEncoding.EncodeToString([]byte("short"))}
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "short SSE-C keys must fail")
+
+	s = &S3Config{Bucket: "backups", ServerSideEncryption: "rot13"}
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "unknown encryption must fail")
+}
+
+func TestS3Session(t *testing.T) {
+	r := require.New(t)
+
+	s := &S3Config{
+		Region:      "us-east-1",
+		Credentials: S3Credentials{AccessKey: "access", SecretKey: "secret"},
+	}
+
+	sess, err := s.newSession()
+	r.NoError(err, "failed to create session")
+
+	creds, err := sess.Config.Credentials.Get()
+	r.NoError(err, "failed to get credentials")
+	r.Equal("access", creds.AccessKeyID)
+	r.Equal("secret", creds.SecretAccessKey)
+
+	same, err := s.newSession()
+	r.NoError(err, "failed to create session")
+	r.True(sess == same, "the session must be reused")
+
+	s = &S3Config{Credentials: S3Credentials{AccessKey: "access"}}
+	_, err = s.newSession()
+	r.Error(err, "the secret key is required")
+
+	s = &S3Config{Credentials: S3Credentials{WebIdentityTokenFile: "/var/run/token"}}
+	_, err = s.newSession()
+	r.Error(err, "the role is required with a web identity token")
+
+	// roles are assumed through STS, not the S3 endpoint
+	var assumed int
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assumed++
+		fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>assumed</AccessKeyId>`+
+			`<SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>`+
+			`<Expiration>2099-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer sts.Close()
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s = server.config("")
+	s.Credentials.RoleARN = "arn:aws:iam::123456789012:role/backup"
+	s.Credentials.STSEndpoint = sts.URL
+
+	_, err = s.List("")
+	r.NoError(err, "failed to list objects with the assumed role")
+	r.Equal(1, assumed, "the role must be assumed through STS")
+
+	sess, err = s.newSession()
+	r.NoError(err, "failed to create session")
+	r.Equal(server.URL, aws.StringValue(sess.Config.Endpoint), "S3 requests must use the S3 endpoint")
+}
+
+func TestS3Transport(t *testing.T) {
+	r := require.New(t)
+
+	transport := &S3Transport{}
+	client, err := transport.newHTTPClient()
+	r.NoError(err, "failed to create client")
+	r.Nil(client, "the default client must be used")
+
+	transport = &S3Transport{InsecureSkipVerify: true, Proxy: "http://proxy.local:3128"}
+	client, err = transport.newHTTPClient()
+	r.NoError(err, "failed to create client")
+
+	httpTransport := client.Transport.(*http.Transport)
+	r.True(httpTransport.TLSClientConfig.InsecureSkipVerify, "verification must be skipped")
+
+	req, err := http.NewRequest("GET", "https://s3.local", nil)
+	r.NoError(err, "failed to create request")
+
+	proxy, err := httpTransport.Proxy(req)
+	r.NoError(err, "failed to get proxy")
+	r.Equal("proxy.local:3128", proxy.Host)
+
+	tmp, err := ioutil.TempFile("", "ca")
+	r.NoError(err, "failed to create CA bundle")
+
+	defer os.Remove(tmp.Name())
+	tmp.WriteString("not a certificate")
+	tmp.Close()
+
+	transport = &S3Transport{CABundle: tmp.Name()}
+	_, err = transport.newHTTPClient()
+	r.Error(err, "invalid CA bundles must fail")
+}
+
+func TestS3PartSize(t *testing.T) {
+	r := require.New(t)
+
+	upload := &S3Upload{}
+	r.Equal(int64(s3manager.MinUploadPartSize), upload.partSize(1<<20), "parts can't be smaller than the minimum")
+
+	upload = &S3Upload{PartSize: 64 << 20}
+	r.Equal(int64(64<<20), upload.partSize(1<<30))
+
+	// 100 GiB don't fit in 10000 parts of 5 MiB
+	size := int64(100 << 30)
+	partSize := (&S3Upload{}).partSize(size)
+	r.True((size+partSize-1)/partSize < s3manager.MaxUploadParts, "too many parts of %d bytes", partSize)
+	r.Equal(int64(0), partSize%(1<<20), "part size must be aligned to MiB")
+}
+
+func TestS3StoreRetrieve(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s := server.config(tmp)
+	s.Upload = S3Upload{BandwidthLimit: 64 << 20}
+
+	filepath := path.Join(tmp, "test.txt")
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.NoError(s.Store(filepath, "test.txt"), "failed to store file")
+
+	_, err = os.Stat(filepath)
+	r.True(os.IsNotExist(err), "the source file must be removed")
+
+	retrieved, err := s.Retrieve("test.txt")
+	r.NoError(err, "failed to retrieve file")
+
+	data, err := ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read retrieved file")
+	r.Equal([]byte("test"), data)
+
+	s.Close()
+}
+
+func TestS3ResumableUpload(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s := server.config(tmp)
+	s.Upload = S3Upload{Concurrency: 1, Resume: true}
+
+	data := make([]byte, 3*s3manager.MinUploadPartSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	filepath := path.Join(tmp, "backup.tar")
+	r.NoError(ioutil.WriteFile(filepath, data, 0644), "failed to create file")
+
+	delay := resumeDelay
+	resumeDelay = 0
+	defer func() { resumeDelay = delay }()
+
+	// the upload is interrupted once on the third part and resumed
+	server.failPart = 3
+	server.failLimit = 1
+	r.NoError(s.Store(filepath, "backup.tar"), "failed to resume upload")
+	r.Equal(4, server.partCount, "only the missing parts must be uploaded")
+	r.Equal(1, server.uploadCount, "the upload must be resumed")
+
+	obj := server.object("backup.tar")
+	r.NotNil(obj, "the object must exist")
+	r.True(bytes.Equal(data, obj.data), "contents mismatch")
+
+	// an upload failing on every attempt is aborted
+	r.NoError(ioutil.WriteFile(filepath, data, 0644), "failed to create file")
+	server.failLimit = 0
+	r.Error(s.Store(filepath, "failed.tar"), "the upload must fail")
+	r.Nil(server.object("failed.tar"), "the object must not exist")
+	r.Empty(server.uploads, "the upload must be aborted")
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := require.New(t)
+
+	limiter := &rateLimiter{rate: 1 << 20}
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		limiter.wait(64 << 10)
+	}
+
+	// the first read goes through, the other four wait 62.5ms each
+	r.True(time.Since(start) >= 200*time.Millisecond, "the rate was not limited")
+}
+
+func TestS3Checksum(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	for _, algorithm := range []string{ChecksumSHA256, ChecksumCRC32C} {
+		s := server.config(tmp)
+		s.Checksum = algorithm
+
+		filepath := path.Join(tmp, "test.txt")
+		r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+		r.NoError(s.Store(filepath, "test.txt"), "failed to store file")
+
+		checksum := server.object("test.txt").header.Get("X-Amz-Meta-" + checksumMetadata)
+		r.True(strings.HasPrefix(checksum, algorithm+":"), "unexpected checksum %s", checksum)
+
+		_, err = s.Retrieve("test.txt")
+		r.NoError(err, "failed to retrieve file")
+		s.Close()
+
+		// the object is corrupted with the same size
+		server.object("test.txt").data = []byte("tset")
+
+		_, err = s.Retrieve("test.txt")
+		r.Error(err, "corrupted objects must fail")
+
+		r.Empty(retrievedDirs(t, tmp), "the corrupted file must be removed")
+	}
+
+	s := server.config(tmp)
+	s.Checksum = ChecksumNone
+
+	filepath := path.Join(tmp, "test.txt")
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.NoError(s.Store(filepath, "test.txt"), "failed to store file")
+	r.Empty(server.object("test.txt").header.Get("X-Amz-Meta-"+checksumMetadata), "the checksum must not be set")
+
+	_, err = s.Retrieve("test.txt")
+	r.NoError(err, "objects without checksum must be retrieved")
+	s.Close()
+
+	r.NotEmpty(server.object("test.txt").header.Get("Content-Md5"), "the Content-MD5 must be sent")
+
+	// objects saved with other contents than the uploaded ones fail the ETag check
+	server.corrupt = true
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.Error(s.Store(filepath, "corrupted.txt"), "corrupted uploads must fail")
+
+	// the ETag of objects encrypted with KMS isn't their MD5, they are
+	// downloaded again to verify their checksum
+	s = server.config(tmp)
+	s.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.Error(s.Store(filepath, "encrypted.txt"), "corrupted encrypted uploads must fail")
+
+	server.corrupt = false
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.NoError(s.Store(filepath, "encrypted.txt"), "failed to store encrypted file")
+
+	// the checksum and the ETag of every part are computed in the same read
+	data := []byte("0123456789")
+	checksum, etag, err := uploadSums(bytes.NewReader(data), ChecksumSHA256, 10, 4, true)
+	r.NoError(err, "failed to compute sums")
+
+	expected, err := fileChecksum(ChecksumSHA256, bytes.NewReader(data))
+	r.NoError(err, "failed to compute checksum")
+	r.Equal(expected, checksum)
+	r.Equal(strings.Trim(multipartETag([][]byte{data[:4], data[4:8], data[8:]}), `"`), etag)
+}
+
+func TestS3Lock(t *testing.T) {
+	r := require.New(t)
+
+	now := time.Now()
+	s := &S3Config{Bucket: "backups", Lock: S3Lock{Mode: "COMPLIANCE", RetainFor: 24 * time.Hour, LegalHold: true}}
+
+	input, err := s.newUploadInput("backup.tar")
+	r.NoError(err, "failed to create upload input")
+	r.Equal("COMPLIANCE", aws.StringValue(input.ObjectLockMode))
+	r.Equal("ON", aws.StringValue(input.ObjectLockLegalHoldStatus))
+	r.True(aws.TimeValue(input.ObjectLockRetainUntilDate).After(now.Add(23*time.Hour)), "the retention must start on upload")
+
+	until := now.Add(48 * time.Hour)
+	s.Lock = S3Lock{Mode: "GOVERNANCE", RetainUntil: until}
+	input, err = s.newUploadInput("backup.tar")
+	r.NoError(err, "failed to create upload input")
+	r.True(until.Equal(aws.TimeValue(input.ObjectLockRetainUntilDate)))
+	r.Nil(input.ObjectLockLegalHoldStatus, "the legal hold must be unset by default")
+
+	s.Lock = S3Lock{Mode: "GOVERNANCE"}
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "the lock mode requires a retention")
+
+	s.Lock = S3Lock{RetainFor: time.Hour}
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "the retention requires a lock mode")
+
+	s.Lock = S3Lock{Mode: "GOVERNANCE", RetainUntil: now.Add(-time.Hour)}
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "past retention dates must fail")
+
+	s.Lock = S3Lock{Mode: "FOREVER", RetainFor: time.Hour}
+	_, err = s.newUploadInput("backup.tar")
+	r.Error(err, "unknown lock modes must fail")
+}
+
+func TestS3RemoveLockedBackups(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s := server.config(tmp)
+	s.Prefix = "mysql"
+
+	for i, name := range []string{"backup-1.sql", "backup-2.sql", "backup-3.sql", "backup-4.sql"} {
+		// the two oldest backups are locked
+		s.Lock = S3Lock{}
+		if i == 0 {
+			s.Lock = S3Lock{Mode: "GOVERNANCE", RetainFor: time.Hour}
+		} else if i == 1 {
+			s.Lock = S3Lock{LegalHold: true}
+		}
+
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(s.Store(filepath, name), "failed to store file")
+	}
+
+	r.NoError(s.RemoveOlderBackups(1), "locked objects must not fail the removal")
+
+	files, err := s.List("")
+	r.NoError(err, "failed to list objects")
+	r.Equal([]string{"backup-1.sql", "backup-2.sql", "backup-4.sql"}, files)
+
+	// a locked noncurrent version is skipped when every version is deleted
+	server.versioned = true
+	s.DeleteVersions = true
+
+	for i, name := range []string{"backup-5.sql", "backup-5.sql", "backup-6.sql"} {
+		s.Lock = S3Lock{}
+		if i == 0 {
+			s.Lock = S3Lock{LegalHold: true}
+		}
+
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(s.Store(filepath, name), "failed to store file")
+	}
+
+	r.NoError(s.RemoveOlderBackups(1), "locked versions must not fail the removal")
+	r.Equal(1, server.versions("mysql/backup-5.sql"), "only the locked version must be kept")
+}
+
+func TestS3DeleteBatches(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	batchSize := deleteBatchSize
+	deleteBatchSize = 2
+	defer func() { deleteBatchSize = batchSize }()
+
+	s := server.config(tmp)
+	s.Prefix = "mysql"
+
+	store := func(names ...string) {
+		for _, name := range names {
+			filepath := path.Join(tmp, name)
+			r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+			r.NoError(s.Store(filepath, name), "failed to store file")
+		}
+	}
+
+	store("backup-1.sql", "backup-2.sql", "backup-3.sql", "backup-4.sql", "backup-5.sql", "backup-6.sql")
+
+	// one key fails, the other batches are still deleted
+	server.failDelete = "mysql/backup-2.sql"
+	err = s.RemoveOlderBackups(1)
+	r.Error(err, "per-key failures must be returned")
+	r.Contains(err.Error(), "mysql/backup-2.sql")
+	r.Equal(3, server.deleteCount, "five keys must be deleted in three batches")
+
+	files, err := s.List("")
+	r.NoError(err, "failed to list objects")
+	r.Equal([]string{"backup-2.sql", "backup-6.sql"}, files)
+
+	// delete markers are left on versioned buckets by default
+	server.failDelete = ""
+	server.versioned = true
+	r.NoError(s.RemoveOlderBackups(1), "failed to remove backups")
+	r.Equal(2, server.versions("mysql/backup-2.sql"), "the version and its delete marker must be kept")
+
+	s.DeleteVersions = true
+	store("backup-7.sql", "backup-7.sql")
+	r.Equal(2, server.versions("mysql/backup-7.sql"))
+	r.NoError(s.Remove("backup-7.sql"), "failed to remove versions")
+	r.Equal(0, server.versions("mysql/backup-7.sql"), "every version must be deleted")
+
+	r.NoError(s.RemoveOlderBackups(0), "failed to remove backups")
+	r.Equal(0, server.versions("mysql/backup-6.sql"), "every version must be deleted")
+}
+
+func TestS3LatestBackup(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s := server.config(tmp)
+	s.Prefix = "db"
+
+	names := []string{"mysql-backup-20200102030405.sql.gz", "postgres-backup-20200101000000.sql", "manual.sql"}
+	for _, name := range names {
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(s.Store(filepath, name), "failed to store file")
+	}
+
+	// names without timestamp are ordered by their modification time
+	server.object("db/manual.sql").modTime = time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	latest, err := s.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("db/mysql-backup-20200102030405.sql.gz", latest)
+
+	r.NoError(s.RemoveOlderBackups(2), "failed to remove backups")
+	r.Nil(server.object("db/manual.sql"), "the oldest backup must be removed")
+	r.NotNil(server.object("db/postgres-backup-20200101000000.sql"), "the newest backups must be kept")
+
+	server.object("db/postgres-backup-20200101000000.sql").modTime = time.Now()
+	latest, err = s.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("db/mysql-backup-20200102030405.sql.gz", latest, "the name timestamp has precedence")
+}
+
+func TestS3Binlogs(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s := server.config(tmp)
+	s.Prefix = "mysql"
+
+	names := []string{"backup-20200101000000.sql", "backup-20200102000000.sql", "binlogs/mysql-bin.000001", "binlogs/mysql-bin.000002"}
+	for _, name := range names {
+		filepath := path.Join(tmp, path.Base(name))
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(s.Store(filepath, name), "failed to store file")
+	}
+
+	// the first binlog was uploaded before the kept dump started
+	server.object("mysql/binlogs/mysql-bin.000001").modTime = time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+
+	latest, err := s.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("mysql/backup-20200102000000.sql", latest, "binlogs must not be taken as backups")
+
+	r.NoError(s.RemoveOlderBackups(1), "failed to remove backups")
+
+	files, err := s.List("")
+	r.NoError(err, "failed to list objects")
+	r.Equal([]string{"backup-20200102000000.sql", "binlogs/mysql-bin.000002"}, files, "binlogs older than the kept dump must be removed")
+}
+
+// retrievedDirs returns the directories of the files downloaded to dir
+func retrievedDirs(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err, "failed to list directory")
+
+	var dirs []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "retrieve-") {
+			dirs = append(dirs, file.Name())
+		}
+	}
+
+	return dirs
+}
+
+func TestS3RetrieveDoesNotOverwrite(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	s := server.config(tmp)
+	s.KeepAfterUpload = true
+
+	filepath := path.Join(tmp, "test.txt")
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.NoError(s.Store(filepath, "test.txt"), "failed to store file")
+
+	server.object("test.txt").data = []byte("remote")
+	delete(server.object("test.txt").header, "X-Amz-Meta-"+checksumMetadata)
+
+	retrieved, err := s.Retrieve("test.txt")
+	r.NoError(err, "failed to retrieve file")
+	r.NotEqual(filepath, retrieved, "the local file must not be overwritten")
+	r.Equal("test.txt", path.Base(retrieved), "the name must be kept")
+
+	data, err := ioutil.ReadFile(filepath)
+	r.NoError(err, "failed to read local file")
+	r.Equal([]byte("test"), data)
+
+	data, err = ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read retrieved file")
+	r.Equal([]byte("remote"), data)
+
+	s.Close()
+	r.Empty(retrievedDirs(t, tmp), "the retrieved files must be removed")
+
+	_, err = s.Retrieve("missing.txt")
+	r.Error(err, "missing objects must fail")
+	r.Empty(retrievedDirs(t, tmp), "nothing must be left on failure")
+}
+
+func TestS3Stream(t *testing.T) {
+	r := require.New(t)
+
+	server := newFakeS3("backups")
+	defer server.Close()
+
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	s := server.config(tmp)
+
+	filepath := path.Join(tmp, "test.txt")
+	r.NoError(ioutil.WriteFile(filepath, []byte("test"), 0644), "failed to create file")
+	r.NoError(s.Store(filepath, "test.txt"), "failed to store file")
+
+	reader, err := s.Stream("test.txt")
+	r.NoError(err, "failed to stream object")
+
+	data, err := ioutil.ReadAll(reader)
+	r.NoError(err, "failed to read object")
+	r.Equal([]byte("test"), data)
+	reader.Close()
+
+	server.object("test.txt").data = []byte("tset")
+
+	reader, err = s.Stream("test.txt")
+	r.NoError(err, "failed to stream object")
+
+	_, err = ioutil.ReadAll(reader)
+	r.Error(err, "corrupted objects must fail at the end of the stream")
+	reader.Close()
+
+	// closing a partly read stream still verifies it
+	reader, err = s.Stream("test.txt")
+	r.NoError(err, "failed to stream object")
+
+	_, err = reader.Read(make([]byte, 1))
+	r.NoError(err, "failed to read object")
+	r.Error(reader.Close(), "corrupted objects must fail when closed before the end")
+
+	r.Empty(retrievedDirs(t, tmp), "streams must not touch the disk")
+}
@@ -0,0 +1,180 @@
+package stores
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Credentials selects the credentials used by a S3 store, the default
+// credential chain is used when none is set
+type S3Credentials struct {
+	AccessKey            string
+	SecretKey            string
+	Profile              string
+	RoleARN              string
+	ExternalID           string
+	SessionName          string
+	WebIdentityTokenFile string
+	STSEndpoint          string
+}
+
+// S3Transport has the connection options of a S3 store
+type S3Transport struct {
+	CABundle           string
+	InsecureSkipVerify bool
+	Proxy              string
+}
+
+// defaultSessionName is used when assuming a role without a session name
+var defaultSessionName = "dBacker"
+
+// newHTTPClient returns a client with the configured CA bundle, TLS
+// verification and proxy, or nil to use the default one
+func (t *S3Transport) newHTTPClient() (*http.Client, error) {
+	if t.CABundle == "" && !t.InsecureSkipVerify && t.Proxy == "" {
+		return nil, nil
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if t.CABundle != "" {
+		data, err := ioutil.ReadFile(t.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle, %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found on CA bundle %s", t.CABundle)
+		}
+
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if t.Proxy != "" {
+		proxy, err := url.Parse(t.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url, %v", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// newSession returns the session of the store, it is created once so the
+// assumed role credentials are reused between requests. The S3 endpoint and
+// the bandwidth limit only apply to S3, roles are assumed through STS
+func (s *S3Config) newSession() (*session.Session, error) {
+	if s.session != nil {
+		return s.session, nil
+	}
+
+	config := aws.Config{
+		Region: aws.String(s.Region),
+	}
+
+	client, err := s.Transport.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if client != nil {
+		config.HTTPClient = client
+	}
+
+	creds := s.Credentials
+
+	if creds.AccessKey != "" || creds.SecretKey != "" {
+		if creds.AccessKey == "" || creds.SecretKey == "" {
+			return nil, fmt.Errorf("both the access key and the secret key must be set")
+		}
+
+		config.Credentials = credentials.NewStaticCredentials(creds.AccessKey, creds.SecretKey, "")
+	}
+
+	opts := session.Options{Config: config}
+
+	if creds.Profile != "" {
+		opts.Profile = creds.Profile
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create S3 session, %v", err)
+	}
+
+	sessionName := creds.SessionName
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+
+	// the role is assumed with the credentials of the base session
+	stsSess := sess
+	if creds.STSEndpoint != "" {
+		stsSess = sess.Copy(&aws.Config{Endpoint: aws.String(creds.STSEndpoint)})
+	}
+
+	s3Config := &aws.Config{
+		Endpoint:         aws.String(s.Endpoint),
+		S3ForcePathStyle: aws.Bool(s.ForcePathStyle),
+	}
+
+	if creds.WebIdentityTokenFile != "" {
+		if creds.RoleARN == "" {
+			return nil, fmt.Errorf("a role ARN is required to use a web identity token")
+		}
+
+		s3Config.Credentials = stscreds.NewWebIdentityCredentials(stsSess, creds.RoleARN, sessionName, creds.WebIdentityTokenFile)
+	} else if creds.RoleARN != "" {
+		s3Config.Credentials = stscreds.NewCredentials(stsSess, creds.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if creds.ExternalID != "" {
+				p.ExternalID = aws.String(creds.ExternalID)
+			}
+		})
+	}
+
+	sess = sess.Copy(s3Config)
+
+	if s.Upload.BandwidthLimit > 0 {
+		sess.Handlers.Send.PushFrontNamed(s.Upload.bandwidthHandler())
+	}
+
+	s.session = sess
+
+	return sess, nil
+}
+
+func (s *S3Config) newClient() (*s3.S3, error) {
+	sess, err := s.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(sess), nil
+}
@@ -0,0 +1,334 @@
+package stores
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "unknwon.dev/clog/v2"
+)
+
+// Checksum algorithms used to verify the integrity of the S3 objects
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32C = "crc32c"
+	ChecksumNone   = "none"
+)
+
+// checksumMD5 is only used to verify the stores that save the MD5 of objects
+var checksumMD5 = "md5"
+
+// checksumMetadata is the metadata key with the checksum of an object, its
+// value is the algorithm and the hex encoded sum separated by a colon
+var checksumMetadata = "Dbacker-Checksum"
+
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case checksumMD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+}
+
+// fileChecksum returns the checksum of a file in the metadata format
+func fileChecksum(algorithm string, f io.ReadSeeker) (string, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("cannot seek file, %v", err)
+	}
+
+	if _, err = io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("cannot read file, %v", err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("cannot seek file, %v", err)
+	}
+
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// objectChecksum returns the checksum stored in the metadata of an object
+func objectChecksum(metadata map[string]*string) string {
+	for name, value := range metadata {
+		if strings.EqualFold(name, checksumMetadata) {
+			return aws.StringValue(value)
+		}
+	}
+
+	return ""
+}
+
+func (s *S3Config) checksum() string {
+	if s.Checksum == "" {
+		return ChecksumSHA256
+	}
+
+	return s.Checksum
+}
+
+func (s *S3Config) newHeadObjectInput(key string) (*s3.HeadObjectInput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+
+	customerKey, err := s.customerKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if customerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(customerKey)
+	}
+
+	return input, nil
+}
+
+// uploadSums returns the checksum of a file in the metadata format and the
+// ETag S3 gives to it, both computed in a single read of the file. The ETag
+// is the MD5 of the contents when the file is uploaded at once, or the MD5
+// of the MD5 of its parts followed by the number of parts otherwise. The
+// checksum is empty with ChecksumNone and the ETag when withETag is false
+func uploadSums(f io.ReadSeeker, algorithm string, size int64, partSize int64, withETag bool) (string, string, error) {
+	var sum hash.Hash
+	if algorithm != ChecksumNone {
+		h, err := newChecksumHash(algorithm)
+		if err != nil {
+			return "", "", err
+		}
+
+		sum = h
+	}
+
+	if sum == nil && !withETag {
+		return "", "", nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", fmt.Errorf("cannot seek file, %v", err)
+	}
+
+	defer f.Seek(0, io.SeekStart)
+
+	var sums []byte
+	parts := 0
+
+	for offset := int64(0); offset < size || parts == 0; offset += partSize {
+		part := md5.New()
+
+		var writers []io.Writer
+		if sum != nil {
+			writers = append(writers, sum)
+		}
+
+		if withETag {
+			writers = append(writers, part)
+		}
+
+		if _, err := io.CopyN(io.MultiWriter(writers...), f, partSize); err != nil && err != io.EOF {
+			return "", "", fmt.Errorf("cannot read file, %v", err)
+		}
+
+		sums = part.Sum(sums)
+		parts++
+	}
+
+	var checksum, etag string
+	if sum != nil {
+		checksum = algorithm + ":" + hex.EncodeToString(sum.Sum(nil))
+	}
+
+	if withETag && size <= partSize {
+		etag = hex.EncodeToString(sums)
+	} else if withETag {
+		total := md5.Sum(sums)
+		etag = fmt.Sprintf("%s-%d", hex.EncodeToString(total[:]), parts)
+	}
+
+	return checksum, etag, nil
+}
+
+// etagVerified reports if the ETag of the uploaded objects is computed from
+// their contents, which isn't the case with KMS or customer keys
+func (s *S3Config) etagVerified() bool {
+	return s.ServerSideEncryption != s3.ServerSideEncryptionAwsKms && s.SSECustomerKey == ""
+}
+
+// verifyUpload checks the size of an uploaded object and its ETag when set.
+// The SDK sends the Content-MD5 of every request, so S3 already rejects the
+// bodies corrupted in transit, the ETag proves the parts were put together
+// into the same contents as the local file. The ETag of objects encrypted
+// with KMS or customer keys isn't their MD5, they are downloaded again to
+// check their checksum instead
+func (s *S3Config) verifyUpload(svc *s3.S3, key string, size int64, etag string, checksum string) error {
+	input, err := s.newHeadObjectInput(key)
+	if err != nil {
+		return err
+	}
+
+	out, err := svc.HeadObject(input)
+	if err != nil {
+		return fmt.Errorf("cannot read uploaded object, %v", err)
+	}
+
+	if aws.Int64Value(out.ContentLength) != size {
+		return fmt.Errorf("uploaded object has %d bytes, expected %d", aws.Int64Value(out.ContentLength), size)
+	}
+
+	if etag != "" {
+		if actual := strings.Trim(aws.StringValue(out.ETag), `"`); actual != etag {
+			return fmt.Errorf("uploaded object ETag %s doesn't match %s", actual, etag)
+		}
+
+		return nil
+	}
+
+	if checksum == "" {
+		log.Warn("Uploaded object %s is only verified by its size, its ETag isn't its MD5 and checksums are disabled", key)
+		return nil
+	}
+
+	body, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		IfMatch:              out.ETag,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot download uploaded object, %v", err)
+	}
+
+	r, err := newVerifyingReader(body.Body, key, size, checksum)
+	if err != nil {
+		return err
+	}
+
+	// closing the reader reads the whole object and verifies it
+	return r.Close()
+}
+
+// verifyDownload checks a downloaded file against the size and checksum of
+// its object, objects uploaded without a checksum only have their size checked
+func verifyDownload(f *os.File, size int64, checksum string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
+
+	if info.Size() != size {
+		return fmt.Errorf("downloaded file has %d bytes, expected %d", info.Size(), size)
+	}
+
+	if checksum == "" {
+		log.Warn("Object %s doesn't have a checksum, skipping verification", f.Name())
+		return nil
+	}
+
+	parts := strings.SplitN(checksum, ":", 2)
+
+	actual, err := fileChecksum(parts[0], f)
+	if err != nil {
+		return err
+	}
+
+	if actual != checksum {
+		return fmt.Errorf("downloaded file checksum %s doesn't match %s", actual, checksum)
+	}
+
+	return nil
+}
+
+// verifyingReader checks the size and checksum of an object once it is read
+type verifyingReader struct {
+	io.ReadCloser
+	name     string
+	size     int64
+	read     int64
+	checksum string
+	hash     hash.Hash
+}
+
+func newVerifyingReader(body io.ReadCloser, name string, size int64, checksum string) (*verifyingReader, error) {
+	r := &verifyingReader{ReadCloser: body, name: name, size: size, checksum: checksum}
+
+	if checksum == "" {
+		log.Warn("Object %s doesn't have a checksum, only its size is verified", name)
+		return r, nil
+	}
+
+	h, err := newChecksumHash(strings.SplitN(checksum, ":", 2)[0])
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	r.hash = h
+
+	return r, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+
+	if err == io.EOF {
+		if verr := r.verify(); verr != nil {
+			return n, verr
+		}
+	}
+
+	return n, err
+}
+
+// Close reads the rest of the object before closing it, so the size and
+// checksum are verified even when the reader stopped before the end
+func (r *verifyingReader) Close() error {
+	_, err := io.Copy(ioutil.Discard, r)
+	if cerr := r.ReadCloser.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (r *verifyingReader) verify() error {
+	if r.read != r.size {
+		return fmt.Errorf("object %s is corrupted, read %d bytes, expected %d", r.name, r.read, r.size)
+	}
+
+	if r.hash == nil {
+		return nil
+	}
+
+	algorithm := strings.SplitN(r.checksum, ":", 2)[0]
+	if actual := algorithm + ":" + hex.EncodeToString(r.hash.Sum(nil)); actual != r.checksum {
+		return fmt.Errorf("object %s is corrupted, checksum %s doesn't match %s", r.name, actual, r.checksum)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package stores
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "unknwon.dev/clog/v2"
+)
+
+// deleteBatchSize is the maximum number of keys of a DeleteObjects request
+var deleteBatchSize = 1000
+
+// deleteKeys deletes the objects with the given keys. On versioned buckets
+// the deletion leaves delete markers unless DeleteVersions is set, then every
+// version of the objects is removed. Failures of single keys don't stop the
+// deletion of the others and are returned together, except the versions
+// denied because of their retention or legal hold which are skipped
+func (s *S3Config) deleteKeys(svc *s3.S3, keys []string) error {
+	var objs []*s3.ObjectIdentifier
+
+	if s.DeleteVersions {
+		var err error
+		if objs, err = s.objectVersions(svc, keys); err != nil {
+			return fmt.Errorf("couldn't list the S3 object versions, %v", err)
+		}
+	} else {
+		for _, key := range keys {
+			objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+	}
+
+	var failed []string
+	deleted, skipped := 0, 0
+
+	for start := 0; start < len(objs); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(objs) {
+			end = len(objs)
+		}
+
+		out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{Objects: objs[start:end], Quiet: aws.Bool(true)},
+		})
+
+		if err != nil {
+			for _, obj := range objs[start:end] {
+				failed = append(failed, fmt.Sprintf("%s: %v", objectName(obj.Key, obj.VersionId), err))
+			}
+			continue
+		}
+
+		deleted += end - start - len(out.Errors)
+
+		for _, e := range out.Errors {
+			name := objectName(e.Key, e.VersionId)
+
+			if aws.StringValue(e.Code) == "AccessDenied" {
+				reason, err := s.objectLock(svc, aws.StringValue(e.Key), aws.StringValue(e.VersionId))
+				if err == nil && reason != "" {
+					log.Info("Skipping s3://%s/%s, %s", s.Bucket, name, reason)
+					skipped++
+					continue
+				}
+			}
+
+			failed = append(failed, fmt.Sprintf("%s: %s", name, aws.StringValue(e.Message)))
+		}
+	}
+
+	log.Trace("Deleted %d objects from S3", deleted)
+
+	if skipped > 0 {
+		log.Warn("Skipped %d locked objects on S3", skipped)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't delete %d S3 objects, %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// objectVersions returns the identifiers of every version and delete marker
+// of the given keys
+func (s *S3Config) objectVersions(svc *s3.S3, keys []string) ([]*s3.ObjectIdentifier, error) {
+	var objs []*s3.ObjectIdentifier
+
+	for _, key := range keys {
+		err := svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+			Bucket: aws.String(s.Bucket),
+			Prefix: aws.String(key),
+		}, func(p *s3.ListObjectVersionsOutput, last bool) bool {
+			for _, v := range p.Versions {
+				if aws.StringValue(v.Key) == key {
+					objs = append(objs, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+				}
+			}
+
+			for _, m := range p.DeleteMarkers {
+				if aws.StringValue(m.Key) == key {
+					objs = append(objs, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+				}
+			}
+
+			return true
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objs, nil
+}
+
+func objectName(key *string, versionID *string) string {
+	if aws.StringValue(versionID) == "" {
+		return aws.StringValue(key)
+	}
+
+	return aws.StringValue(key) + "@" + aws.StringValue(versionID)
+}
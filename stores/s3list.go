@@ -0,0 +1,34 @@
+package stores
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listObjects returns the objects under a prefix of the bucket
+func (s *S3Config) listObjects(svc *s3.S3, prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(p *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range p.Contents {
+			if strings.HasSuffix(aws.StringValue(obj.Key), "/") {
+				continue
+			}
+
+			objects = append(objects, remoteObject{
+				Key:          aws.StringValue(obj.Key),
+				LastModified: aws.TimeValue(obj.LastModified),
+				Size:         aws.Int64Value(obj.Size),
+				ETag:         aws.StringValue(obj.ETag),
+			})
+		}
+		return true
+	})
+
+	return objects, err
+}
@@ -0,0 +1,116 @@
+package stores
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "unknwon.dev/clog/v2"
+)
+
+// S3Lock has the Object Lock options of the uploaded objects. Mode is
+// GOVERNANCE or COMPLIANCE, the objects are retained until RetainUntil or
+// for RetainFor after each upload. The bucket must have Object Lock enabled
+type S3Lock struct {
+	Mode        string
+	RetainUntil time.Time
+	RetainFor   time.Duration
+	LegalHold   bool
+}
+
+// retainUntil returns the retention date of an object uploaded now
+func (l *S3Lock) retainUntil(now time.Time) time.Time {
+	if !l.RetainUntil.IsZero() {
+		return l.RetainUntil
+	}
+
+	if l.RetainFor > 0 {
+		return now.Add(l.RetainFor)
+	}
+
+	return time.Time{}
+}
+
+// apply sets the lock options on an upload
+func (l *S3Lock) apply(input *s3manager.UploadInput, now time.Time) error {
+	until := l.retainUntil(now)
+
+	switch l.Mode {
+	case "":
+		if !until.IsZero() {
+			return fmt.Errorf("a lock mode is required to retain objects")
+		}
+	case s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+		if until.IsZero() {
+			return fmt.Errorf("a retention date or period is required by lock mode %s", l.Mode)
+		}
+
+		if !until.After(now) {
+			return fmt.Errorf("the retention date %s is in the past", until.Format(time.RFC3339))
+		}
+
+		input.ObjectLockMode = aws.String(l.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(until)
+	default:
+		return fmt.Errorf("unsupported lock mode: %s", l.Mode)
+	}
+
+	if l.LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+
+	return nil
+}
+
+// lockedObjects returns the objects that can't be deleted because of their
+// retention or legal hold. Objects whose lock can't be read are assumed to be
+// unlocked, their deletion fails if they are not
+func (s *S3Config) lockedObjects(svc *s3.S3, keys []string) map[string]bool {
+	locked := make(map[string]bool)
+
+	for _, key := range keys {
+		reason, err := s.objectLock(svc, key, "")
+		if err != nil {
+			log.Warn("Cannot check the lock of s3://%s/%s, %v", s.Bucket, key, err)
+			continue
+		}
+
+		if reason != "" {
+			log.Info("Skipping s3://%s/%s, %s", s.Bucket, key, reason)
+			locked[key] = true
+		}
+	}
+
+	return locked
+}
+
+// objectLock returns why a version of an object can't be deleted, or an
+// empty string when it has no active retention or legal hold. An empty
+// version is the current one
+func (s *S3Config) objectLock(svc *s3.S3, key string, version string) (string, error) {
+	input, err := s.newHeadObjectInput(key)
+	if err != nil {
+		return "", err
+	}
+
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+
+	out, err := svc.HeadObject(input)
+	if err != nil {
+		return "", err
+	}
+
+	if aws.StringValue(out.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn {
+		return "it has a legal hold", nil
+	}
+
+	if out.ObjectLockRetainUntilDate != nil && out.ObjectLockRetainUntilDate.After(time.Now()) {
+		return fmt.Sprintf("it is retained until %s", out.ObjectLockRetainUntilDate.Format(time.RFC3339)), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,385 @@
+package stores
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "unknwon.dev/clog/v2"
+)
+
+// S3Upload has the multipart upload options of a S3 store. PartSize is
+// raised when needed to stay under the parts limit, BandwidthLimit is in
+// bytes per second and Resume retries failed multipart uploads from their
+// completed parts
+type S3Upload struct {
+	PartSize       int64
+	Concurrency    int
+	BandwidthLimit int64
+	Resume         bool
+}
+
+// partSizeAlignment rounds automatic part sizes to whole MiB
+var partSizeAlignment int64 = 1 << 20
+
+// throttleChunk is the largest read allowed at once by the bandwidth limit
+var throttleChunk = 32 * 1024
+
+// resumeAttempts is the number of times a multipart upload is tried, each
+// attempt resumes from the parts completed by the previous ones
+var resumeAttempts = 3
+
+// resumeDelay is the time to wait before resuming a failed upload
+var resumeDelay = 10 * time.Second
+
+// partSize returns the part size of a file, big enough to upload it in
+// less than the maximum number of parts
+func (u *S3Upload) partSize(size int64) int64 {
+	partSize := u.PartSize
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/(s3manager.MaxUploadParts-1) + 1
+		partSize = (partSize + partSizeAlignment - 1) / partSizeAlignment * partSizeAlignment
+	}
+
+	return partSize
+}
+
+func (u *S3Upload) concurrency() int {
+	if u.Concurrency <= 0 {
+		return s3manager.DefaultUploadConcurrency
+	}
+
+	return u.Concurrency
+}
+
+// rateLimiter spreads reads over time to stay under a rate in bytes per second
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// wait blocks until n bytes can be transferred
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+
+	return n, err
+}
+
+// bandwidthHandler returns a send handler that limits the rate of request
+// bodies, the limit is shared by every concurrent request of the session
+func (u *S3Upload) bandwidthHandler() request.NamedHandler {
+	limiter := &rateLimiter{rate: u.BandwidthLimit}
+
+	return request.NamedHandler{
+		Name: "dBacker.BandwidthLimitHandler",
+		Fn: func(r *request.Request) {
+			body := r.HTTPRequest.Body
+			if body != nil && body != http.NoBody {
+				r.HTTPRequest.Body = &throttledReader{ReadCloser: body, limiter: limiter}
+			}
+		},
+	}
+}
+
+// uploadState is the progress of a multipart upload, it is kept between
+// the attempts of a run to resume a failed upload
+type uploadState struct {
+	Key      string
+	UploadID string
+	Size     int64
+	PartSize int64
+	Parts    map[int64]string
+}
+
+// multipartUpload uploads the parts of a file and keeps track of its state
+type multipartUpload struct {
+	svc   *s3.S3
+	input *s3manager.UploadInput
+	file  *os.File
+	state *uploadState
+	mu    sync.Mutex
+}
+
+// resumableUpload uploads a file in parts, a failed attempt is resumed from
+// the completed parts and the upload is aborted when all attempts fail
+func (s *S3Config) resumableUpload(svc *s3.S3, f *os.File, input *s3manager.UploadInput) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
+
+	upload := &multipartUpload{
+		svc:   svc,
+		input: input,
+		file:  f,
+		state: &uploadState{
+			Key:      aws.StringValue(input.Key),
+			Size:     info.Size(),
+			PartSize: s.Upload.partSize(info.Size()),
+			Parts:    make(map[int64]string),
+		},
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err = upload.run(s.Upload.concurrency()); err == nil {
+			return nil
+		}
+
+		if attempt >= resumeAttempts {
+			break
+		}
+
+		log.Warn("Upload of %s failed, resuming in %s: %v", upload.state.Key, resumeDelay, err)
+		time.Sleep(resumeDelay)
+	}
+
+	log.Warn("Giving up upload of %s after %d attempts", upload.state.Key, resumeAttempts)
+
+	if upload.state.UploadID != "" {
+		upload.abort()
+	}
+
+	return err
+}
+
+// run resumes the upload and uploads the missing parts
+func (u *multipartUpload) run(concurrency int) error {
+	if err := u.resume(); err != nil {
+		return err
+	}
+
+	if err := u.uploadParts(concurrency); err != nil {
+		return err
+	}
+
+	return u.complete()
+}
+
+// resume keeps the parts of the previous attempt confirmed by the server, or
+// starts a new upload
+func (u *multipartUpload) resume() error {
+	if u.state.UploadID != "" {
+		parts, err := u.listParts()
+		if err == nil {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+
+			// only keep the parts the server confirms
+			for number, etag := range u.state.Parts {
+				if parts[number] != etag {
+					delete(u.state.Parts, number)
+				}
+			}
+
+			log.Info("Resuming upload of %s with %d parts done", u.state.Key, len(u.state.Parts))
+			return nil
+		}
+
+		log.Warn("Cannot resume upload of %s, %v", u.state.Key, err)
+		u.abort()
+
+		u.state.UploadID = ""
+		u.state.Parts = make(map[int64]string)
+	}
+
+	out, err := u.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:                    u.input.Bucket,
+		Key:                       u.input.Key,
+		ContentType:               u.input.ContentType,
+		Metadata:                  u.input.Metadata,
+		ServerSideEncryption:      u.input.ServerSideEncryption,
+		SSEKMSKeyId:               u.input.SSEKMSKeyId,
+		SSECustomerAlgorithm:      u.input.SSECustomerAlgorithm,
+		SSECustomerKey:            u.input.SSECustomerKey,
+		StorageClass:              u.input.StorageClass,
+		Tagging:                   u.input.Tagging,
+		ObjectLockMode:            u.input.ObjectLockMode,
+		ObjectLockRetainUntilDate: u.input.ObjectLockRetainUntilDate,
+		ObjectLockLegalHoldStatus: u.input.ObjectLockLegalHoldStatus,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create multipart upload, %v", err)
+	}
+
+	u.state.UploadID = aws.StringValue(out.UploadId)
+
+	return nil
+}
+
+// listParts returns the ETags of the uploaded parts by part number
+func (u *multipartUpload) listParts() (map[int64]string, error) {
+	parts := make(map[int64]string)
+
+	err := u.svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   u.input.Bucket,
+		Key:      u.input.Key,
+		UploadId: aws.String(u.state.UploadID),
+	}, func(p *s3.ListPartsOutput, last bool) bool {
+		for _, part := range p.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+		return true
+	})
+
+	return parts, err
+}
+
+func (u *multipartUpload) abort() {
+	_, err := u.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   u.input.Bucket,
+		Key:      u.input.Key,
+		UploadId: aws.String(u.state.UploadID),
+	})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		return
+	} else if err != nil {
+		log.Warn("Cannot abort upload of %s, %v", u.state.Key, err)
+	}
+}
+
+// uploadParts uploads the missing parts with the given concurrency
+func (u *multipartUpload) uploadParts(concurrency int) error {
+	count := (u.state.Size + u.state.PartSize - 1) / u.state.PartSize
+	numbers := make(chan int64)
+	errs := make(chan error, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for number := range numbers {
+				if err := u.uploadPart(number); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+
+loop:
+	for number := int64(1); number <= count; number++ {
+		u.mu.Lock()
+		_, done := u.state.Parts[number]
+		u.mu.Unlock()
+
+		if done {
+			continue
+		}
+
+		select {
+		case numbers <- number:
+		case err = <-errs:
+			break loop
+		}
+	}
+
+	close(numbers)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+
+	return err
+}
+
+func (u *multipartUpload) uploadPart(number int64) error {
+	offset := (number - 1) * u.state.PartSize
+	size := u.state.PartSize
+	if offset+size > u.state.Size {
+		size = u.state.Size - offset
+	}
+
+	out, err := u.svc.UploadPart(&s3.UploadPartInput{
+		Bucket:               u.input.Bucket,
+		Key:                  u.input.Key,
+		UploadId:             aws.String(u.state.UploadID),
+		PartNumber:           aws.Int64(number),
+		Body:                 io.NewSectionReader(u.file, offset, size),
+		SSECustomerAlgorithm: u.input.SSECustomerAlgorithm,
+		SSECustomerKey:       u.input.SSECustomerKey,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot upload part %d, %v", number, err)
+	}
+
+	u.mu.Lock()
+	u.state.Parts[number] = aws.StringValue(out.ETag)
+	u.mu.Unlock()
+
+	return nil
+}
+
+// complete finishes the upload
+func (u *multipartUpload) complete() error {
+	var parts []*s3.CompletedPart
+	for number, etag := range u.state.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: aws.String(etag)})
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+
+	_, err := u.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          u.input.Bucket,
+		Key:             u.input.Key,
+		UploadId:        aws.String(u.state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot complete multipart upload, %v", err)
+	}
+
+	return nil
+}
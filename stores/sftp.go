@@ -0,0 +1,453 @@
+package stores
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	log "unknwon.dev/clog/v2"
+)
+
+// SFTPConfig has the config options of the SFTP store. The private key is
+// read from PrivateKeyFile when PrivateKey is empty, and the host key is
+// checked against KnownHostsFile, ~/.ssh/known_hosts by default
+type SFTPConfig struct {
+	Host                 string
+	Port                 int
+	User                 string
+	PrivateKey           string
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	KnownHostsFile       string
+	Dir                  string
+	KeepAfterUpload      bool
+	SaveDir              string
+	conn                 *ssh.Client
+	client               *sftp.Client
+	retrievedFiles       []string
+}
+
+// DefaultSFTPPort is the port used when none is configured
+var DefaultSFTPPort = 22
+
+// sftpDialTimeout is the timeout of the SSH connection and handshake
+var sftpDialTimeout = 30 * time.Second
+
+func (s *SFTPConfig) address() string {
+	port := s.Port
+	if port <= 0 {
+		port = DefaultSFTPPort
+	}
+
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+func (s *SFTPConfig) signer() (ssh.Signer, error) {
+	key := []byte(s.PrivateKey)
+	if len(key) == 0 {
+		if s.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("a private key is required")
+		}
+
+		var err error
+		if key, err = ioutil.ReadFile(s.PrivateKeyFile); err != nil {
+			return nil, fmt.Errorf("cannot read private key, %v", err)
+		}
+	}
+
+	if s.PrivateKeyPassphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(s.PrivateKeyPassphrase))
+	}
+
+	return ssh.ParsePrivateKey(key)
+}
+
+func (s *SFTPConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	file := s.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find the known_hosts file, %v", err)
+		}
+
+		file = path.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts, %v", err)
+	}
+
+	return callback, nil
+}
+
+// init connects to the server on the first use of the store
+func (s *SFTPConfig) init() error {
+	if s.client != nil {
+		return nil
+	}
+
+	signer, err := s.signer()
+	if err != nil {
+		return fmt.Errorf("invalid private key, %v", err)
+	}
+
+	callback, err := s.hostKeyCallback()
+	if err != nil {
+		return err
+	}
+
+	conn, err := ssh.Dial("tcp", s.address(), &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: callback,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s, %v", s.address(), err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot start SFTP session, %v", err)
+	}
+
+	s.conn = conn
+	s.client = client
+
+	return nil
+}
+
+// remotePath returns the path of a file, relative paths start on the home
+// directory of the user
+func (s *SFTPConfig) remotePath(filename string) string {
+	if p := path.Join(s.Dir, filename); p != "" {
+		return p
+	}
+
+	return "."
+}
+
+// Store uploads a file to a temporary name and renames it once complete, so
+// an interrupted upload is never taken as a backup
+func (s *SFTPConfig) Store(filepath string, filename string) error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	if !s.KeepAfterUpload {
+		defer func() {
+			if err := os.Remove(filepath); err != nil {
+				log.Warn("Cannot remove file %s", filepath)
+			}
+		}()
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
+
+	dest := s.remotePath(filename)
+	if err = s.client.MkdirAll(path.Dir(dest)); err != nil {
+		return fmt.Errorf("cannot create remote directory, %v", err)
+	}
+
+	tmp := path.Join(path.Dir(dest), "."+path.Base(dest)+partialSuffix)
+	if err = s.upload(f, tmp, info.Size()); err != nil {
+		s.client.Remove(tmp)
+		return fmt.Errorf("failed to upload file, %v", err)
+	}
+
+	// the standard rename fails when the destination exists
+	if err = s.client.PosixRename(tmp, dest); err != nil {
+		if err = s.client.Rename(tmp, dest); err != nil {
+			s.client.Remove(tmp)
+			return fmt.Errorf("cannot rename uploaded file, %v", err)
+		}
+	}
+
+	log.Trace("File uploaded to sftp://%s%s", s.address(), dest)
+
+	return nil
+}
+
+func (s *SFTPConfig) upload(f io.Reader, remote string, size int64) error {
+	dest, err := s.client.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dest, f)
+	if cerr := dest.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	info, err := s.client.Stat(remote)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != size {
+		return fmt.Errorf("uploaded file has %d bytes, expected %d", info.Size(), size)
+	}
+
+	return nil
+}
+
+// Retrieve downloads a file of the SFTP store to the local filesystem
+func (s *SFTPConfig) Retrieve(filename string) (string, error) {
+	if err := s.init(); err != nil {
+		return "", err
+	}
+
+	remote := s.remotePath(filename)
+
+	info, err := s.client.Stat(remote)
+	if err != nil {
+		return "", fmt.Errorf("cannot read remote file %s, %v", remote, err)
+	}
+
+	if err = checkFreeSpace(s.SaveDir, info.Size()); err != nil {
+		return "", err
+	}
+
+	filepath, err := downloadFile(s.SaveDir, path.Base(filename), func(f *os.File) error {
+		src, err := s.client.Open(remote)
+		if err != nil {
+			return fmt.Errorf("cannot open remote file %s, %v", remote, err)
+		}
+
+		defer src.Close()
+
+		n, err := io.Copy(f, src)
+		if err != nil {
+			return fmt.Errorf("failed to download file, %v", err)
+		}
+
+		if n != info.Size() {
+			return fmt.Errorf("downloaded file has %d bytes, expected %d", n, info.Size())
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Trace("File downloaded to %s", filepath)
+	s.retrievedFiles = append(s.retrievedFiles, filepath)
+
+	return filepath, nil
+}
+
+// Stream returns a reader of a file of the SFTP store
+func (s *SFTPConfig) Stream(filename string) (io.ReadCloser, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+
+	f, err := s.client.Open(s.remotePath(filename))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open remote file %s, %v", filename, err)
+	}
+
+	return f, nil
+}
+
+// listBackups returns the files of the remote directory and the names of their
+// indexes, partial uploads are skipped
+func (s *SFTPConfig) listBackups() ([]remoteObject, map[string]bool, error) {
+	if err := s.init(); err != nil {
+		return nil, nil, err
+	}
+
+	files, err := s.client.ReadDir(s.remotePath(""))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list contents of directory %s, %v", s.Dir, err)
+	}
+
+	var objects []remoteObject
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasSuffix(file.Name(), partialSuffix) {
+			continue
+		}
+
+		objects = append(objects, remoteObject{
+			Key:          file.Name(),
+			LastModified: file.ModTime(),
+			Size:         file.Size(),
+		})
+	}
+
+	objects, indexes := splitIndexes(objects)
+	sortBackups(objects)
+
+	return objects, indexes, nil
+}
+
+// listBinlogs returns the binlogs archived in the binlog directory
+func (s *SFTPConfig) listBinlogs() ([]remoteObject, error) {
+	files, err := s.client.ReadDir(s.remotePath(BinlogDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list binlogs of directory %s, %v", s.Dir, err)
+	}
+
+	var binlogs []remoteObject
+	for _, file := range files {
+		if file.Mode().IsRegular() && !strings.HasSuffix(file.Name(), partialSuffix) {
+			binlogs = append(binlogs, remoteObject{
+				Key:          path.Join(BinlogDir, file.Name()),
+				LastModified: file.ModTime(),
+			})
+		}
+	}
+
+	return binlogs, nil
+}
+
+// RemoveOlderBackups keeps the most recent backups of the SFTP store and deletes the old ones
+// along with the binlogs they don't need
+func (s *SFTPConfig) RemoveOlderBackups(keep int) error {
+	objects, indexes, err := s.listBackups()
+	if err != nil {
+		return err
+	}
+
+	binlogs, err := s.listBinlogs()
+	if err != nil {
+		return err
+	}
+
+	count := len(objects) - keep
+	if count < 0 {
+		count = 0
+	}
+
+	var files []string
+	for _, obj := range objects[:count] {
+		files = append(files, obj.Key)
+	}
+
+	files = append(withIndexes(files, indexes), expiredBinlogs(binlogs, objects[count:])...)
+	if len(files) == 0 {
+		return nil
+	}
+
+	var failed []string
+	for _, file := range files {
+		log.Trace("Deleting %s", s.remotePath(file))
+
+		if err = s.client.Remove(s.remotePath(file)); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", file, err))
+		}
+	}
+
+	log.Trace("Deleted %d files from %s", len(files)-len(failed), s.Dir)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't delete %d files, %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the SFTP store
+func (s *SFTPConfig) FindLatestBackup() (string, error) {
+	objects, _, err := s.listBackups()
+	if err != nil {
+		return "", err
+	}
+
+	if len(objects) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on sftp://%s%s", s.address(), s.remotePath(""))
+	}
+
+	return objects[len(objects)-1].Key, nil
+}
+
+// List returns the files under a directory of the store
+func (s *SFTPConfig) List(prefix string) ([]string, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+
+	root := s.remotePath("")
+	dir := s.remotePath(prefix)
+
+	if _, err := s.client.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var files []string
+
+	walker := s.client.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("cannot list contents of directory %s, %v", dir, err)
+		}
+
+		info := walker.Stat()
+		if info.IsDir() || strings.HasSuffix(info.Name(), partialSuffix) {
+			continue
+		}
+
+		files = append(files, strings.TrimPrefix(walker.Path(), strings.TrimSuffix(root, "/")+"/"))
+	}
+
+	return files, nil
+}
+
+// Remove deletes a file of the store
+func (s *SFTPConfig) Remove(filename string) error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	remote := s.remotePath(filename)
+	if err := s.client.Remove(remote); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove file %s, %v", remote, err)
+	}
+
+	return nil
+}
+
+// Close removes the downloaded files and closes the connection
+func (s *SFTPConfig) Close() {
+	for _, file := range s.retrievedFiles {
+		removeDownloaded(file)
+	}
+
+	s.retrievedFiles = nil
+
+	if s.client != nil {
+		s.client.Close()
+		s.conn.Close()
+		s.client = nil
+		s.conn = nil
+	}
+}
@@ -0,0 +1,141 @@
+package stores
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newSFTPStore starts a server and returns a store connected to it
+func newSFTPStore(t *testing.T, tmp string) (*SFTPConfig, *fakeSFTP) {
+	r := require.New(t)
+
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	r.NoError(err, "failed to generate client key")
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	r.NoError(err, "failed to read client key")
+
+	server, err := newFakeSFTP(sshPublic)
+	r.NoError(err, "failed to start SFTP server")
+
+	knownHosts := path.Join(tmp, "known_hosts")
+	line := knownhosts.Line([]string{server.listener.Addr().String()}, server.hostKey.PublicKey())
+	r.NoError(ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0644), "failed to write known hosts")
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	r.NoError(err, "failed to marshal client key")
+
+	s := &SFTPConfig{
+		Host:           "127.0.0.1",
+		Port:           server.port(),
+		User:           "backup",
+		PrivateKey:     string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		KnownHostsFile: knownHosts,
+		Dir:            path.Join(tmp, "remote"),
+		SaveDir:        path.Join(tmp, "local"),
+	}
+
+	r.NoError(os.MkdirAll(s.SaveDir, 0755), "failed to create save directory")
+
+	return s, server
+}
+
+func TestSFTPStoreRetrieve(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "sftp")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	s, server := newSFTPStore(t, tmp)
+	defer server.Close()
+	defer s.Close()
+
+	for _, name := range []string{"mysql-backup-20200102000000.sql", "mysql-backup-20200101000000.sql", "mysql-backup-20200103000000.sql"} {
+		filepath := path.Join(s.SaveDir, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(s.Store(filepath, name), "failed to store file")
+
+		_, err = os.Stat(filepath)
+		r.True(os.IsNotExist(err), "the uploaded file must be removed")
+	}
+
+	// interrupted uploads are never taken as backups
+	r.NoError(ioutil.WriteFile(path.Join(s.Dir, ".mysql-backup-20200104000000.sql"+partialSuffix), []byte("partial"), 0644))
+
+	latest, err := s.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("mysql-backup-20200103000000.sql", latest)
+
+	retrieved, err := s.Retrieve(latest)
+	r.NoError(err, "failed to retrieve file")
+
+	data, err := ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read retrieved file")
+	r.Equal([]byte(latest), data)
+
+	reader, err := s.Stream(latest)
+	r.NoError(err, "failed to stream file")
+
+	data, err = ioutil.ReadAll(reader)
+	r.NoError(err, "failed to read streamed file")
+	r.Equal([]byte(latest), data)
+	reader.Close()
+
+	r.NoError(s.RemoveOlderBackups(1), "failed to remove backups")
+
+	files, err := s.List("")
+	r.NoError(err, "failed to list files")
+	r.Equal([]string{"mysql-backup-20200103000000.sql"}, files)
+
+	// uploads replace existing files
+	filepath := path.Join(s.SaveDir, latest)
+	r.NoError(ioutil.WriteFile(filepath, []byte("replaced"), 0644), "failed to create file")
+	r.NoError(s.Store(filepath, latest), "failed to replace file")
+
+	data, err = ioutil.ReadFile(path.Join(s.Dir, latest))
+	r.NoError(err, "failed to read remote file")
+	r.Equal([]byte("replaced"), data)
+
+	r.NoError(s.Remove(latest), "failed to remove file")
+	r.NoError(s.Remove(latest), "missing files must be ignored")
+
+	s.Close()
+	r.Empty(retrievedDirs(t, s.SaveDir), "the retrieved files must be removed")
+}
+
+func TestSFTPHostKey(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "sftp")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	s, server := newSFTPStore(t, tmp)
+	defer server.Close()
+
+	other, err := newFakeSFTP(server.authorized)
+	r.NoError(err, "failed to start SFTP server")
+
+	defer other.Close()
+
+	// the host key of the other server isn't known
+	s.Port = other.port()
+	_, err = s.FindLatestBackup()
+	r.Error(err, "unknown host keys must fail")
+
+	s.Port = server.port()
+	s.User = "other"
+	_, err = s.FindLatestBackup()
+	r.Error(err, "unauthorized users must fail")
+}
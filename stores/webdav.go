@@ -0,0 +1,655 @@
+package stores
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// WebDAVConfig has the config options of the WebDAV store. URL is the
+// collection of the backups, e.g. https://cloud/remote.php/dav/files/user/backups
+// on Nextcloud. Files bigger than ChunkSize are sent with the chunked upload
+// of Nextcloud, other servers receive them in a single request
+type WebDAVConfig struct {
+	URL             string
+	User            string
+	Password        string
+	KeepAfterUpload bool
+	SaveDir         string
+	ChunkSize       int64
+	client          *http.Client
+	collections     map[string]bool
+	retrievedFiles  []string
+}
+
+// webdavFilesPath is the path of the user files on Nextcloud, the chunks are
+// uploaded to the uploads collection of the same user
+var webdavFilesPath = "/remote.php/dav/files/"
+
+// webdavPropfind requests the properties used to list the backups
+var webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/></d:prop></d:propfind>`
+
+// webdavEntry is a file or collection returned by PROPFIND
+type webdavEntry struct {
+	Path         string
+	Size         int64
+	LastModified time.Time
+	Collection   bool
+}
+
+// webdavMultistatus is the body of a PROPFIND response
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// fileURL returns the URL of a file relative to the collection of the store
+func (w *WebDAVConfig) fileURL(name string) string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(name, "/"), "/") {
+		if segment != "" {
+			segments = append(segments, url.PathEscape(segment))
+		}
+	}
+
+	base := strings.TrimSuffix(w.URL, "/")
+	if len(segments) == 0 {
+		return base + "/"
+	}
+
+	return base + "/" + strings.Join(segments, "/")
+}
+
+// uploadsURL returns the collection of the Nextcloud chunked uploads
+func (w *WebDAVConfig) uploadsURL() (string, bool) {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return "", false
+	}
+
+	i := strings.Index(u.Path, webdavFilesPath)
+	if i < 0 {
+		return "", false
+	}
+
+	user := strings.SplitN(u.Path[i+len(webdavFilesPath):], "/", 2)[0]
+	if user == "" {
+		return "", false
+	}
+
+	u.Path = u.Path[:i] + "/remote.php/dav/uploads/" + user
+	u.RawPath = ""
+
+	return u.String(), true
+}
+
+// do sends an authenticated request and fails on unsuccessful responses
+func (w *WebDAVConfig) do(method string, rawurl string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = length
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if w.User != "" {
+		req.SetBasicAuth(w.User, w.Password)
+	}
+
+	if w.client == nil {
+		w.client = &http.Client{}
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, webdavError(res)
+	}
+
+	return res, nil
+}
+
+// request sends a request without reading the response
+func (w *WebDAVConfig) request(method string, rawurl string, header http.Header) error {
+	res, err := w.do(method, rawurl, nil, 0, header)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	return nil
+}
+
+// webdavStatusError is the error of a failed response
+type webdavStatusError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *webdavStatusError) Error() string {
+	if e.Message != "" {
+		return e.Status + ": " + e.Message
+	}
+
+	return e.Status
+}
+
+// webdavError returns the error of a failed response, with the message of
+// the body returned by Nextcloud
+func webdavError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(res.Body)
+
+	var message struct {
+		Message string `xml:"message"`
+	}
+
+	xml.Unmarshal(body, &message)
+
+	return &webdavStatusError{StatusCode: res.StatusCode, Status: res.Status, Message: strings.TrimSpace(message.Message)}
+}
+
+func isWebDAVStatus(err error, status int) bool {
+	serr, ok := err.(*webdavStatusError)
+	return ok && serr.StatusCode == status
+}
+
+// mkcol creates the collection of a file and its parents
+func (w *WebDAVConfig) mkcol(dir string) error {
+	if w.collections == nil {
+		w.collections = make(map[string]bool)
+	}
+
+	segments := []string{""}
+	if dir = strings.Trim(path.Clean(dir), "/"); dir != "." && dir != "" {
+		segments = append(segments, strings.Split(dir, "/")...)
+	}
+
+	current := ""
+	for _, segment := range segments {
+		current = path.Join(current, segment)
+		if w.collections[current] {
+			continue
+		}
+
+		// the collection already exists when the method isn't allowed
+		err := w.request("MKCOL", w.fileURL(current), nil)
+		if err != nil && !isWebDAVStatus(err, http.StatusMethodNotAllowed) {
+			return fmt.Errorf("cannot create collection %s, %v", current, err)
+		}
+
+		w.collections[current] = true
+	}
+
+	return nil
+}
+
+// propfind returns the properties of a file, or the files of a collection
+// with depth 1
+func (w *WebDAVConfig) propfind(rawurl string, depth string) ([]webdavEntry, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	res, err := w.do("PROPFIND", rawurl, strings.NewReader(webdavPropfind), int64(len(webdavPropfind)), header)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var status webdavMultistatus
+	if err = xml.NewDecoder(res.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("cannot parse PROPFIND response, %v", err)
+	}
+
+	var entries []webdavEntry
+	for _, response := range status.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %s, %v", response.Href, err)
+		}
+
+		entry := webdavEntry{Path: path.Clean(href.Path)}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+
+			prop := propstat.Prop
+			entry.Collection = entry.Collection || prop.ResourceType.Collection != nil
+
+			if prop.ContentLength != "" {
+				entry.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+
+			if prop.LastModified != "" {
+				entry.LastModified, _ = http.ParseTime(prop.LastModified)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// stat returns the properties of a file of the store
+func (w *WebDAVConfig) stat(name string) (*webdavEntry, error) {
+	entries, err := w.propfind(w.fileURL(name), "0")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no properties returned for %s", name)
+	}
+
+	return &entries[0], nil
+}
+
+// readDir returns the names of the files and collections of a collection
+func (w *WebDAVConfig) readDir(dir string) ([]webdavEntry, error) {
+	rawurl := w.fileURL(dir)
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := w.propfind(rawurl, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	var children []webdavEntry
+	for _, entry := range entries {
+		if entry.Path == path.Clean(u.Path) {
+			continue
+		}
+
+		entry.Path = path.Base(entry.Path)
+		children = append(children, entry)
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Path < children[j].Path
+	})
+
+	return children, nil
+}
+
+// Store uploads a file to a temporary name and moves it once complete, so
+// an interrupted upload is never taken as a backup
+func (w *WebDAVConfig) Store(filepath string, filename string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	if !w.KeepAfterUpload {
+		defer func() {
+			if err := os.Remove(filepath); err != nil {
+				log.Warn("Cannot remove file %s", filepath)
+			}
+		}()
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read file info, %v", err)
+	}
+
+	if err = w.mkcol(path.Dir(filename)); err != nil {
+		return err
+	}
+
+	dest := w.fileURL(filename)
+
+	uploads, nextcloud := w.uploadsURL()
+	if w.ChunkSize > 0 && info.Size() > w.ChunkSize && nextcloud {
+		err = w.uploadChunks(uploads, f, info.Size(), dest)
+	} else {
+		if w.ChunkSize > 0 && info.Size() > w.ChunkSize {
+			log.Warn("Chunked uploads are only supported by Nextcloud, uploading %s in a single request", filename)
+		}
+
+		err = w.upload(f, info.Size(), filename, dest)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to upload file, %v", err)
+	}
+
+	entry, err := w.stat(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read uploaded file, %v", err)
+	}
+
+	if entry.Size != info.Size() {
+		return fmt.Errorf("uploaded file has %d bytes, expected %d", entry.Size, info.Size())
+	}
+
+	log.Trace("File uploaded to %s", dest)
+
+	return nil
+}
+
+// upload sends a file in a single request
+func (w *WebDAVConfig) upload(f io.Reader, size int64, filename string, dest string) error {
+	tmp := w.fileURL(path.Join(path.Dir(filename), "."+path.Base(filename)+partialSuffix))
+
+	res, err := w.do(http.MethodPut, tmp, f, size, nil)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	header := http.Header{}
+	header.Set("Destination", dest)
+	header.Set("Overwrite", "T")
+
+	if err = w.request("MOVE", tmp, header); err != nil {
+		w.request(http.MethodDelete, tmp, nil)
+		return fmt.Errorf("cannot move uploaded file, %v", err)
+	}
+
+	return nil
+}
+
+// uploadChunks sends a file in chunks to a new Nextcloud upload, the file
+// is assembled on its destination by moving the upload
+func (w *WebDAVConfig) uploadChunks(uploads string, f io.ReaderAt, size int64, dest string) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	upload := uploads + "/dbacker-" + hex.EncodeToString(id)
+
+	header := http.Header{}
+	header.Set("Destination", dest)
+
+	if err := w.request("MKCOL", upload, header); err != nil {
+		return fmt.Errorf("cannot create upload, %v", err)
+	}
+
+	err := func() error {
+		header.Set("OC-Total-Length", strconv.FormatInt(size, 10))
+
+		for offset, n := int64(0), 1; offset < size; offset, n = offset+w.ChunkSize, n+1 {
+			length := w.ChunkSize
+			if offset+length > size {
+				length = size - offset
+			}
+
+			res, err := w.do(http.MethodPut, fmt.Sprintf("%s/%05d", upload, n), io.NewSectionReader(f, offset, length), length, header)
+			if err != nil {
+				return fmt.Errorf("cannot upload chunk %d, %v", n, err)
+			}
+
+			res.Body.Close()
+		}
+
+		header.Set("Overwrite", "T")
+
+		if err := w.request("MOVE", upload+"/.file", header); err != nil {
+			return fmt.Errorf("cannot assemble chunks, %v", err)
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		if derr := w.request(http.MethodDelete, upload, nil); derr != nil {
+			log.Warn("Cannot remove upload %s, %v", upload, derr)
+		}
+	}
+
+	return err
+}
+
+// Retrieve downloads a file of the WebDAV store to the local filesystem
+func (w *WebDAVConfig) Retrieve(filename string) (string, error) {
+	entry, err := w.stat(filename)
+	if err != nil {
+		return "", fmt.Errorf("cannot read remote file %s, %v", filename, err)
+	}
+
+	if err = checkFreeSpace(w.SaveDir, entry.Size); err != nil {
+		return "", err
+	}
+
+	filepath, err := downloadFile(w.SaveDir, path.Base(filename), func(f *os.File) error {
+		body, err := w.Stream(filename)
+		if err != nil {
+			return err
+		}
+
+		defer body.Close()
+
+		n, err := io.Copy(f, body)
+		if err != nil {
+			return fmt.Errorf("failed to download file, %v", err)
+		}
+
+		if n != entry.Size {
+			return fmt.Errorf("downloaded file has %d bytes, expected %d", n, entry.Size)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Trace("File downloaded to %s", filepath)
+	w.retrievedFiles = append(w.retrievedFiles, filepath)
+
+	return filepath, nil
+}
+
+// Stream returns a reader of a file of the WebDAV store
+func (w *WebDAVConfig) Stream(filename string) (io.ReadCloser, error) {
+	res, err := w.do(http.MethodGet, w.fileURL(filename), nil, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download file %s, %v", filename, err)
+	}
+
+	return res.Body, nil
+}
+
+// listBackups returns the names of the files of the collection, sorted like
+// the filesystem store, and the names of their indexes. Collections and
+// partial uploads are skipped
+func (w *WebDAVConfig) listBackups() ([]remoteObject, map[string]bool, error) {
+	entries, err := w.readDir("")
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list contents of %s, %v", w.URL, err)
+	}
+
+	var objects []remoteObject
+	indexes := make(map[string]bool)
+
+	for _, entry := range entries {
+		switch {
+		case entry.Collection || strings.HasSuffix(entry.Path, partialSuffix):
+		case isBackupIndex(entry.Path):
+			indexes[entry.Path] = true
+		default:
+			objects = append(objects, remoteObject{Key: entry.Path, LastModified: entry.LastModified})
+		}
+	}
+
+	return objects, indexes, nil
+}
+
+// listBinlogs returns the binlogs archived in the binlog collection
+func (w *WebDAVConfig) listBinlogs() ([]remoteObject, error) {
+	entries, err := w.readDir(BinlogDir)
+	if isWebDAVStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list binlogs of %s, %v", w.URL, err)
+	}
+
+	var binlogs []remoteObject
+	for _, entry := range entries {
+		if !entry.Collection && !strings.HasSuffix(entry.Path, partialSuffix) {
+			binlogs = append(binlogs, remoteObject{Key: path.Join(BinlogDir, entry.Path), LastModified: entry.LastModified})
+		}
+	}
+
+	return binlogs, nil
+}
+
+// RemoveOlderBackups keeps the most recent backups of the WebDAV store and deletes the old ones
+// along with the binlogs they don't need
+func (w *WebDAVConfig) RemoveOlderBackups(keep int) error {
+	objects, indexes, err := w.listBackups()
+	if err != nil {
+		return err
+	}
+
+	binlogs, err := w.listBinlogs()
+	if err != nil {
+		return err
+	}
+
+	count := len(objects) - keep
+	if count < 0 {
+		count = 0
+	}
+
+	var files []string
+	for _, obj := range objects[:count] {
+		files = append(files, obj.Key)
+	}
+
+	files = append(withIndexes(files, indexes), expiredBinlogs(binlogs, objects[count:])...)
+	if len(files) == 0 {
+		return nil
+	}
+
+	var failed []string
+	for _, file := range files {
+		log.Trace("Deleting %s", w.fileURL(file))
+
+		if err = w.request(http.MethodDelete, w.fileURL(file), nil); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", file, err))
+		}
+	}
+
+	log.Trace("Deleted %d files from %s", len(files)-len(failed), w.URL)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't delete %d files, %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the WebDAV store
+func (w *WebDAVConfig) FindLatestBackup() (string, error) {
+	objects, _, err := w.listBackups()
+	if err != nil {
+		return "", err
+	}
+
+	if len(objects) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on %s", w.URL)
+	}
+
+	return objects[len(objects)-1].Key, nil
+}
+
+// List returns the files under a collection of the store
+func (w *WebDAVConfig) List(prefix string) ([]string, error) {
+	var files []string
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := w.readDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Path)
+			if entry.Collection {
+				if err = walk(name); err != nil {
+					return err
+				}
+			} else if !strings.HasSuffix(name, partialSuffix) {
+				files = append(files, name)
+			}
+		}
+
+		return nil
+	}
+
+	err := walk(prefix)
+	if isWebDAVStatus(err, http.StatusNotFound) && len(files) == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list contents of %s, %v", w.fileURL(prefix), err)
+	}
+
+	return files, nil
+}
+
+// Remove deletes a file of the store
+func (w *WebDAVConfig) Remove(filename string) error {
+	err := w.request(http.MethodDelete, w.fileURL(filename), nil)
+	if err != nil && !isWebDAVStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("cannot remove file %s, %v", filename, err)
+	}
+
+	return nil
+}
+
+// Close removes the downloaded files
+func (w *WebDAVConfig) Close() {
+	for _, file := range w.retrievedFiles {
+		removeDownloaded(file)
+	}
+
+	w.retrievedFiles = nil
+}
@@ -0,0 +1,131 @@
+package stores
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebDAVStoreRetrieve(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "webdav")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	root := path.Join(tmp, "remote")
+	r.NoError(os.Mkdir(root, 0755), "failed to create server directory")
+
+	server := newFakeWebDAV(root)
+	defer server.Close()
+
+	w := &WebDAVConfig{
+		URL:      server.URL + fakeWebDAVFiles + "/backups",
+		User:     "backup",
+		Password: "secret",
+		SaveDir:  tmp,
+	}
+
+	for _, name := range []string{"mysql-backup-20200102000000.sql", "mysql-backup-20200101000000.sql", "mysql-backup-20200103000000.sql"} {
+		filepath := path.Join(tmp, name)
+		r.NoError(ioutil.WriteFile(filepath, []byte(name), 0644), "failed to create file")
+		r.NoError(w.Store(filepath, name), "failed to store file")
+	}
+
+	r.False(server.exists("backups/.mysql-backup-20200103000000.sql"+partialSuffix), "the temporary file must be moved")
+
+	// interrupted uploads are never taken as backups
+	r.NoError(ioutil.WriteFile(path.Join(root, "backups", ".mysql-backup-20200104000000.sql"+partialSuffix), []byte("partial"), 0644))
+
+	latest, err := w.FindLatestBackup()
+	r.NoError(err, "failed to find the latest backup")
+	r.Equal("mysql-backup-20200103000000.sql", latest)
+
+	retrieved, err := w.Retrieve(latest)
+	r.NoError(err, "failed to retrieve file")
+
+	data, err := ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read retrieved file")
+	r.Equal([]byte(latest), data)
+
+	w.Close()
+	r.Empty(retrievedDirs(t, tmp), "the retrieved files must be removed")
+
+	r.NoError(w.RemoveOlderBackups(1), "failed to remove backups")
+
+	filepath := path.Join(tmp, "chunk")
+	r.NoError(ioutil.WriteFile(filepath, []byte("chunk"), 0644), "failed to create file")
+	r.NoError(w.Store(filepath, "chunks/ab/chunk"), "failed to store nested file")
+
+	files, err := w.List("")
+	r.NoError(err, "failed to list files")
+	r.Equal([]string{"chunks/ab/chunk", "mysql-backup-20200103000000.sql"}, files)
+
+	files, err = w.List("missing")
+	r.NoError(err, "missing collections must be empty")
+	r.Empty(files)
+
+	r.NoError(w.Remove(latest), "failed to remove file")
+	r.NoError(w.Remove(latest), "missing files must be ignored")
+
+	w.Password = "invalid"
+	_, err = w.FindLatestBackup()
+	r.Error(err, "invalid credentials must fail")
+}
+
+func TestWebDAVChunkedUpload(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "webdav")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	root := path.Join(tmp, "remote")
+	r.NoError(os.Mkdir(root, 0755), "failed to create server directory")
+
+	server := newFakeWebDAV(root)
+	defer server.Close()
+
+	w := &WebDAVConfig{
+		URL:       server.URL + fakeWebDAVFiles + "/backups",
+		User:      "backup",
+		Password:  "secret",
+		SaveDir:   tmp,
+		ChunkSize: 64 << 10,
+	}
+
+	uploads, ok := w.uploadsURL()
+	r.True(ok, "the uploads collection must be found")
+	r.Equal(server.URL+fakeWebDAVUploads, uploads)
+
+	data := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	filepath := path.Join(tmp, "backup.tar")
+	r.NoError(ioutil.WriteFile(filepath, data, 0644), "failed to create file")
+	r.NoError(w.Store(filepath, "backup.tar"), "failed to store file")
+	r.Equal(4, server.chunkPuts, "the file must be uploaded in four chunks")
+	r.Empty(server.uploads, "the upload must be assembled")
+
+	uploaded, err := ioutil.ReadFile(path.Join(root, "backups", "backup.tar"))
+	r.NoError(err, "failed to read uploaded file")
+	r.True(bytes.Equal(data, uploaded), "contents mismatch")
+
+	reader, err := w.Stream("backup.tar")
+	r.NoError(err, "failed to stream file")
+
+	streamed, err := ioutil.ReadAll(reader)
+	r.NoError(err, "failed to read file")
+	r.True(bytes.Equal(data, streamed), "contents mismatch")
+	reader.Close()
+
+	// other servers receive the files in a single request
+	w.URL = "https://dav.example.com/backups"
+	_, ok = w.uploadsURL()
+	r.False(ok, "generic servers don't have chunked uploads")
+}